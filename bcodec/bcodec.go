@@ -2,12 +2,14 @@ package bcodec
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-	"os"
-	"path/filepath"
+	"net/netip"
 	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -16,14 +18,78 @@ import (
 
 // TODO fill in missing fields and corresponding b-decode logic
 
+var (
+	// piece length in torrent is not positive
+	ErrInvalidPieceLen = errors.New("invalid piece length")
+	// piece length in torrent is not a power of two
+	ErrPieceLenNotPowerOfTwo = errors.New("piece length is not a power of two")
+	// content length in torrent doesn't agree with the number of piece hashes
+	ErrPieceCntMismatch = errors.New("content length doesn't match piece hash count")
+)
+
+// Decodes meta info file content with default Decoder.
+func DecodeTorrent(raw []byte) (*Torrent, error) {
+	return (&Decoder{}).Decode(raw)
+}
+
+// meta info file decoder. The zero value escapes unsafe file paths and tolerates odd piece lengths.
+type Decoder struct {
+	PathPolicy PathPolicy
+	// require piece length to be a power of two
+	StrictPieceLen bool
+}
+
+// Decodes meta info file content. Unlike bencode.Unmarshal, errors returned can be matched with errors.Is.
+func (d *Decoder) Decode(raw []byte) (*Torrent, error) {
+	x := &Torrent{}
+	if err := bencode.Unmarshal(raw, x); err != nil {
+		return nil, matchable(err)
+	}
+	if x.Info == nil {
+		return nil, fmt.Errorf("Torrent has no info dictionary")
+	}
+	if d.PathPolicy == PathPolicyReject {
+		if unsafe := x.Info.EscapedPaths(); len(unsafe) > 0 {
+			return nil, fmt.Errorf("%w: torrent has unsafe name or file paths, escaped as %q", ErrUnsafePath, unsafe)
+		}
+	}
+	if err := x.Info.Validate(d.StrictPieceLen); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// bencode.UnmarshalerError doesn't support unwrapping, which hides errors returned by UnmarshalBencode
+// from errors.Is and errors.As
+type unmarshalerError struct {
+	*bencode.UnmarshalerError
+}
+
+func (e unmarshalerError) Unwrap() error {
+	return e.Err
+}
+
+func matchable(err error) error {
+	var ue *bencode.UnmarshalerError
+	if errors.As(err, &ue) {
+		return unmarshalerError{ue}
+	}
+	return err
+}
+
 // meta info file content
 type Torrent struct {
-	Info         *TorrentInfo
-	Trackers     []string
+	Info *TorrentInfo
+	// unique trackers, led by the one in announce key
+	Trackers []string
+	// trackers grouped by tier as in BEP 12; trackers in Trackers but absent here count as a tier of their own
+	TrackerTiers [][]string
 	Comment      *string
 	CreationDate *time.Time
 	HttpSeeds    []string
+	WebSeeds     []string // BEP 19 url-list
 	DhtNodes     []*DhtNode
+	PieceLayers  PieceLayers // v2 piece hashes of files spanning more than one piece
 }
 
 func (x *Torrent) UnmarshalBencode(raw []byte) error {
@@ -36,10 +102,12 @@ func (x *Torrent) UnmarshalBencode(raw []byte) error {
 		Comment           *string      `bencode:"comment,omitempty"`
 		CreationTimestamp *int64       `bencode:"creation date,omitempty"`
 		HttpSeeds         []string     `bencode:"httpseeds,omitempty"`
+		UrlList           urlList      `bencode:"url-list,omitempty"`
 		DhtNode           []*DhtNode   `bencode:"nodes,omitempty"`
+		PieceLayers       PieceLayers  `bencode:"piece layers,omitempty"`
 	}{}
 	if err := bencode.Unmarshal(raw, &tmp); err != nil {
-		return fmt.Errorf("error decoding anonymous struct for Torrent: %w", err)
+		return fmt.Errorf("error decoding anonymous struct for Torrent: %w", matchable(err))
 	}
 	// validate that all text strings are valid UTF-8 encoded strings
 	if tmp.Comment != nil {
@@ -52,25 +120,48 @@ func (x *Torrent) UnmarshalBencode(raw []byte) error {
 			return fmt.Errorf("url in Torrent http seeds is invalid UTF-8 string: %w", err)
 		}
 	}
+	for _, s := range tmp.UrlList {
+		if err := validateUtf8Str(s); err != nil {
+			return fmt.Errorf("url in Torrent url-list is invalid UTF-8 string: %w", err)
+		}
+	}
 	if err := validateUtf8Str(tmp.Announce); err != nil {
 		return fmt.Errorf("Torrent announce url is invalid UTF-8 string: %w", err)
 	}
-	// collect unique trackers
-	visited := map[string]struct{}{
-		tmp.Announce: {},
+	// collect unique trackers, keeping their tiers. Either announce or announce-list may be absent
+	visited := map[string]struct{}{}
+	var uniq_trackers []string
+	if tmp.Announce != "" {
+		uniq_trackers = append(uniq_trackers, tmp.Announce)
+		visited[tmp.Announce] = struct{}{}
 	}
-	uniq_trackers := []string{tmp.Announce}
+	var tiers [][]string
 	for _, ls := range tmp.AnnounceList {
+		var tier []string
 		for _, s := range ls {
 			if err := validateUtf8Str(s); err != nil {
 				return fmt.Errorf("url in Torrent announce-list is invalid UTF-8 string: %w", err)
 			}
+			if s == "" {
+				continue
+			}
 			if _, ok := visited[s]; !ok {
 				uniq_trackers = append(uniq_trackers, s)
 				visited[s] = struct{}{}
 			}
+			if !containsStr(tiers, s) && !containsStr([][]string{tier}, s) {
+				tier = append(tier, s)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
 		}
 	}
+	// tracker in announce key but not in announce-list forms the first tier on its own
+	if tmp.Announce != "" && !containsStr(tiers, tmp.Announce) {
+		tiers = append([][]string{{tmp.Announce}}, tiers...)
+	}
+	x.TrackerTiers = tiers
 	// convert creation date timestamp
 	if tmp.CreationTimestamp != nil {
 		t := time.Unix(*tmp.CreationTimestamp, 0)
@@ -80,7 +171,104 @@ func (x *Torrent) UnmarshalBencode(raw []byte) error {
 	x.Trackers = uniq_trackers
 	x.Comment = tmp.Comment
 	x.HttpSeeds = tmp.HttpSeeds
+	x.WebSeeds = tmp.UrlList
 	x.DhtNodes = tmp.DhtNode
+	x.PieceLayers = tmp.PieceLayers
+	if x.Info != nil && x.Info.HasV2() {
+		if err := x.Info.validatePieceLayers(x.PieceLayers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalBencode encodes the torrent as a canonical bencode dictionary. The info dictionary is re-emitted
+// verbatim when it was decoded from a meta info file, therefore the info hash never changes.
+func (x *Torrent) MarshalBencode() ([]byte, error) {
+	if x.Info == nil {
+		return nil, fmt.Errorf("Torrent has no info dictionary to encode")
+	}
+	tmp := struct {
+		Info              *TorrentInfo      `bencode:"info"`
+		Announce          string            `bencode:"announce,omitempty"`
+		AnnounceList      [][]string        `bencode:"announce-list,omitempty"`
+		Comment           *string           `bencode:"comment,omitempty"`
+		CreationTimestamp *int64            `bencode:"creation date,omitempty"`
+		HttpSeeds         []string          `bencode:"httpseeds,omitempty"`
+		UrlList           []string          `bencode:"url-list,omitempty"`
+		DhtNode           []*DhtNode        `bencode:"nodes,omitempty"`
+		PieceLayers       map[string][]byte `bencode:"piece layers,omitempty"`
+	}{
+		Info:        x.Info,
+		Comment:     x.Comment,
+		HttpSeeds:   x.HttpSeeds,
+		UrlList:     x.WebSeeds,
+		DhtNode:     x.DhtNodes,
+		PieceLayers: x.PieceLayers,
+	}
+	if len(x.Trackers) > 0 {
+		tmp.Announce = x.Trackers[0]
+	}
+	tiers := x.Tiers()
+	// announce key alone suffices for single tracker
+	if len(tiers) > 1 || (len(tiers) == 1 && (len(tiers[0]) > 1 || tiers[0][0] != tmp.Announce)) {
+		tmp.AnnounceList = tiers
+	}
+	if x.CreationDate != nil {
+		ts := x.CreationDate.Unix()
+		tmp.CreationTimestamp = &ts
+	}
+	return bencode.Marshal(&tmp)
+}
+
+/*
+Returns trackers grouped by tier, in the order of failover as described in BEP 12.
+
+Trackers listed in Trackers but absent in TrackerTiers, e.g. ones added after decoding, each make up a tier
+of their own following the existing tiers.
+*/
+func (x *Torrent) Tiers() [][]string {
+	res := make([][]string, 0, len(x.TrackerTiers))
+	for _, tier := range x.TrackerTiers {
+		if len(tier) > 0 {
+			res = append(res, tier)
+		}
+	}
+	for _, s := range x.Trackers {
+		if s != "" && !containsStr(res, s) {
+			res = append(res, []string{s})
+		}
+	}
+	return res
+}
+
+func containsStr(tiers [][]string, s string) bool {
+	for _, tier := range tiers {
+		for _, e := range tier {
+			if e == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// url-list holds either a single url or a list of urls
+type urlList []string
+
+func (x *urlList) UnmarshalBencode(raw []byte) error {
+	var url string
+	if err := bencode.Unmarshal(raw, &url); err == nil {
+		if url != "" {
+			*x = urlList{url}
+		}
+		return nil
+	}
+	var urls []string
+	if err := bencode.Unmarshal(raw, &urls); err != nil {
+		return fmt.Errorf("url-list is neither a string nor a list of strings: %w", err)
+	}
+	*x = urls
 	return nil
 }
 
@@ -93,41 +281,84 @@ func validateUtf8Str(s string) error {
 
 // meta info dictionary content
 type TorrentInfo struct {
-	Name          string
-	Hash          []byte // info dictionary sha1 hash
+	Name string
+	// info hash used with trackers and peers: info dictionary sha1 hash, or sha256 hash truncated to 20 bytes
+	// for v2-only torrents
+	Hash          []byte
+	HashV2        []byte // info dictionary sha256 hash, only present for v2 and hybrid torrents
+	MetaVersion   int64  // 2 for v2 and hybrid torrents (BEP 52), 1 otherwise
 	PieceLenBytes int64
-	Pieces        []byte
+	// v1 piece hashes, nil for v2-only torrents
+	Pieces []byte
+	// merkle root of single-file v2 torrents; see FileSpec.PiecesRoot for multi-file ones
+	PiecesRoot []byte
 	// TODO make this always available as the total length of the file
 	LenBytes int64
 	Files    []*FileSpec
+	// whether peers shall only be obtained from trackers listed in the torrent
+	Private bool
+	// whether name in torrent is unsafe and got escaped
+	nameEscaped bool
+	// bencoded info dictionary as found in meta info file. It takes precedence over other fields in
+	// b-encoding so that the info hash stays the same; reset it to nil after altering other fields.
+	Raw []byte
 }
 
 func (x *TorrentInfo) UnmarshalBencode(raw []byte) error {
 	// attention: no way unmarshal the struct directly, otherwise we run into infinite recursion and stack overflow
 	tmp := struct {
-		Name          string      `bencode:"name"`
-		PieceLenBytes int64       `bencode:"piece length"`
-		Pieces        string      `bencode:"pieces"`
-		LenBytes      *int64      `bencode:"length,omitempty"`
-		Files         []*FileSpec `bencode:"files,omitempty"`
+		Name          string        `bencode:"name"`
+		PieceLenBytes int64         `bencode:"piece length"`
+		Pieces        *string       `bencode:"pieces,omitempty"`
+		LenBytes      *int64        `bencode:"length,omitempty"`
+		Files         []*FileSpec   `bencode:"files,omitempty"`
+		Private       *int64        `bencode:"private,omitempty"`
+		MetaVersion   *int64        `bencode:"meta version,omitempty"`
+		FileTree      bencode.Bytes `bencode:"file tree,omitempty"`
 	}{}
 	if err := bencode.Unmarshal(raw, &tmp); err != nil {
-		return fmt.Errorf("error decoding TorrentInfo struct: %w", err)
+		return fmt.Errorf("error decoding TorrentInfo struct: %w", matchable(err))
 	}
 	// validate value of name key is valid UTF-8 encoded string
 	if err := validateUtf8Str(tmp.Name); err != nil {
 		return fmt.Errorf("TorrentInfo name is not valid UTF-8 string: %w", err)
 	}
-	if len(tmp.Pieces)%20 != 0 {
-		return fmt.Errorf("TorrentInfo pieces byte string length is not a multiple of 20")
+	// name is used as file or directory name thus is subject to the same rules as file paths
+	x.Name = sanitizeSegment(tmp.Name)
+	x.nameEscaped = x.Name != tmp.Name
+	x.MetaVersion = 1
+	if tmp.MetaVersion != nil {
+		x.MetaVersion = *tmp.MetaVersion
+	}
+	if x.MetaVersion != 1 && x.MetaVersion != 2 {
+		return fmt.Errorf("unsupported TorrentInfo meta version %d", x.MetaVersion)
+	}
+	if tmp.PieceLenBytes <= 0 {
+		return fmt.Errorf("%w: TorrentInfo piece length %d is not positive", ErrInvalidPieceLen, tmp.PieceLenBytes)
+	}
+	if tmp.Pieces == nil && x.MetaVersion == 1 {
+		return fmt.Errorf("TorrentInfo has neither v1 pieces nor v2 file tree")
+	}
+	if tmp.Pieces != nil {
+		if len(*tmp.Pieces)%20 != 0 {
+			return fmt.Errorf("TorrentInfo pieces byte string length is not a multiple of 20")
+		}
+		x.Pieces = []byte(*tmp.Pieces)
 	}
-	x.Name = tmp.Name
 	x.PieceLenBytes = tmp.PieceLenBytes
-	x.Pieces = []byte(tmp.Pieces)
 	x.Files = tmp.Files
-	// TODO verify that value of length field / aggregated length value of all files involved is identical to
-	// the product of piece length and # piece hashes present in torrent file, instead of blindly trust the
-	// length values
+	x.Private = tmp.Private != nil && *tmp.Private == 1
+	if x.MetaVersion == 2 {
+		if err := x.decodeFileTree(tmp.FileTree, tmp.Pieces != nil); err != nil {
+			return err
+		}
+		h := sha256.Sum256(raw)
+		x.HashV2 = h[:]
+		if tmp.Pieces == nil && x.Files == nil {
+			// single-file v2-only torrent has its length in file tree only
+			tmp.LenBytes = &x.LenBytes
+		}
+	}
 	if tmp.LenBytes != nil {
 		// overflow?
 		if *tmp.LenBytes < 0 {
@@ -141,14 +372,131 @@ func (x *TorrentInfo) UnmarshalBencode(raw []byte) error {
 		}
 		x.LenBytes = totalBytes
 	}
+	if err := x.Validate(false); err != nil {
+		return err
+	}
 	// compute info hash. hash.Hash.Write() never return an error
-	h := sha1.New()
-	_, _ = h.Write(raw)
-	buf := make([]byte, 0, 20)
-	x.Hash = h.Sum(buf)
+	if x.HasV1() {
+		h := sha1.New()
+		_, _ = h.Write(raw)
+		buf := make([]byte, 0, 20)
+		x.Hash = h.Sum(buf)
+	} else {
+		x.Hash = append([]byte(nil), x.HashV2[:20]...)
+	}
+	// raw may be part of a larger buffer owned by the caller
+	x.Raw = append([]byte(nil), raw...)
+	return nil
+}
+
+func (x *TorrentInfo) MarshalBencode() ([]byte, error) {
+	if x.Raw != nil {
+		return x.Raw, nil
+	}
+	tmp := struct {
+		Name          string                 `bencode:"name"`
+		PieceLenBytes int64                  `bencode:"piece length"`
+		Pieces        *[]byte                `bencode:"pieces,omitempty"`
+		LenBytes      *int64                 `bencode:"length,omitempty"`
+		Files         []*FileSpec            `bencode:"files,omitempty"`
+		Private       *int64                 `bencode:"private,omitempty"`
+		MetaVersion   *int64                 `bencode:"meta version,omitempty"`
+		FileTree      map[string]interface{} `bencode:"file tree,omitempty"`
+	}{
+		Name:          x.Name,
+		PieceLenBytes: x.PieceLenBytes,
+	}
+	if x.HasV1() {
+		tmp.Pieces = &x.Pieces
+		// length and files keys are mutually exclusive
+		if len(x.Files) == 0 {
+			tmp.LenBytes = &x.LenBytes
+		} else {
+			tmp.Files = x.Files
+		}
+	}
+	if x.HasV2() {
+		tmp.MetaVersion = &x.MetaVersion
+		tmp.FileTree = x.encodeFileTree()
+	}
+	if x.Private {
+		private := int64(1)
+		tmp.Private = &private
+	}
+	return bencode.Marshal(&tmp)
+}
+
+/*
+Validates piece length against content length and v1 piece hashes.
+
+In strict mode piece length is also required to be a power of two, which is what virtually all torrent
+creators do but v1 protocol doesn't mandate. Returned error can be matched against ErrInvalidPieceLen,
+ErrPieceLenNotPowerOfTwo and ErrPieceCntMismatch with errors.Is.
+*/
+func (x *TorrentInfo) Validate(strict bool) error {
+	if x.PieceLenBytes <= 0 {
+		return fmt.Errorf("%w: TorrentInfo piece length %d is not positive", ErrInvalidPieceLen, x.PieceLenBytes)
+	}
+	if strict && x.PieceLenBytes&(x.PieceLenBytes-1) != 0 {
+		return fmt.Errorf("%w: TorrentInfo piece length %d", ErrPieceLenNotPowerOfTwo, x.PieceLenBytes)
+	}
+	if !x.HasV1() {
+		// v2 piece hashes live in piece layers outside of info dictionary
+		return nil
+	}
+	expected := x.PieceCnt()
+	if actual := int64(len(x.Pieces) / 20); actual != expected {
+		return fmt.Errorf("%w: content of %d bytes needs %d pieces of %d bytes but got %d piece hashes",
+			ErrPieceCntMismatch, x.LenBytes, expected, x.PieceLenBytes, actual)
+	}
 	return nil
 }
 
+// # pieces of torrent content. Pieces of v2-only torrents are aligned to file boundaries.
+func (x *TorrentInfo) PieceCnt() int64 {
+	if x.PieceLenBytes <= 0 {
+		return 0
+	}
+	if x.HasV1() || !x.HasV2() {
+		return (x.LenBytes + x.PieceLenBytes - 1) / x.PieceLenBytes
+	}
+	var res int64
+	for _, f := range x.v2Files() {
+		res += (f.LenBytes + x.PieceLenBytes - 1) / x.PieceLenBytes
+	}
+	return res
+}
+
+// returns name and file paths which are unsafe in torrent, in their escaped form
+func (x *TorrentInfo) EscapedPaths() []string {
+	var res []string
+	if x.nameEscaped {
+		res = append(res, x.Name)
+	}
+	for _, f := range x.Files {
+		if f.escaped {
+			res = append(res, f.Path)
+		}
+	}
+	return res
+}
+
+// whether the torrent carries v1 piece hashes
+func (x *TorrentInfo) HasV1() bool {
+	return x.Pieces != nil
+}
+
+// whether the torrent carries v2 (BEP 52) file tree
+func (x *TorrentInfo) HasV2() bool {
+	return x.MetaVersion == 2
+}
+
+// whether content of info dictionary is known, rather than pending as in torrents made out of magnet links
+func (x *TorrentInfo) HasMetadata() bool {
+	// either v1 piece hashes or v2 file tree comes with piece length
+	return x.PieceLenBytes > 0 && (x.HasV1() || x.HasV2())
+}
+
 func totalFileSizeBytes(files []*FileSpec) (int64, error) {
 	var res int64 = 0
 	for _, f := range files {
@@ -188,15 +536,31 @@ func (x *DhtNode) UnmarshalBencode(raw []byte) error {
 	return nil
 }
 
+func (x *DhtNode) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal([]interface{}{x.Host, x.Port})
+}
+
 type FileSpec struct {
 	LenBytes int64
 	Path     string
+	// BEP 47 attributes, e.g. "p" for padding files
+	Attr string
+	// merkle root of the file's piece hashes in v2 torrents; absent for empty files
+	PiecesRoot []byte
+	// whether path in torrent is unsafe and got escaped
+	escaped bool
+}
+
+// whether the file only pads the preceding file to a piece boundary
+func (x *FileSpec) IsPadding() bool {
+	return strings.Contains(x.Attr, "p")
 }
 
 func (x *FileSpec) UnmarshalBencode(raw []byte) error {
 	tmp := struct {
 		LenBytes int64    `bencode:"length"`
 		Path     []string `bencode:"path"`
+		Attr     string   `bencode:"attr,omitempty"`
 	}{}
 	if err := bencode.Unmarshal(raw, &tmp); err != nil {
 		return fmt.Errorf("error decoding anonymous struct for FileSpec: %w", err)
@@ -204,41 +568,100 @@ func (x *FileSpec) UnmarshalBencode(raw []byte) error {
 	if len(tmp.Path) == 0 {
 		return fmt.Errorf("got zero-length path list for FileSpec")
 	}
-	for _, s := range tmp.Path {
-		if err := validateUtf8Str(s); err != nil {
-			return fmt.Errorf("path list segment for FileSpec is not valid UTF-8 string: %w", err)
-		}
+	if tmp.LenBytes < 0 {
+		return fmt.Errorf("got negative length %d for FileSpec", tmp.LenBytes)
+	}
+	path, escaped, err := sanitizePath(tmp.Path)
+	if err != nil {
+		return fmt.Errorf("path list segment for FileSpec is not valid UTF-8 string: %w", err)
 	}
-	// all path segments are valid UTF-8 encoded strings, create os specific file path
-	x.Path = filepath.Join(tmp.Path...)
+	x.Path = path
+	x.escaped = escaped
 	x.LenBytes = tmp.LenBytes
+	x.Attr = tmp.Attr
 	return nil
 }
 
+func (x *FileSpec) MarshalBencode() ([]byte, error) {
+	tmp := struct {
+		LenBytes int64    `bencode:"length"`
+		Path     []string `bencode:"path"`
+		Attr     string   `bencode:"attr,omitempty"`
+	}{
+		LenBytes: x.LenBytes,
+		Path:     pathSegments(x.Path),
+		Attr:     x.Attr,
+	}
+	return bencode.Marshal(&tmp)
+}
+
+// tracker asks client not to retry the failed announce, see TrackerRsp.RetryIn
+const RetryNever time.Duration = -1
+
 type TrackerRsp struct {
 	FailureReason *string
-	WarningMsg    *string
-	PollInterval  *time.Duration
-	TrackerID     *string
-	SeederCnt     *int
-	LeecherCnt    *int
-	PeerAddrs     PeerAddrs
+	// BEP 31 duration to wait before retrying a failed announce; RetryNever if tracker asks not to retry
+	RetryIn    *time.Duration
+	WarningMsg *string
+	// interval between regular announces tracker asks clients to respect
+	PollInterval *time.Duration
+	// interval below which tracker may reject announces, e.g. when announcing on demand
+	MinPollInterval *time.Duration
+	TrackerID       *string
+	SeederCnt       *int
+	LeecherCnt      *int
+	// addresses of both IPv4 and IPv6 peers
+	PeerAddrs PeerAddrs
+	// same peers as in PeerAddrs along with their ids if available
+	Peers []*Peer
+	// client's IP address seen by tracker; zero Addr if tracker doesn't report it
+	ExternalIP netip.Addr
+	// raw values of keys unknown to TrackerRsp, retained as is during bencoding
+	Extra map[string]bencode.Bytes
+}
+
+// keys TrackerRsp knows how to (un)marshal
+var trackerRspKeys = map[string]struct{}{
+	"failure reason": {}, "retry in": {}, "warning message": {}, "interval": {}, "min interval": {},
+	"tracker id": {}, "complete": {}, "incomplete": {}, "peers": {}, "peers6": {}, "external ip": {},
 }
 
 func (x *TrackerRsp) UnmarshalBencode(raw []byte) error {
 	tmp := struct {
-		FailureReason          *string   `bencode:"failure reason,omitempty"`
-		WarningMsg             *string   `bencode:"warning message,omitempty"`
-		PollIntervalSeconds    *int64    `bencode:"interval,omitempty"`
-		MinPollIntervalSeconds *int64    `bencode:"min interval,omitempty"`
-		TrackerID              *string   `bencode:"tracker id,omitempty"`
-		SeederCnt              *int      `bencode:"complete,omitempty"`
-		LeecherCnt             *int      `bencode:"incomplete,omitempty"`
-		PeerAddrs              PeerAddrs `bencode:"peers,omitempty"`
+		FailureReason          *string       `bencode:"failure reason,omitempty"`
+		RetryIn                bencode.Bytes `bencode:"retry in,omitempty"`
+		WarningMsg             *string       `bencode:"warning message,omitempty"`
+		PollIntervalSeconds    *int64        `bencode:"interval,omitempty"`
+		MinPollIntervalSeconds *int64        `bencode:"min interval,omitempty"`
+		TrackerID              *string       `bencode:"tracker id,omitempty"`
+		SeederCnt              *int          `bencode:"complete,omitempty"`
+		LeecherCnt             *int          `bencode:"incomplete,omitempty"`
+		Peers                  bencode.Bytes `bencode:"peers,omitempty"`
+		Peers6                 bencode.Bytes `bencode:"peers6,omitempty"`
+		ExternalIP             []byte        `bencode:"external ip,omitempty"`
 	}{}
 	if err := bencode.Unmarshal(raw, &tmp); err != nil {
 		return fmt.Errorf("error decoding anonymous struct for TrackerRsp: %w", err)
 	}
+	all := map[string]bencode.Bytes{}
+	if err := bencode.Unmarshal(raw, &all); err != nil {
+		return fmt.Errorf("error decoding keys of TrackerRsp: %w", err)
+	}
+	for k, v := range all {
+		if _, ok := trackerRspKeys[k]; !ok {
+			if x.Extra == nil {
+				x.Extra = map[string]bencode.Bytes{}
+			}
+			x.Extra[k] = v
+		}
+	}
+	if tmp.RetryIn != nil {
+		retryIn, err := decodeRetryIn(tmp.RetryIn)
+		if err != nil {
+			return err
+		}
+		x.RetryIn = &retryIn
+	}
 	if ptr := tmp.FailureReason; ptr != nil {
 		if err := validateUtf8Str(*ptr); err != nil {
 			return fmt.Errorf("failure reason presents in tracker response but is invalid UTF-8 sring: %w", err)
@@ -253,73 +676,271 @@ func (x *TrackerRsp) UnmarshalBencode(raw []byte) error {
 		}
 		x.WarningMsg = ptr
 	}
-	var pollIntervalSeconds int64 = 0
 	if ptr := tmp.PollIntervalSeconds; ptr != nil {
-		pollIntervalSeconds = *ptr
+		duration := time.Duration(*ptr) * time.Second
+		x.PollInterval = &duration
 	}
 	if ptr := tmp.MinPollIntervalSeconds; ptr != nil {
-		pollIntervalSeconds = *ptr
+		duration := time.Duration(*ptr) * time.Second
+		x.MinPollInterval = &duration
 	}
-	duration := time.Duration(pollIntervalSeconds) * time.Second
-	x.PollInterval = &duration
 	x.TrackerID = tmp.TrackerID
 	x.SeederCnt = tmp.SeederCnt
 	x.LeecherCnt = tmp.LeecherCnt
-	x.PeerAddrs = tmp.PeerAddrs
+	if tmp.Peers != nil {
+		peers, err := decodePeers(tmp.Peers, 4)
+		if err != nil {
+			return err
+		}
+		x.Peers = peers
+	}
+	// BEP 7 IPv6 peers
+	if tmp.Peers6 != nil {
+		peers, err := decodePeers(tmp.Peers6, 16)
+		if err != nil {
+			return fmt.Errorf("error decoding IPv6 peer list: %w", err)
+		}
+		x.Peers = append(x.Peers, peers...)
+	}
+	if x.Peers != nil {
+		x.PeerAddrs = peerAddrs(x.Peers)
+	}
+	if tmp.ExternalIP != nil {
+		addr, ok := netip.AddrFromSlice(tmp.ExternalIP)
+		if !ok {
+			return fmt.Errorf("external ip in tracker response has invalid length %d", len(tmp.ExternalIP))
+		}
+		x.ExternalIP = addr.Unmap()
+	}
 	return nil
 }
 
+// decodes value of "retry in", which is either # minutes or string "never"
+func decodeRetryIn(raw []byte) (time.Duration, error) {
+	var minutes int64
+	if err := bencode.Unmarshal(raw, &minutes); err == nil {
+		if minutes < 0 {
+			return 0, fmt.Errorf("retry in in tracker response is negative: %d", minutes)
+		}
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	var s string
+	if err := bencode.Unmarshal(raw, &s); err != nil || s != "never" {
+		return 0, fmt.Errorf("retry in in tracker response is neither an integer nor \"never\": %q", raw)
+	}
+	return RetryNever, nil
+}
+
+func (x *TrackerRsp) MarshalBencode() ([]byte, error) {
+	tmp := struct {
+		FailureReason          *string       `bencode:"failure reason,omitempty"`
+		RetryIn                bencode.Bytes `bencode:"retry in,omitempty"`
+		WarningMsg             *string       `bencode:"warning message,omitempty"`
+		PollIntervalSeconds    *int64        `bencode:"interval,omitempty"`
+		MinPollIntervalSeconds *int64        `bencode:"min interval,omitempty"`
+		TrackerID              *string       `bencode:"tracker id,omitempty"`
+		SeederCnt              *int          `bencode:"complete,omitempty"`
+		LeecherCnt             *int          `bencode:"incomplete,omitempty"`
+		Peers                  bencode.Bytes `bencode:"peers,omitempty"`
+		Peers6                 []byte        `bencode:"peers6,omitempty"`
+		ExternalIP             []byte        `bencode:"external ip,omitempty"`
+	}{
+		FailureReason: x.FailureReason,
+	}
+	if x.RetryIn != nil {
+		if *x.RetryIn == RetryNever {
+			tmp.RetryIn = bencode.MustMarshal("never")
+		} else {
+			tmp.RetryIn = bencode.MustMarshal(int64(*x.RetryIn / time.Minute))
+		}
+	}
+	if x.FailureReason == nil {
+		tmp.WarningMsg = x.WarningMsg
+		tmp.TrackerID = x.TrackerID
+		tmp.SeederCnt = x.SeederCnt
+		tmp.LeecherCnt = x.LeecherCnt
+		// typed peers take precedence and are encoded in binary mode, IPv6 ones separately as per BEP 7
+		if x.Peers != nil {
+			v4, v6 := EncodeCompactPeers(x.Peers)
+			tmp.Peers = bencode.MustMarshal(v4)
+			tmp.Peers6 = v6
+		} else if x.PeerAddrs != nil {
+			peers, err := x.PeerAddrs.MarshalBencode()
+			if err != nil {
+				return nil, err
+			}
+			tmp.Peers = peers
+		}
+		if x.PollInterval != nil {
+			seconds := int64(*x.PollInterval / time.Second)
+			tmp.PollIntervalSeconds = &seconds
+		}
+		if x.MinPollInterval != nil {
+			seconds := int64(*x.MinPollInterval / time.Second)
+			tmp.MinPollIntervalSeconds = &seconds
+		}
+		if x.ExternalIP.IsValid() {
+			tmp.ExternalIP = x.ExternalIP.AsSlice()
+		}
+	}
+	if len(x.Extra) == 0 {
+		return bencode.Marshal(&tmp)
+	}
+	// merge unknown keys in; bencoding maps always sorts keys
+	b, err := bencode.Marshal(&tmp)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]bencode.Bytes{}
+	if err := bencode.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range x.Extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return bencode.Marshal(all)
+}
+
 // peer address in form of concatenation of hostname and port
 type PeerAddrs []string
 
-// bittorrent peer address. NOTE only use this in bdecode
-//type PeerAddr struct {
-//	// peer ID seems useless so exclude it for now
-//	Hostname string
-//	Port     int
-//}
-
 func (x *PeerAddrs) UnmarshalBencode(raw []byte) error {
-	// parse peer list in binary mode first as this is preferred by trackers, if parsing encountered error
-	// then continue parsing in list-of-dictionary mode
-	// for a peer list to be in binary mode the length of decoded peer list string must be divisible by 6.
-	if peersStr := ""; bencode.Unmarshal(raw, &peersStr) == nil && len(peersStr)%6 == 0 {
-		// possibly binary mode
-		var tmp []string
-		err := false
-		ln := len(peersStr)
-		for idx := 0; idx < ln; idx += 6 {
-			// read ip address in ipv4 format. TODO see how endian-ness can impact parsing result
-			hostname := fmt.Sprintf("%d.%d.%d.%d", peersStr[idx], peersStr[idx+1], peersStr[idx+2], peersStr[idx+3])
-			if net.ParseIP(hostname) == nil {
-				fmt.Fprintf(os.Stderr, "error parsing ip address in peer list: %s peer list may be in list-of-dictionary mode", hostname)
-				err = true
-				break
-			}
-			port := int(binary.BigEndian.Uint16([]byte(peersStr[idx+4 : idx+6])))
-			tmp = append(tmp, net.JoinHostPort(hostname, strconv.Itoa(port)))
+	peers, err := decodePeers(raw, 4)
+	if err != nil {
+		return err
+	}
+	*x = peerAddrs(peers)
+	return nil
+}
+
+func peerAddrs(peers []*Peer) PeerAddrs {
+	res := make(PeerAddrs, len(peers))
+	for i, p := range peers {
+		res[i] = p.String()
+	}
+	return res
+}
+
+// bittorrent peer
+type Peer struct {
+	AddrPort netip.AddrPort
+	// 20-byte peer id, only available in list-of-dictionary mode
+	ID []byte
+}
+
+func (x *Peer) String() string {
+	return x.AddrPort.String()
+}
+
+/*
+Decodes peer list in either binary (compact) or list-of-dictionary mode.
+
+Binary mode peer list is a string of addrLen-byte IP addresses each followed by a 2-byte port, all in
+network byte order. Peers with invalid address or port are dropped, as well as those identified by DNS
+names which can't be represented by netip.Addr.
+*/
+func decodePeers(raw []byte, addrLen int) ([]*Peer, error) {
+	// binary mode is preferred by trackers so try it first
+	if peersStr := ""; bencode.Unmarshal(raw, &peersStr) == nil {
+		return DecodeCompactPeers([]byte(peersStr), addrLen)
+	}
+	type PeerDict struct {
+		Hostname string `bencode:"ip"`
+		Port     int64  `bencode:"port"`
+		ID       string `bencode:"peer id,omitempty"`
+	}
+	tmp := []*PeerDict{}
+	if err := bencode.Unmarshal(raw, &tmp); err != nil {
+		// raw is malformed
+		return nil, fmt.Errorf("error decoding peer list in both binary and list-of-dictionary mode: %w", err)
+	}
+	res := make([]*Peer, 0, len(tmp))
+	for _, d := range tmp {
+		addr, err := netip.ParseAddr(d.Hostname)
+		if err != nil || addr.Zone() != "" || !validPeerAddr(addr, d.Port) {
+			continue
 		}
-		if !err {
-			*x = tmp
-			return nil
+		p := &Peer{AddrPort: netip.AddrPortFrom(addr.Unmap(), uint16(d.Port))}
+		if len(d.ID) == 20 {
+			p.ID = []byte(d.ID)
 		}
-		// otherwise proceed to parsing via list-of-dictionary mode
-	} else if peersStr != "" {
-		// here the raw data represents a (malformed) bencoded string instead of dictionary
-		return fmt.Errorf("malformed peer list in binary mode: decoded peer list string doesn't have length divisible by 6")
+		res = append(res, p)
 	}
+	return res, nil
+}
+
+// DecodeCompactPeers decodes peer list in binary mode, in which each peer takes addrLen + 2 bytes.
+func DecodeCompactPeers(b []byte, addrLen int) ([]*Peer, error) {
+	entryLen := addrLen + 2
+	if len(b)%entryLen != 0 {
+		return nil, fmt.Errorf("malformed peer list in binary mode: decoded peer list string doesn't have length divisible by %d", entryLen)
+	}
+	res := make([]*Peer, 0, len(b)/entryLen)
+	for idx := 0; idx < len(b); idx += entryLen {
+		addr, _ := netip.AddrFromSlice(b[idx : idx+addrLen])
+		port := binary.BigEndian.Uint16(b[idx+addrLen : idx+entryLen])
+		if validPeerAddr(addr, int64(port)) {
+			res = append(res, &Peer{AddrPort: netip.AddrPortFrom(addr.Unmap(), port)})
+		}
+	}
+	return res, nil
+}
+
+func validPeerAddr(addr netip.Addr, port int64) bool {
+	return addr.IsValid() && !addr.IsUnspecified() && !addr.IsMulticast() && port > 0 && port <= 65535
+}
+
+// EncodeCompactPeers encodes peers in binary mode, IPv4 peers in v4 and IPv6 peers in v6.
+func EncodeCompactPeers(peers []*Peer) (v4 []byte, v6 []byte) {
+	for _, p := range peers {
+		addr, port := p.AddrPort.Addr(), p.AddrPort.Port()
+		if addr.Is4() {
+			b := addr.As4()
+			v4 = append(v4, b[:]...)
+			v4 = append(v4, byte(port>>8), byte(port))
+		} else {
+			b := addr.As16()
+			v6 = append(v6, b[:]...)
+			v6 = append(v6, byte(port>>8), byte(port))
+		}
+	}
+	return v4, v6
+}
+
+// MarshalBencode encodes peer list in binary mode if all peers have IPv4 addresses, otherwise in
+// list-of-dictionary mode.
+func (x PeerAddrs) MarshalBencode() ([]byte, error) {
 	type PeerAddr struct {
 		Hostname string `bencode:"ip"`
 		Port     int    `bencode:"port"`
 	}
-	tmp := []*PeerAddr{}
-	if err := bencode.Unmarshal(raw, &tmp); err != nil {
-		// raw is either malformed or encoded in binary mode
-		return fmt.Errorf("error decoding peer list in both binary and list-of-dictionary mode: %w", err)
+	compact := make([]byte, 0, 6*len(x))
+	dicts := make([]*PeerAddr, 0, len(x))
+	for _, addr := range x {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("malformed peer address %q: %w", addr, err)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("malformed port in peer address %q: %w", addr, err)
+		}
+		dicts = append(dicts, &PeerAddr{Hostname: host, Port: int(port)})
+		if compact == nil {
+			continue
+		}
+		if ip := net.ParseIP(host).To4(); ip != nil {
+			compact = append(compact, ip...)
+			compact = append(compact, byte(port>>8), byte(port))
+		} else {
+			// not representable in binary mode
+			compact = nil
+		}
 	}
-	for _, a := range tmp {
-		// TODO validation against hostname and port
-		*x = append(*x, net.JoinHostPort(a.Hostname, strconv.Itoa(a.Port)))
+	if compact != nil {
+		return bencode.Marshal(compact)
 	}
-	return nil
+	return bencode.Marshal(dicts)
 }
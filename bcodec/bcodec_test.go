@@ -1,7 +1,13 @@
 package bcodec
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"net/netip"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -101,14 +107,14 @@ func TestBedecode(t *testing.T) {
 		{
 			name:   "TorrentInfo: multiple files",
 			target: &TorrentInfo{},
-			data:   []byte("d5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi1024e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbce"),
+			data:   []byte("d5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi512e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbce"),
 			verify: func(t *testing.T, target bencode.Unmarshaler, err error) {
 				assert.Nil(t, err)
 				x := target.(*TorrentInfo)
 				assert.Equal(t, "foo", x.Name)
 				// assert.True(t, len(x.Hash) == 20)
-				assert.Equal(t, []byte("\x7a\xe2\x52\xce\x0d\x5b\x2a\x2f\x7f\x01\x38\x76\x3b\x0e\xfe\x40\xd6\x6d\xb2\xe0"), x.Hash)
-				assert.Equal(t, int64(1024), x.PieceLenBytes)
+				assert.Equal(t, []byte("\x3e\xc4\x19\xb1\x4f\x91\x76\x3d\xa9\x33\x4d\x0f\x93\x61\xe9\x62\xa9\x02\x11\xa4"), x.Hash)
+				assert.Equal(t, int64(512), x.PieceLenBytes)
 				assert.Equal(
 					t,
 					[]byte("\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc"),
@@ -135,24 +141,27 @@ func TestBedecode(t *testing.T) {
 		{
 			name:   "Torrent: minimal",
 			target: &Torrent{},
-			data:   []byte("d8:announce27:http://tracker.net/announce13:announce-listll23:udp://tracker1.net:688127:http://tracker.net/announceee4:infod5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi1024e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbcee"),
+			data:   []byte("d8:announce27:http://tracker.net/announce13:announce-listll23:udp://tracker1.net:688127:http://tracker.net/announceee4:infod5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi512e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbcee"),
 			verify: func(t *testing.T, target bencode.Unmarshaler, err error) {
 				assert.Nil(t, err)
 				tr := target.(*Torrent)
 				assert.Equal(t, []string{"http://tracker.net/announce", "udp://tracker1.net:6881"}, tr.Trackers)
 				assert.Equal(t, &Torrent{
 					// tracker list is deduped
-					Trackers: []string{"http://tracker.net/announce", "udp://tracker1.net:6881"},
+					Trackers:     []string{"http://tracker.net/announce", "udp://tracker1.net:6881"},
+					TrackerTiers: [][]string{{"udp://tracker1.net:6881", "http://tracker.net/announce"}},
 					Info: &TorrentInfo{
 						Name:          "foo",
-						Hash:          []byte("\x7a\xe2\x52\xce\x0d\x5b\x2a\x2f\x7f\x01\x38\x76\x3b\x0e\xfe\x40\xd6\x6d\xb2\xe0"),
-						PieceLenBytes: 1024,
+						MetaVersion:   1,
+						Hash:          []byte("\x3e\xc4\x19\xb1\x4f\x91\x76\x3d\xa9\x33\x4d\x0f\x93\x61\xe9\x62\xa9\x02\x11\xa4"),
+						PieceLenBytes: 512,
 						Pieces:        []byte("\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc"),
 						Files: []*FileSpec{
 							{LenBytes: 123, Path: filepath.Join("foo", "bar", "qux.mp4")},
 							{LenBytes: 456, Path: filepath.Join("ham", "eggs", "hot.avi")},
 						},
 						LenBytes: 579,
+						Raw:      []byte("d5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi512e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbce"),
 					},
 				}, tr)
 			},
@@ -239,15 +248,20 @@ func TestBedecode(t *testing.T) {
 				assert.Nil(t, err)
 				actual := target.(*TrackerRsp)
 				assert.Equal(t, &TrackerRsp{
-					WarningMsg:   func() *string { v := "boom!"; return &v }(),
-					PollInterval: func() *time.Duration { v := 30 * time.Second; return &v }(),
-					TrackerID:    func() *string { v := "xyz"; return &v }(),
-					SeederCnt:    func() *int { v := 1024; return &v }(),
-					LeecherCnt:   func() *int { v := 2048; return &v }(),
+					WarningMsg:      func() *string { v := "boom!"; return &v }(),
+					PollInterval:    func() *time.Duration { v := 60 * time.Second; return &v }(),
+					MinPollInterval: func() *time.Duration { v := 30 * time.Second; return &v }(),
+					TrackerID:       func() *string { v := "xyz"; return &v }(),
+					SeederCnt:       func() *int { v := 1024; return &v }(),
+					LeecherCnt:      func() *int { v := 2048; return &v }(),
 					PeerAddrs: PeerAddrs{
 						"67.215.246.202:6881",
 						"190.115.31.218:6883",
 					},
+					Peers: []*Peer{
+						newTestPeer("67.215.246.202:6881", nil),
+						newTestPeer("190.115.31.218:6883", nil),
+					},
 				}, actual)
 			},
 		},
@@ -259,15 +273,20 @@ func TestBedecode(t *testing.T) {
 				assert.Nil(t, err)
 				actual := target.(*TrackerRsp)
 				assert.Equal(t, &TrackerRsp{
-					WarningMsg:   func() *string { v := "boom!"; return &v }(),
-					PollInterval: func() *time.Duration { v := 60 * time.Second; return &v }(),
-					TrackerID:    func() *string { v := "xyz"; return &v }(),
-					SeederCnt:    func() *int { v := 1024; return &v }(),
-					LeecherCnt:   func() *int { v := 2048; return &v }(),
+					WarningMsg:      func() *string { v := "boom!"; return &v }(),
+					PollInterval:    func() *time.Duration { v := 30 * time.Second; return &v }(),
+					MinPollInterval: func() *time.Duration { v := 60 * time.Second; return &v }(),
+					TrackerID:       func() *string { v := "xyz"; return &v }(),
+					SeederCnt:       func() *int { v := 1024; return &v }(),
+					LeecherCnt:      func() *int { v := 2048; return &v }(),
 					PeerAddrs: PeerAddrs{
 						"67.215.246.202:6881",
 						"190.115.31.218:6883",
 					},
+					Peers: []*Peer{
+						newTestPeer("67.215.246.202:6881", nil),
+						newTestPeer("190.115.31.218:6883", nil),
+					},
 				}, actual)
 			},
 		},
@@ -291,3 +310,773 @@ func TestBdecodeNestedStruct(t *testing.T) {
 	t.Logf("unmarshalled fss: %v", fss)
 	assert.Equal(t, []*FileSpec{{LenBytes: 123, Path: filepath.Join("foo", "bar", "qux.mp4")}}, fss)
 }
+
+func TestBencodeRoundTrip(t *testing.T) {
+	type C struct {
+		name   string
+		target interface {
+			bencode.Unmarshaler
+			bencode.Marshaler
+		}
+		data []byte
+	}
+	tcs := []*C{
+		{
+			name:   "FileSpec",
+			target: &FileSpec{},
+			data:   []byte("d6:lengthi123e4:pathl3:foo3:bar7:qux.mp4ee"),
+		},
+		{
+			name:   "DhtNode",
+			target: &DhtNode{},
+			data:   []byte("l9:127.0.0.1i6881ee"),
+		},
+		{
+			name:   "TorrentInfo: single file",
+			target: &TorrentInfo{},
+			data:   []byte("d6:lengthi2048e4:name3:foo12:piece lengthi1024e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbce"),
+		},
+		{
+			name:   "Torrent",
+			target: &Torrent{},
+			data:   []byte("d8:announce27:http://tracker.net/announce13:announce-listll27:http://tracker.net/announce23:udp://tracker1.net:6881ee7:comment5:hello13:creation datei1650000000e9:httpseedsl22:http://seed.net/files/e4:infod5:filesld6:lengthi123e4:pathl3:foo3:bar7:qux.mp4eed6:lengthi456e4:pathl3:ham4:eggs7:hot.avieee4:name3:foo12:piece lengthi512e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbce5:nodesll9:127.0.0.1i6881eeee"),
+		},
+		{
+			name:   "TrackerRsp: w/ peer list in binary mode",
+			target: &TrackerRsp{},
+			data:   []byte("d8:completei1024e10:incompletei2048e8:intervali60e5:peers12:\x43\xd7\xf6\xca\x1a\xe1\xbe\x73\x1f\xda\x1a\xe310:tracker id3:xyz15:warning message5:boom!e"),
+		},
+		{
+			name:   "TrackerRsp: w/ IPv4 and IPv6 peer lists in binary mode",
+			target: &TrackerRsp{},
+			data:   []byte("d8:intervali60e5:peers6:\x43\xd7\xf6\xca\x1a\xe16:peers618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe3e"),
+		},
+		{
+			name:   "TrackerRsp: w/ failure reason",
+			target: &TrackerRsp{},
+			data:   []byte("d14:failure reason5:boom!e"),
+		},
+		{
+			name:   "ScrapeRsp",
+			target: &ScrapeRsp{},
+			data:   []byte("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10e4:name3:fooe20:bbbbbbbbbbbbbbbbbbbbd8:completei0e10:downloadedi0e10:incompletei1eee5:flagsd20:min_request_intervali900eee"),
+		},
+		{
+			name:   "ScrapeRsp: w/o files",
+			target: &ScrapeRsp{},
+			data:   []byte("d5:filesdee"),
+		},
+		{
+			name:   "ScrapeRsp: w/ failure reason",
+			target: &ScrapeRsp{},
+			data:   []byte("d14:failure reason5:boom!e"),
+		},
+		{
+			name:   "TrackerRsp: w/ failure reason and retry in",
+			target: &TrackerRsp{},
+			data:   []byte("d14:failure reason5:boom!8:retry in5:nevere"),
+		},
+		{
+			name:   "TrackerRsp: w/ min interval, external ip and unknown keys",
+			target: &TrackerRsp{},
+			data:   []byte("d11:external ip4:\x0a\x00\x00\x198:intervali1800e12:min intervali60e5:peers0:3:qux3:ham5:zzzzzli1eee"),
+		},
+		{
+			name:   "PeerAddrs: list-of-dictionary mode",
+			target: &PeerAddrs{},
+			data:   []byte("ld2:ip14:67.215.246.2024:porti6881eed2:ip11:2001:db8::14:porti6883eee"),
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Nil(t, bencode.Unmarshal(c.data, c.target))
+			b, err := bencode.Marshal(c.target)
+			assert.Nil(t, err)
+			assert.Equal(t, string(c.data), string(b))
+		})
+	}
+}
+
+func newTestPeer(addrPort string, id []byte) *Peer {
+	return &Peer{AddrPort: netip.MustParseAddrPort(addrPort), ID: id}
+}
+
+func TestBdecodePeers(t *testing.T) {
+	id := []byte("-GT0001-0123456789ab")
+	tcs := []struct {
+		name     string
+		data     []byte
+		expected []*Peer
+		err      bool
+	}{
+		{
+			name: "IPv6 peers in binary mode",
+			data: []byte("d5:peers0:6:peers636:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x43\xd7\xf6\xca\x1a\xe3e"),
+			expected: []*Peer{
+				newTestPeer("[2001:db8::1]:6881", nil),
+				// IPv4-mapped IPv6 address is unmapped
+				newTestPeer("67.215.246.202:6883", nil),
+			},
+		},
+		{
+			name: "IPv6 peers in binary mode - incorrect peer list byte string length",
+			data: []byte("d6:peers617:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1ae"),
+			err:  true,
+		},
+		{
+			name: "peers w/ ids in list-of-dictionary mode",
+			data: []byte("d5:peersld2:ip11:2001:db8::17:peer id20:-GT0001-0123456789ab4:porti6881eed2:ip14:67.215.246.2024:porti6883eeee"),
+			expected: []*Peer{
+				newTestPeer("[2001:db8::1]:6881", id),
+				newTestPeer("67.215.246.202:6883", nil),
+			},
+		},
+		{
+			name: "peers w/ invalid address or port are dropped",
+			data: []byte("d5:peersld2:ip11:tracker.net4:porti6881eed2:ip7:0.0.0.04:porti6881eed2:ip9:10.0.0.254:porti0eed2:ip9:10.0.0.254:porti65536eed2:ip9:10.0.0.254:porti6881eeee"),
+			expected: []*Peer{
+				newTestPeer("10.0.0.25:6881", nil),
+			},
+		},
+		{
+			name: "peers w/ zero port in binary mode are dropped",
+			data: []byte("d5:peers12:\x43\xd7\xf6\xca\x00\x00\xbe\x73\x1f\xda\x1a\xe3e"),
+			expected: []*Peer{
+				newTestPeer("190.115.31.218:6883", nil),
+			},
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			rsp := &TrackerRsp{}
+			err := bencode.Unmarshal(c.data, rsp)
+			if c.err {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.expected, rsp.Peers)
+			assert.Equal(t, peerAddrs(c.expected), rsp.PeerAddrs)
+		})
+	}
+}
+
+func TestBdecodeTrackerRspExtensions(t *testing.T) {
+	rsp := &TrackerRsp{}
+	err := bencode.Unmarshal([]byte("d11:external ip16:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x018:intervali1800e12:min intervali60e5:peers0:8:retry ini5e3:qux3:hame"), rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, 1800*time.Second, *rsp.PollInterval)
+	assert.Equal(t, time.Minute, *rsp.MinPollInterval)
+	assert.Equal(t, 5*time.Minute, *rsp.RetryIn)
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), rsp.ExternalIP)
+	assert.Equal(t, map[string]bencode.Bytes{"qux": bencode.Bytes("3:ham")}, rsp.Extra)
+
+	rsp = &TrackerRsp{}
+	err = bencode.Unmarshal([]byte("d8:intervali1800ee"), rsp)
+	assert.Nil(t, err)
+	assert.Nil(t, rsp.MinPollInterval)
+	assert.Nil(t, rsp.RetryIn)
+	assert.False(t, rsp.ExternalIP.IsValid())
+	assert.Nil(t, rsp.Extra)
+
+	for _, data := range []string{
+		"d14:failure reason5:boom!8:retry in5:latere",
+		"d14:failure reason5:boom!8:retry ini-1ee",
+		"d11:external ip3:\x0a\x00\x008:intervali1800ee",
+	} {
+		assert.NotNil(t, bencode.Unmarshal([]byte(data), &TrackerRsp{}), data)
+	}
+}
+
+func TestBdecodeScrapeRsp(t *testing.T) {
+	rsp := &ScrapeRsp{}
+	assert.Nil(t, bencode.Unmarshal([]byte("d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei5e10:downloadedi50e10:incompletei10e4:name3:fooeee"), rsp))
+	name := "foo"
+	assert.Equal(t, &ScrapeStats{SeederCnt: 5, CompletedCnt: 50, LeecherCnt: 10, Name: &name}, rsp.Stats([]byte("aaaaaaaaaaaaaaaaaaaa")))
+	assert.Nil(t, rsp.Stats([]byte("bbbbbbbbbbbbbbbbbbbb")))
+	assert.Nil(t, rsp.MinRequestInterval)
+	// info hash must be 20 bytes long
+	assert.NotNil(t, bencode.Unmarshal([]byte("d5:filesd3:aaad8:completei5e10:downloadedi50e10:incompletei10eeee"), &ScrapeRsp{}))
+}
+
+func TestBencodeEditedTorrent(t *testing.T) {
+	data := []byte("d8:announce27:http://tracker.net/announce4:infod6:lengthi2048e4:name3:foo12:piece lengthi1024e6:pieces40:\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc\xbd\xf1\x3d\xff\x92\xe2\x8c\x98\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98\xbd\xb2\x3d\xbc7:privatei1eee")
+	tr := &Torrent{}
+	assert.Nil(t, bencode.Unmarshal(data, tr))
+	comment := "edited"
+	tr.Comment = &comment
+	tr.Trackers = []string{"udp://tracker1.net:6881", "http://tracker.net/announce"}
+	b, err := bencode.Marshal(tr)
+	assert.Nil(t, err)
+	edited := &Torrent{}
+	assert.Nil(t, bencode.Unmarshal(b, edited))
+	// keys unknown to TorrentInfo, e.g. private, are retained along with the info hash
+	assert.Equal(t, tr.Info.Hash, edited.Info.Hash)
+	assert.Equal(t, tr.Info.Raw, edited.Info.Raw)
+	assert.Equal(t, "edited", *edited.Comment)
+	assert.Equal(t, tr.Trackers, edited.Trackers)
+}
+
+func TestNewTorrent(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "foo")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "bar"), 0o755))
+	content := map[string][]byte{
+		filepath.Join("bar", "qux.mp4"): make([]byte, 40<<10),
+		"ham.avi":                       []byte("eggs"),
+	}
+	for p, b := range content {
+		for i := range b {
+			b[i] = byte(i % 251)
+		}
+		assert.Nil(t, os.WriteFile(filepath.Join(root, p), b, 0o644))
+	}
+	comment := "hello"
+	tr, err := NewTorrent(root, &CreateOpts{
+		Trackers: []string{"http://tracker.net/announce"},
+		Comment:  &comment,
+		WebSeeds: []string{"http://seed.net/files/"},
+		Private:  true,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", tr.Info.Name)
+	assert.Equal(t, int64(16<<10), tr.Info.PieceLenBytes)
+	// files are collected in lexical order
+	assert.Equal(t, []*FileSpec{
+		{LenBytes: 40 << 10, Path: filepath.Join("bar", "qux.mp4")},
+		{LenBytes: 4, Path: "ham.avi"},
+	}, tr.Info.Files)
+	assert.Equal(t, int64(40<<10+4), tr.Info.LenBytes)
+	all := append(append([]byte{}, content[filepath.Join("bar", "qux.mp4")]...), content["ham.avi"]...)
+	var pieces []byte
+	for off := 0; off < len(all); off += 16 << 10 {
+		end := off + 16<<10
+		if end > len(all) {
+			end = len(all)
+		}
+		h := sha1.Sum(all[off:end])
+		pieces = append(pieces, h[:]...)
+	}
+	assert.Equal(t, pieces, tr.Info.Pieces)
+	// created torrent survives a round trip with the same info hash
+	b, err := bencode.Marshal(tr)
+	assert.Nil(t, err)
+	decoded := &Torrent{}
+	assert.Nil(t, bencode.Unmarshal(b, decoded))
+	assert.Equal(t, tr.Info.Hash, decoded.Info.Hash)
+	assert.True(t, decoded.Info.Private)
+	assert.Equal(t, tr.Trackers, decoded.Trackers)
+	assert.Equal(t, tr.WebSeeds, decoded.WebSeeds)
+	assert.Equal(t, tr.Info.Files, decoded.Info.Files)
+}
+
+func TestNewTorrentInfoSingleFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "foo.iso")
+	assert.Nil(t, os.WriteFile(p, []byte("hello world"), 0o644))
+	info, err := NewTorrentInfo(p, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo.iso", info.Name)
+	assert.Nil(t, info.Files)
+	assert.Equal(t, int64(11), info.LenBytes)
+	h := sha1.Sum([]byte("hello world"))
+	assert.Equal(t, h[:], info.Pieces)
+}
+
+func TestNewTorrentInfoName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "foo")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "bar"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "bar", "baz"), []byte("hello"), 0o644))
+	// paths are joined by hand so that dot segments are kept
+	sep := string(filepath.Separator)
+	for rel, name := range map[string]string{".": "bar", "..": "foo", "." + sep + "baz": "baz"} {
+		path := dir + sep + "bar" + sep + rel
+		info, err := NewTorrentInfo(path, 0, false)
+		assert.Nil(t, err, path)
+		assert.Equal(t, name, info.Name, path)
+	}
+	_, err := NewTorrentInfo(sep, 0, false)
+	assert.NotNil(t, err)
+}
+
+func TestAutoPieceLenBytes(t *testing.T) {
+	assert.Equal(t, int64(16<<10), autoPieceLenBytes(0))
+	assert.Equal(t, int64(16<<10), autoPieceLenBytes(1500*16<<10))
+	assert.Equal(t, int64(32<<10), autoPieceLenBytes(1500*16<<10+1))
+	assert.Equal(t, int64(16<<20), autoPieceLenBytes(1<<40))
+}
+
+func TestBdecodeV2(t *testing.T) {
+	root := bytes.Repeat([]byte{0xab}, 32)
+	tree := map[string]interface{}{
+		"dir": map[string]interface{}{
+			"a.txt": map[string]interface{}{"": map[string]interface{}{"length": 20000, "pieces root": root}},
+		},
+		"b.txt": map[string]interface{}{"": map[string]interface{}{"length": 0}},
+	}
+	type C struct {
+		name   string
+		info   map[string]interface{}
+		verify func(t *testing.T, x *TorrentInfo, err error)
+	}
+	tcs := []*C{
+		{
+			name: "v2 only",
+			info: map[string]interface{}{"file tree": tree, "meta version": 2, "name": "foo", "piece length": 16384},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.Nil(t, err)
+				assert.False(t, x.HasV1())
+				assert.True(t, x.HasV2())
+				assert.Nil(t, x.Pieces)
+				assert.Equal(t, 32, len(x.HashV2))
+				// info hash of v2-only torrent is truncated sha256
+				assert.Equal(t, x.HashV2[:20], x.Hash)
+				assert.Equal(t, []*FileSpec{
+					{LenBytes: 0, Path: "b.txt"},
+					{LenBytes: 20000, Path: filepath.Join("dir", "a.txt"), PiecesRoot: root},
+				}, x.Files)
+				assert.Equal(t, int64(20000), x.LenBytes)
+				assert.Equal(t, int64(2), x.PieceCnt())
+			},
+		},
+		{
+			name: "v2 only: single file",
+			info: map[string]interface{}{
+				"file tree":    map[string]interface{}{"foo": map[string]interface{}{"": map[string]interface{}{"length": 20000, "pieces root": root}}},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 16384,
+			},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.Nil(t, err)
+				assert.Nil(t, x.Files)
+				assert.Equal(t, int64(20000), x.LenBytes)
+				assert.Equal(t, root, x.PiecesRoot)
+			},
+		},
+		{
+			name: "hybrid",
+			info: map[string]interface{}{
+				"file tree": tree,
+				"files": []interface{}{
+					map[string]interface{}{"length": 0, "path": []string{"b.txt"}},
+					map[string]interface{}{"length": 20000, "path": []string{"dir", "a.txt"}},
+					map[string]interface{}{"attr": "p", "length": 12768, "path": []string{".pad", "12768"}},
+				},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 16384,
+				"pieces":       bytes.Repeat([]byte{0xcd}, 40),
+			},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.Nil(t, err)
+				assert.True(t, x.HasV1())
+				assert.True(t, x.HasV2())
+				assert.Equal(t, 20, len(x.Hash))
+				assert.Equal(t, 32, len(x.HashV2))
+				assert.Equal(t, []*FileSpec{
+					{LenBytes: 0, Path: "b.txt"},
+					{LenBytes: 20000, Path: filepath.Join("dir", "a.txt"), PiecesRoot: root},
+					{LenBytes: 12768, Path: filepath.Join(".pad", "12768"), Attr: "p"},
+				}, x.Files)
+				assert.Equal(t, int64(32768), x.LenBytes)
+			},
+		},
+		{
+			name: "hybrid: file lists disagree",
+			info: map[string]interface{}{
+				"file tree": tree,
+				"files": []interface{}{
+					map[string]interface{}{"length": 20000, "path": []string{"dir", "a.txt"}},
+				},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 16384,
+				"pieces":       bytes.Repeat([]byte{0xcd}, 40),
+			},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "v1 and v2 file lists of hybrid TorrentInfo disagree")
+			},
+		},
+		{
+			name: "v2: piece length not power of two",
+			info: map[string]interface{}{"file tree": tree, "meta version": 2, "name": "foo", "piece length": 20000},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "is not a power of two")
+			},
+		},
+		{
+			name: "v2: missing pieces root",
+			info: map[string]interface{}{
+				"file tree":    map[string]interface{}{"foo": map[string]interface{}{"": map[string]interface{}{"length": 20000}}},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 16384,
+			},
+			verify: func(t *testing.T, x *TorrentInfo, err error) {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "has no pieces root")
+			},
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			raw := bencode.MustMarshal(c.info)
+			x := &TorrentInfo{}
+			err := bencode.Unmarshal(raw, x)
+			c.verify(t, x, err)
+			if err != nil {
+				return
+			}
+			h := sha256.Sum256(raw)
+			assert.Equal(t, h[:], x.HashV2)
+			// re-encoding decoded fields yields the same info dictionary
+			x.Raw = nil
+			b, err := bencode.Marshal(x)
+			assert.Nil(t, err)
+			assert.Equal(t, string(raw), string(b))
+		})
+	}
+}
+
+func sha256Of(b ...[]byte) []byte {
+	h := sha256.Sum256(bytes.Join(b, nil))
+	return h[:]
+}
+
+func TestBdecodePieceLayers(t *testing.T) {
+	h0, h1 := bytes.Repeat([]byte{0xef}, 32), bytes.Repeat([]byte{0x12}, 32)
+	layer := append(append([]byte(nil), h0...), h1...)
+	root := sha256Of(h0, h1)
+	data := bencode.MustMarshal(map[string]interface{}{
+		"info": map[string]interface{}{
+			"file tree":    map[string]interface{}{"foo": map[string]interface{}{"": map[string]interface{}{"length": 20000, "pieces root": root}}},
+			"meta version": 2,
+			"name":         "foo",
+			"piece length": 16384,
+		},
+		"piece layers": map[string]interface{}{string(root): layer},
+	})
+	tr := &Torrent{}
+	assert.Nil(t, bencode.Unmarshal(data, tr))
+	actual, ok := tr.PieceLayers.Layer(tr.Info.PiecesRoot)
+	assert.True(t, ok)
+	assert.Equal(t, layer, actual)
+	b, err := bencode.Marshal(tr)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), string(b))
+
+	malformed := bencode.MustMarshal(map[string]interface{}{
+		"info":         map[string]interface{}{"length": 1, "name": "foo", "piece length": 16384, "pieces": layer[:20]},
+		"piece layers": map[string]interface{}{string(root): layer[:40]},
+	})
+	err = bencode.Unmarshal(malformed, &Torrent{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "not a multiple of 32")
+}
+
+func TestBdecodeV2MultiFile(t *testing.T) {
+	// pieces of 2 blocks each; the layer of a is padded with hash of a piece of zero leaves
+	hs := [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)}
+	zero := make([]byte, 32)
+	pad := sha256Of(zero, zero)
+	rootA := sha256Of(sha256Of(hs[0], hs[1]), sha256Of(hs[2], pad))
+	rootB := bytes.Repeat([]byte{0xab}, 32)
+	torrent := func(layer []byte) map[string]interface{} {
+		return map[string]interface{}{
+			"info": map[string]interface{}{
+				"file tree": map[string]interface{}{
+					"a": map[string]interface{}{"": map[string]interface{}{"length": 70000, "pieces root": rootA}},
+					"b": map[string]interface{}{"": map[string]interface{}{"length": 20000, "pieces root": rootB}},
+				},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 32768,
+			},
+			"piece layers": map[string]interface{}{string(rootA): layer},
+		}
+	}
+	data := bencode.MustMarshal(torrent(bytes.Join(hs, nil)))
+	tr := &Torrent{}
+	assert.Nil(t, bencode.Unmarshal(data, tr))
+	// pieces don't span file boundaries
+	assert.Equal(t, int64(4), tr.Info.PieceCnt())
+	assert.Equal(t, int64(90000), tr.Info.LenBytes)
+	assert.Equal(t, tr.Info.HashV2[:20], tr.Info.Hash)
+	assert.Equal(t, 32, len(tr.Info.HashV2))
+
+	cases := []struct {
+		name    string
+		layer   []byte
+		wantErr string
+	}{
+		{"hashes missing", bytes.Join(hs[:2], nil), "has 2 hashes but file has 3 pieces"},
+		{"hash altered", bytes.Join([][]byte{hs[0], hs[2], hs[1]}, nil), "doesn't match its pieces root"},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			err := bencode.Unmarshal(bencode.MustMarshal(torrent(c.layer)), &Torrent{})
+			assert.NotNil(t, err)
+			assert.Contains(t, err.Error(), c.wantErr)
+		})
+	}
+	noLayers := torrent(nil)
+	delete(noLayers, "piece layers")
+	err := bencode.Unmarshal(bencode.MustMarshal(noLayers), &Torrent{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no layer of file a")
+}
+
+func TestValidatePieces(t *testing.T) {
+	pieces := bytes.Repeat([]byte{0xcd}, 40)
+	type C struct {
+		name   string
+		info   map[string]interface{}
+		strict bool
+		err    error
+	}
+	tcs := []*C{
+		{
+			name: "valid",
+			info: map[string]interface{}{"length": 2048, "name": "foo", "piece length": 1024, "pieces": pieces},
+		},
+		{
+			name: "valid: last piece is partial",
+			info: map[string]interface{}{"length": 1025, "name": "foo", "piece length": 1024, "pieces": pieces},
+		},
+		{
+			name: "too few piece hashes",
+			info: map[string]interface{}{"length": 2049, "name": "foo", "piece length": 1024, "pieces": pieces},
+			err:  ErrPieceCntMismatch,
+		},
+		{
+			name: "too many piece hashes",
+			info: map[string]interface{}{
+				"files": []interface{}{
+					map[string]interface{}{"length": 512, "path": []string{"a"}},
+					map[string]interface{}{"length": 512, "path": []string{"b"}},
+				},
+				"name":         "foo",
+				"piece length": 1024,
+				"pieces":       pieces,
+			},
+			err: ErrPieceCntMismatch,
+		},
+		{
+			name: "zero piece length",
+			info: map[string]interface{}{"length": 2048, "name": "foo", "piece length": 0, "pieces": pieces},
+			err:  ErrInvalidPieceLen,
+		},
+		{
+			name: "negative piece length",
+			info: map[string]interface{}{"length": 2048, "name": "foo", "piece length": -1024, "pieces": pieces},
+			err:  ErrInvalidPieceLen,
+		},
+		{
+			name: "piece length not power of two is fine in lenient mode",
+			info: map[string]interface{}{"length": 2000, "name": "foo", "piece length": 1000, "pieces": pieces},
+		},
+		{
+			name:   "piece length not power of two in strict mode",
+			info:   map[string]interface{}{"length": 2000, "name": "foo", "piece length": 1000, "pieces": pieces},
+			strict: true,
+			err:    ErrPieceLenNotPowerOfTwo,
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			tr, err := DecodeTorrent(bencode.MustMarshal(map[string]interface{}{"info": c.info}))
+			if err == nil && c.strict {
+				err = tr.Info.Validate(true)
+			}
+			if c.err == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, c.err)
+			}
+		})
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	pieces := bytes.Repeat([]byte{0xcd}, 20)
+	multiFile := func(paths ...[]string) map[string]interface{} {
+		var files []interface{}
+		for _, p := range paths {
+			files = append(files, map[string]interface{}{"length": 1, "path": p})
+		}
+		return map[string]interface{}{"files": files, "name": "foo", "piece length": 1024, "pieces": pieces}
+	}
+	type C struct {
+		name     string
+		info     map[string]interface{}
+		expected []string
+	}
+	tcs := []*C{
+		{
+			name:     "parent directory segment",
+			info:     multiFile([]string{"..", "..", "etc", "passwd"}),
+			expected: []string{filepath.Join("_..", "_..", "etc", "passwd")},
+		},
+		{
+			name:     "absolute segment",
+			info:     multiFile([]string{"/etc", "passwd"}),
+			expected: []string{filepath.Join("_etc", "passwd")},
+		},
+		{
+			name:     "empty and current directory segments",
+			info:     multiFile([]string{"", ".", "a"}),
+			expected: []string{filepath.Join("_", "_.", "a")},
+		},
+		{
+			name:     "separators within segment",
+			info:     multiFile([]string{"a/../../b"}, []string{"c\\..\\d"}),
+			expected: []string{"a_.._.._b", "c_.._d"},
+		},
+		{
+			name:     "NUL byte",
+			info:     multiFile([]string{"a\x00.txt"}),
+			expected: []string{"a_.txt"},
+		},
+		{
+			name:     "unsafe name",
+			info:     map[string]interface{}{"length": 1, "name": "..", "piece length": 1024, "pieces": pieces},
+			expected: []string{"_.."},
+		},
+		{
+			name: "unsafe path in v2 file tree",
+			info: map[string]interface{}{
+				"file tree": map[string]interface{}{
+					"..": map[string]interface{}{"x": map[string]interface{}{"": map[string]interface{}{"length": 0}}},
+				},
+				"meta version": 2,
+				"name":         "foo",
+				"piece length": 16384,
+			},
+			expected: []string{filepath.Join("_..", "x")},
+		},
+		{
+			name: "safe paths",
+			info: multiFile([]string{"a", "b..c"}, []string{".hidden"}),
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			raw := bencode.MustMarshal(map[string]interface{}{"info": c.info})
+			// unsafe paths are escaped by default
+			tr, err := DecodeTorrent(raw)
+			assert.Nil(t, err)
+			assert.Equal(t, c.expected, tr.Info.EscapedPaths())
+			for _, p := range append([]string{tr.Info.Name}, c.expected...) {
+				assert.False(t, filepath.IsAbs(p), p)
+				assert.NotContains(t, strings.Split(p, string(filepath.Separator)), "..", p)
+			}
+			// and refused on demand
+			_, err = (&Decoder{PathPolicy: PathPolicyReject}).Decode(raw)
+			if c.expected == nil {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrUnsafePath)
+			}
+		})
+	}
+}
+
+func TestSanitizePath(t *testing.T) {
+	p, err := SanitizePath([]string{"a", "b"}, PathPolicyReject)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("a", "b"), p)
+	_, err = SanitizePath([]string{"a", ".."}, PathPolicyReject)
+	assert.ErrorIs(t, err, ErrUnsafePath)
+	p, err = SanitizePath([]string{"a", ".."}, PathPolicyEscape)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join("a", "_.."), p)
+	_, err = SanitizePath(nil, PathPolicyEscape)
+	assert.ErrorIs(t, err, ErrUnsafePath)
+}
+
+func TestTrackerTiers(t *testing.T) {
+	info := map[string]interface{}{"length": 1, "name": "foo", "piece length": 1024, "pieces": bytes.Repeat([]byte{0xcd}, 20)}
+	type C struct {
+		name     string
+		torrent  map[string]interface{}
+		trackers []string
+		tiers    [][]string
+	}
+	tcs := []*C{
+		{
+			name:     "announce only",
+			torrent:  map[string]interface{}{"announce": "http://a", "info": info},
+			trackers: []string{"http://a"},
+			tiers:    [][]string{{"http://a"}},
+		},
+		{
+			name:     "announce-list only",
+			torrent:  map[string]interface{}{"announce-list": [][]string{{"http://a", "http://b"}, {"udp://c"}}, "info": info},
+			trackers: []string{"http://a", "http://b", "udp://c"},
+			tiers:    [][]string{{"http://a", "http://b"}, {"udp://c"}},
+		},
+		{
+			name: "announce absent in announce-list",
+			torrent: map[string]interface{}{
+				"announce":      "http://x",
+				"announce-list": [][]string{{"http://a"}, {"udp://c", "udp://d"}},
+				"info":          info,
+			},
+			trackers: []string{"http://x", "http://a", "udp://c", "udp://d"},
+			tiers:    [][]string{{"http://x"}, {"http://a"}, {"udp://c", "udp://d"}},
+		},
+		{
+			name: "duplicated and empty entries",
+			torrent: map[string]interface{}{
+				"announce":      "udp://c",
+				"announce-list": [][]string{{"http://a", "http://a", ""}, {}, {"udp://c", "http://a"}},
+				"info":          info,
+			},
+			trackers: []string{"udp://c", "http://a"},
+			tiers:    [][]string{{"http://a"}, {"udp://c"}},
+		},
+		{
+			name:    "no tracker",
+			torrent: map[string]interface{}{"info": info},
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			tr, err := DecodeTorrent(bencode.MustMarshal(c.torrent))
+			assert.Nil(t, err)
+			assert.Equal(t, c.trackers, tr.Trackers)
+			assert.Equal(t, c.tiers, tr.TrackerTiers)
+			// tiers survive encoding
+			b, err := bencode.Marshal(tr)
+			assert.Nil(t, err)
+			decoded, err := DecodeTorrent(b)
+			assert.Nil(t, err)
+			assert.Equal(t, c.trackers, decoded.Trackers)
+			assert.Equal(t, c.tiers, decoded.TrackerTiers)
+		})
+	}
+}
+
+func TestTiersWithAddedTrackers(t *testing.T) {
+	tr := &Torrent{
+		Trackers:     []string{"http://a", "http://b", "udp://new"},
+		TrackerTiers: [][]string{{"http://a", "http://b"}},
+	}
+	assert.Equal(t, [][]string{{"http://a", "http://b"}, {"udp://new"}}, tr.Tiers())
+}
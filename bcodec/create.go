@@ -0,0 +1,256 @@
+package bcodec
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+const (
+	minAutoPieceLenBytes int64 = 16 << 10
+	maxAutoPieceLenBytes int64 = 16 << 20
+	// desired # pieces when picking piece length automatically
+	targetPieceCnt int64 = 1500
+)
+
+// options of torrent creation
+type CreateOpts struct {
+	Trackers []string
+	Comment  *string
+	// piece length is picked based on content size when it's not positive
+	PieceLenBytes int64
+	WebSeeds      []string
+	Private       bool
+}
+
+// Creates a torrent out of the file or directory at path.
+func NewTorrent(path string, opts *CreateOpts) (*Torrent, error) {
+	if opts == nil {
+		opts = &CreateOpts{}
+	}
+	for _, s := range opts.Trackers {
+		if err := validateUtf8Str(s); err != nil {
+			return nil, fmt.Errorf("tracker url is invalid UTF-8 string: %w", err)
+		}
+	}
+	if opts.Comment != nil {
+		if err := validateUtf8Str(*opts.Comment); err != nil {
+			return nil, fmt.Errorf("comment is invalid UTF-8 string: %w", err)
+		}
+	}
+	info, err := NewTorrentInfo(path, opts.PieceLenBytes, opts.Private)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	return &Torrent{
+		Info:         info,
+		Trackers:     opts.Trackers,
+		Comment:      opts.Comment,
+		CreationDate: &now,
+		WebSeeds:     opts.WebSeeds,
+	}, nil
+}
+
+/*
+Creates meta info dictionary out of the file or directory at path.
+
+Files under a directory are collected in lexical order; anything other than regular files are skipped.
+Piece hashes are computed concurrently, one worker per CPU core.
+*/
+func NewTorrentInfo(path string, pieceLenBytes int64, private bool) (*TorrentInfo, error) {
+	// name is taken from absolute path, so that e.g. "." is named after the current directory
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path of content to create torrent from: %w", err)
+	}
+	name := filepath.Base(path)
+	if name == "." || name == string(filepath.Separator) {
+		return nil, fmt.Errorf("can't name torrent after %q", path)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing content to create torrent from: %w", err)
+	}
+	x := &TorrentInfo{
+		Name:        name,
+		MetaVersion: 1,
+		Private:     private,
+	}
+	if err := validateUtf8Str(x.Name); err != nil {
+		return nil, fmt.Errorf("torrent name is invalid UTF-8 string: %w", err)
+	}
+	// absolute paths of files, in the same order as in torrent
+	var paths []string
+	if stat.Mode().IsRegular() {
+		x.LenBytes = stat.Size()
+		paths = []string{path}
+	} else if stat.IsDir() {
+		err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(path, p)
+			if err != nil {
+				return err
+			}
+			if err := validateUtf8Str(rel); err != nil {
+				return fmt.Errorf("file path is invalid UTF-8 string: %w", err)
+			}
+			x.Files = append(x.Files, &FileSpec{LenBytes: fi.Size(), Path: rel})
+			paths = append(paths, p)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error collecting files to create torrent from: %w", err)
+		}
+		if len(x.Files) == 0 {
+			return nil, fmt.Errorf("no regular file found under %s", path)
+		}
+		if x.LenBytes, err = totalFileSizeBytes(x.Files); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s is neither a regular file nor a directory", path)
+	}
+	if pieceLenBytes <= 0 {
+		pieceLenBytes = autoPieceLenBytes(x.LenBytes)
+	}
+	x.PieceLenBytes = pieceLenBytes
+	if x.Pieces, err = hashPieces(paths, x.fileLens(), pieceLenBytes); err != nil {
+		return nil, err
+	}
+	raw, err := bencode.Marshal(x)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding TorrentInfo to compute info hash: %w", err)
+	}
+	h := sha1.Sum(raw)
+	x.Hash = h[:]
+	return x, nil
+}
+
+// lengths of files in the order of their appearance in the torrent
+func (x *TorrentInfo) fileLens() []int64 {
+	if len(x.Files) == 0 {
+		return []int64{x.LenBytes}
+	}
+	res := make([]int64, len(x.Files))
+	for i, f := range x.Files {
+		res[i] = f.LenBytes
+	}
+	return res
+}
+
+// picks the smallest power of two which splits content into no more than targetPieceCnt pieces
+func autoPieceLenBytes(totalBytes int64) int64 {
+	res := minAutoPieceLenBytes
+	for res < maxAutoPieceLenBytes && (totalBytes+res-1)/res > targetPieceCnt {
+		res <<= 1
+	}
+	return res
+}
+
+// computes concatenated sha1 piece hashes of content spanning files in paths
+func hashPieces(paths []string, lens []int64, pieceLenBytes int64) ([]byte, error) {
+	var total int64
+	for _, l := range lens {
+		total += l
+	}
+	pieceCnt := (total + pieceLenBytes - 1) / pieceLenBytes
+	res := make([]byte, 20*pieceCnt)
+	idxs := make(chan int64)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLenBytes)
+			for idx := range idxs {
+				off := idx * pieceLenBytes
+				n := pieceLenBytes
+				if off+n > total {
+					n = total - off
+				}
+				if err := readSpan(paths, lens, off, buf[:n]); err != nil {
+					select {
+					case errs <- fmt.Errorf("error reading piece %d: %w", idx, err):
+						close(done)
+					default:
+					}
+					return
+				}
+				h := sha1.Sum(buf[:n])
+				copy(res[20*idx:], h[:])
+			}
+		}()
+	}
+loop:
+	for idx := int64(0); idx < pieceCnt; idx++ {
+		select {
+		case idxs <- idx:
+		case <-done:
+			break loop
+		}
+	}
+	close(idxs)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+		return res, nil
+	}
+}
+
+// reads len(buf) bytes starting at offset off of the content formed by concatenating files in paths
+func readSpan(paths []string, lens []int64, off int64, buf []byte) error {
+	for i, p := range paths {
+		if len(buf) == 0 {
+			break
+		}
+		if off >= lens[i] {
+			off -= lens[i]
+			continue
+		}
+		n := lens[i] - off
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		if err := readFileAt(p, off, buf[:n]); err != nil {
+			return err
+		}
+		buf = buf[n:]
+		off = 0
+	}
+	if len(buf) != 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func readFileAt(path string, off int64, buf []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.ReadAt(buf, off)
+	return err
+}
@@ -0,0 +1,272 @@
+package bcodec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// BEP 52 file tree handling
+
+const (
+	piecesRootLen = 32
+	// size of blocks hashed into leaves of v2 merkle trees
+	merkleBlockLen = 16 << 10
+)
+
+// decodes file tree of v2 torrent into x. For hybrid torrents, the v1 file list already decoded in x is
+// checked against the file tree instead of being replaced.
+func (x *TorrentInfo) decodeFileTree(raw []byte, hybrid bool) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("v2 TorrentInfo has no file tree")
+	}
+	if x.PieceLenBytes&(x.PieceLenBytes-1) != 0 {
+		return fmt.Errorf("%w: v2 TorrentInfo piece length %d", ErrPieceLenNotPowerOfTwo, x.PieceLenBytes)
+	}
+	if x.PieceLenBytes < 16<<10 {
+		return fmt.Errorf("%w: v2 TorrentInfo piece length %d is less than 16KiB", ErrInvalidPieceLen, x.PieceLenBytes)
+	}
+	var tree map[string]interface{}
+	if err := bencode.Unmarshal(raw, &tree); err != nil {
+		return fmt.Errorf("error decoding TorrentInfo file tree: %w", err)
+	}
+	var files []*FileSpec
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("TorrentInfo file tree has no file")
+	}
+	// single-file torrent has one file named after the torrent itself
+	single := len(files) == 1 && files[0].Path == x.Name && !strings.ContainsRune(x.Name, filepath.Separator)
+	if hybrid {
+		return x.attachPiecesRoots(files, single)
+	}
+	if single {
+		x.LenBytes = files[0].LenBytes
+		x.PiecesRoot = files[0].PiecesRoot
+		return nil
+	}
+	x.Files = files
+	return nil
+}
+
+// attaches pieces roots of files in file tree to v1 files of hybrid torrent
+func (x *TorrentInfo) attachPiecesRoots(files []*FileSpec, single bool) error {
+	if len(x.Files) == 0 {
+		if !single || files[0].LenBytes != x.LenBytes {
+			return fmt.Errorf("v1 and v2 file lists of hybrid TorrentInfo disagree")
+		}
+		x.PiecesRoot = files[0].PiecesRoot
+		return nil
+	}
+	idx := 0
+	for _, f := range x.Files {
+		if f.IsPadding() {
+			continue
+		}
+		if idx >= len(files) || files[idx].Path != f.Path || files[idx].LenBytes != f.LenBytes {
+			return fmt.Errorf("v1 and v2 file lists of hybrid TorrentInfo disagree at %s", f.Path)
+		}
+		f.PiecesRoot = files[idx].PiecesRoot
+		idx++
+	}
+	if idx != len(files) {
+		return fmt.Errorf("v1 and v2 file lists of hybrid TorrentInfo disagree: %d files absent in v1 file list", len(files)-idx)
+	}
+	return nil
+}
+
+// collects files under node in lexical order of path
+func walkFileTree(node map[string]interface{}, dirs []string, files *[]*FileSpec) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree entry %q under %v is not a dictionary", name, dirs)
+		}
+		if name != "" {
+			// copy dirs so that siblings don't share the same underlying array
+			if err := walkFileTree(child, append(dirs[:len(dirs):len(dirs)], name), files); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(dirs) == 0 {
+			return fmt.Errorf("file tree has a file without name")
+		}
+		f, err := fileTreeEntry(child, dirs)
+		if err != nil {
+			return err
+		}
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+func fileTreeEntry(entry map[string]interface{}, segments []string) (*FileSpec, error) {
+	path, escaped, err := sanitizePath(segments)
+	if err != nil {
+		return nil, fmt.Errorf("path segment in file tree is not valid UTF-8 string: %w", err)
+	}
+	length, ok := entry["length"].(int64)
+	if !ok || length < 0 {
+		return nil, fmt.Errorf("file tree entry %s has invalid length: %v", path, entry["length"])
+	}
+	f := &FileSpec{LenBytes: length, Path: path, escaped: escaped}
+	if root, ok := entry["pieces root"]; ok {
+		s, ok := root.(string)
+		if !ok || len(s) != piecesRootLen {
+			return nil, fmt.Errorf("file tree entry %s has invalid pieces root", path)
+		}
+		f.PiecesRoot = []byte(s)
+	} else if length > 0 {
+		return nil, fmt.Errorf("file tree entry %s has no pieces root", path)
+	}
+	return f, nil
+}
+
+// builds file tree out of files in x
+func (x *TorrentInfo) encodeFileTree() map[string]interface{} {
+	if len(x.Files) == 0 {
+		return map[string]interface{}{
+			x.Name: map[string]interface{}{"": fileTreeLeaf(x.LenBytes, x.PiecesRoot)},
+		}
+	}
+	tree := map[string]interface{}{}
+	for _, f := range x.Files {
+		if f.IsPadding() {
+			continue
+		}
+		node := tree
+		for _, s := range pathSegments(f.Path) {
+			child, ok := node[s].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[s] = child
+			}
+			node = child
+		}
+		node[""] = fileTreeLeaf(f.LenBytes, f.PiecesRoot)
+	}
+	return tree
+}
+
+func fileTreeLeaf(lenBytes int64, piecesRoot []byte) map[string]interface{} {
+	leaf := map[string]interface{}{"length": lenBytes}
+	if lenBytes > 0 {
+		leaf["pieces root"] = piecesRoot
+	}
+	return leaf
+}
+
+// splits os specific file path into path segments found in torrent
+func pathSegments(path string) []string {
+	return strings.Split(filepath.ToSlash(path), "/")
+}
+
+// piece layers of v2 torrent, keyed by pieces root of each file
+type PieceLayers map[string][]byte
+
+func (x *PieceLayers) UnmarshalBencode(raw []byte) error {
+	tmp := map[string]string{}
+	if err := bencode.Unmarshal(raw, &tmp); err != nil {
+		return fmt.Errorf("error decoding piece layers: %w", err)
+	}
+	res := make(PieceLayers, len(tmp))
+	for root, layer := range tmp {
+		if len(root) != piecesRootLen {
+			return fmt.Errorf("piece layers has key of invalid pieces root length %d", len(root))
+		}
+		if len(layer) == 0 || len(layer)%piecesRootLen != 0 {
+			return fmt.Errorf("piece layer of %x has length %d not a multiple of %d", root, len(layer), piecesRootLen)
+		}
+		res[root] = []byte(layer)
+	}
+	*x = res
+	return nil
+}
+
+// returns piece hashes of the file with given pieces root
+func (x PieceLayers) Layer(piecesRoot []byte) ([]byte, bool) {
+	layer, ok := x[string(piecesRoot)]
+	return layer, ok
+}
+
+// returns files of v2 torrent with their pieces roots, padding files excluded
+func (x *TorrentInfo) v2Files() []*FileSpec {
+	if len(x.Files) == 0 {
+		return []*FileSpec{{Path: x.Name, LenBytes: x.LenBytes, PiecesRoot: x.PiecesRoot}}
+	}
+	res := make([]*FileSpec, 0, len(x.Files))
+	for _, f := range x.Files {
+		if !f.IsPadding() {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+/*
+Checks layers against files of v2 torrent: layer of a file has a hash per piece of the file, and these hashes
+make up a merkle tree whose root is pieces root of the file. Files no larger than a piece have no layer.
+*/
+func (x *TorrentInfo) validatePieceLayers(layers PieceLayers) error {
+	for _, f := range x.v2Files() {
+		if f.LenBytes <= x.PieceLenBytes {
+			continue
+		}
+		layer, ok := layers.Layer(f.PiecesRoot)
+		if !ok {
+			return fmt.Errorf("piece layers has no layer of file %s", f.Path)
+		}
+		pieceCnt := (f.LenBytes + x.PieceLenBytes - 1) / x.PieceLenBytes
+		if int64(len(layer)) != pieceCnt*piecesRootLen {
+			return fmt.Errorf("piece layer of file %s has %d hashes but file has %d pieces",
+				f.Path, len(layer)/piecesRootLen, pieceCnt)
+		}
+		if !bytes.Equal(merkleRoot(layer, x.PieceLenBytes), f.PiecesRoot) {
+			return fmt.Errorf("piece layer of file %s doesn't match its pieces root", f.Path)
+		}
+	}
+	return nil
+}
+
+/*
+Returns root of merkle tree over piece hashes concatenated in layer. The layer is padded up to a power of two
+with hashes of pieces whose blocks all have zero leaf hashes, as per BEP 52.
+*/
+func merkleRoot(layer []byte, pieceLenBytes int64) []byte {
+	pad := make([]byte, piecesRootLen)
+	for n := pieceLenBytes / merkleBlockLen; n > 1; n >>= 1 {
+		h := sha256.Sum256(append(pad, pad...))
+		pad = h[:]
+	}
+	hashes := make([][]byte, 0, len(layer)/piecesRootLen)
+	for i := 0; i < len(layer); i += piecesRootLen {
+		hashes = append(hashes, layer[i:i+piecesRootLen])
+	}
+	for len(hashes) > 1 {
+		if len(hashes)%2 != 0 {
+			hashes = append(hashes, pad)
+		}
+		next := make([][]byte, len(hashes)/2)
+		for i := range next {
+			h := sha256.Sum256(append(append([]byte(nil), hashes[2*i]...), hashes[2*i+1]...))
+			next[i] = h[:]
+		}
+		hashes = next
+		h := sha256.Sum256(append(append([]byte(nil), pad...), pad...))
+		pad = h[:]
+	}
+	return hashes[0]
+}
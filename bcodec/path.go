@@ -0,0 +1,76 @@
+package bcodec
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnsafePath indicates a file path in torrent which could escape download directory.
+var ErrUnsafePath = errors.New("unsafe file path")
+
+// how to deal with unsafe file paths found in torrent
+type PathPolicy int
+
+const (
+	// replace unsafe path segments and characters with underscore
+	PathPolicyEscape PathPolicy = iota
+	// refuse torrents with unsafe file paths
+	PathPolicyReject
+)
+
+// placeholder for unsafe path segments and characters
+const escapeChar = '_'
+
+/*
+Creates os specific relative file path out of path segments found in torrent.
+
+A segment is unsafe if it is empty, "." or "..", carries a volume name, or contains path separator or NUL
+byte. Under PathPolicyEscape unsafe segments are escaped so that the resulting path always stays within
+the download directory; under PathPolicyReject an error wrapping ErrUnsafePath is returned instead.
+*/
+func SanitizePath(segments []string, policy PathPolicy) (string, error) {
+	path, escaped, err := sanitizePath(segments)
+	if err != nil {
+		return "", err
+	}
+	if escaped && policy == PathPolicyReject {
+		return "", fmt.Errorf("%w: %q", ErrUnsafePath, segments)
+	}
+	return path, nil
+}
+
+// returns the escaped path and whether any segment had to be escaped
+func sanitizePath(segments []string) (string, bool, error) {
+	if len(segments) == 0 {
+		return "", false, fmt.Errorf("%w: no path segment", ErrUnsafePath)
+	}
+	res := make([]string, len(segments))
+	escaped := false
+	for i, s := range segments {
+		if err := validateUtf8Str(s); err != nil {
+			return "", false, err
+		}
+		res[i] = sanitizeSegment(s)
+		escaped = escaped || res[i] != s
+	}
+	return filepath.Join(res...), escaped, nil
+}
+
+func sanitizeSegment(s string) string {
+	switch s {
+	case "", ".", "..":
+		return string(escapeChar) + s
+	}
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return escapeChar
+		}
+		return r
+	}, s)
+	if vol := filepath.VolumeName(s); vol != "" {
+		s = strings.Repeat(string(escapeChar), len(vol)) + s[len(vol):]
+	}
+	return s
+}
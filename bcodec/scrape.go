@@ -0,0 +1,93 @@
+package bcodec
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// tracker scrape response
+type ScrapeRsp struct {
+	FailureReason *string
+	// swarm statistics keyed by 20-byte info hash in binary form
+	Files map[string]*ScrapeStats
+	// interval below which tracker may reject scrapes, from flags dictionary
+	MinRequestInterval *time.Duration
+}
+
+// swarm statistics of a single torrent in scrape response
+type ScrapeStats struct {
+	SeederCnt    int64   `bencode:"complete"`
+	CompletedCnt int64   `bencode:"downloaded"`
+	LeecherCnt   int64   `bencode:"incomplete"`
+	Name         *string `bencode:"name,omitempty"`
+}
+
+// Stats returns statistics of the torrent with info hash, or nil if tracker doesn't report it.
+func (x *ScrapeRsp) Stats(infoHash []byte) *ScrapeStats {
+	return x.Files[string(infoHash)]
+}
+
+func (x *ScrapeRsp) UnmarshalBencode(raw []byte) error {
+	tmp := struct {
+		FailureReason *string                 `bencode:"failure reason,omitempty"`
+		Files         map[string]*ScrapeStats `bencode:"files,omitempty"`
+		Flags         *struct {
+			MinRequestIntervalSeconds *int64 `bencode:"min_request_interval,omitempty"`
+		} `bencode:"flags,omitempty"`
+	}{}
+	if err := bencode.Unmarshal(raw, &tmp); err != nil {
+		return fmt.Errorf("error decoding anonymous struct for ScrapeRsp: %w", err)
+	}
+	if ptr := tmp.FailureReason; ptr != nil {
+		if err := validateUtf8Str(*ptr); err != nil {
+			return fmt.Errorf("failure reason presents in scrape response but is invalid UTF-8 sring: %w", err)
+		}
+		x.FailureReason = ptr
+		return nil
+	}
+	for h, stats := range tmp.Files {
+		if len(h) != 20 {
+			return fmt.Errorf("scrape response has info hash of length %d", len(h))
+		}
+		if stats == nil {
+			return fmt.Errorf("scrape response has no statistics for info hash %x", h)
+		}
+	}
+	x.Files = tmp.Files
+	if tmp.Flags != nil && tmp.Flags.MinRequestIntervalSeconds != nil {
+		duration := time.Duration(*tmp.Flags.MinRequestIntervalSeconds) * time.Second
+		x.MinRequestInterval = &duration
+	}
+	return nil
+}
+
+func (x *ScrapeRsp) MarshalBencode() ([]byte, error) {
+	type Flags struct {
+		MinRequestIntervalSeconds int64 `bencode:"min_request_interval"`
+	}
+	tmp := struct {
+		FailureReason *string       `bencode:"failure reason,omitempty"`
+		Files         bencode.Bytes `bencode:"files,omitempty"`
+		Flags         *Flags        `bencode:"flags,omitempty"`
+	}{
+		FailureReason: x.FailureReason,
+	}
+	if x.FailureReason == nil {
+		// files is mandatory even if tracker knows none of the torrents
+		files := x.Files
+		if files == nil {
+			files = map[string]*ScrapeStats{}
+		}
+		b, err := bencode.Marshal(files)
+		if err != nil {
+			return nil, err
+		}
+		tmp.Files = b
+		if x.MinRequestInterval != nil {
+			tmp.Flags = &Flags{MinRequestIntervalSeconds: int64(*x.MinRequestInterval / time.Second)}
+		}
+	}
+	return bencode.Marshal(&tmp)
+}
@@ -0,0 +1,73 @@
+// Package bitfield implements piece bitfield in the form used by peer wire protocol.
+package bitfield
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+/*
+Bitfield of a fixed # bits, with bit 0 being the most significant bit of the first byte.
+
+It's not goroutine safe.
+*/
+type Bitfield struct {
+	b []byte
+	n int
+}
+
+// New creates bitfield of n bits, all cleared.
+func New(n int) *Bitfield {
+	return &Bitfield{b: make([]byte, (n+7)/8), n: n}
+}
+
+// FromBytes creates bitfield of n bits out of a copy of b, whose spare bits must be cleared.
+func FromBytes(b []byte, n int) (*Bitfield, error) {
+	if len(b) != (n+7)/8 {
+		return nil, fmt.Errorf("bitfield of %d bits must be %d bytes long, got %d", n, (n+7)/8, len(b))
+	}
+	if n%8 != 0 && b[len(b)-1]&(0xff>>(n%8)) != 0 {
+		return nil, fmt.Errorf("spare bits of bitfield are set")
+	}
+	return &Bitfield{b: append([]byte{}, b...), n: n}, nil
+}
+
+// Bytes returns bitfield in wire form. The slice returned is shared with the bitfield.
+func (x *Bitfield) Bytes() []byte {
+	return x.b
+}
+
+// Len returns # bits.
+func (x *Bitfield) Len() int {
+	return x.n
+}
+
+func (x *Bitfield) Has(i int) bool {
+	return i >= 0 && i < x.n && x.b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func (x *Bitfield) Set(i int) {
+	x.b[i/8] |= 0x80 >> (i % 8)
+}
+
+func (x *Bitfield) Clear(i int) {
+	x.b[i/8] &^= 0x80 >> (i % 8)
+}
+
+// Count returns # bits set.
+func (x *Bitfield) Count() int {
+	res := 0
+	for _, c := range x.b {
+		res += bits.OnesCount8(c)
+	}
+	return res
+}
+
+// All tells whether all bits are set.
+func (x *Bitfield) All() bool {
+	return x.Count() == x.n
+}
+
+func (x *Bitfield) Clone() *Bitfield {
+	return &Bitfield{b: append([]byte{}, x.b...), n: x.n}
+}
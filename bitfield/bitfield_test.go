@@ -0,0 +1,34 @@
+package bitfield
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBitfield(t *testing.T) {
+	x := New(10)
+	assert.Equal(t, 10, x.Len())
+	assert.Equal(t, []byte{0, 0}, x.Bytes())
+	x.Set(0)
+	x.Set(9)
+	assert.Equal(t, []byte{0x80, 0x40}, x.Bytes())
+	assert.True(t, x.Has(0))
+	assert.False(t, x.Has(1))
+	assert.False(t, x.Has(10))
+	assert.Equal(t, 2, x.Count())
+	x.Clear(0)
+	assert.Equal(t, 1, x.Count())
+	for i := 0; i < 10; i++ {
+		x.Set(i)
+	}
+	assert.True(t, x.All())
+
+	y, err := FromBytes([]byte{0xff, 0xc0}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, x, y)
+	_, err = FromBytes([]byte{0xff, 0xe0}, 10)
+	assert.NotNil(t, err)
+	_, err = FromBytes([]byte{0xff}, 10)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,186 @@
+package bt
+
+import (
+	"context"
+	"crypto/rand"
+	"hash/crc32"
+	"io"
+	mrand "math/rand"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/tracker"
+)
+
+// client name and version in Azureus-style peer id
+const peerIDPrefix = "-GT0001-"
+
+// # peers asked from tracker in each announce
+const numWant = 50
+
+// wait before announcing to trackers again once all of them fail
+const tierRetryInterval = time.Minute
+
+// Generates a random Azureus-style peer id.
+func NewPeerID() []byte {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	id := make([]byte, 20)
+	copy(id, peerIDPrefix)
+	if _, err := rand.Read(id[len(peerIDPrefix):]); err != nil {
+		panic(err)
+	}
+	for i := len(peerIDPrefix); i < len(id); i++ {
+		id[i] = alphabet[int(id[i])%len(alphabet)]
+	}
+	return id
+}
+
+// state of announcing a job to a single tracker
+type TrackerStatus struct {
+	URL string
+	// time of the last announce attempt
+	LastAnnounce time.Time
+	// error of the last announce, nil if it succeeded
+	Err error
+	// swarm size reported by tracker in the last successful announce
+	SeederCnt  *int
+	LeecherCnt *int
+}
+
+// TrackerStatuses returns snapshot of announce states of job, one per tracker announced to.
+func (job *Job) TrackerStatuses() []TrackerStatus {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	res := make([]TrackerStatus, 0, len(job.trackers))
+	for _, s := range job.trackers {
+		res = append(res, *s)
+	}
+	return res
+}
+
+func (job *Job) setTrackerStatus(url string, rsp *bcodec.TrackerRsp, err error) {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	if job.trackers == nil {
+		job.trackers = make(map[string]*TrackerStatus)
+	}
+	s := job.trackers[url]
+	if s == nil {
+		s = &TrackerStatus{URL: url}
+		job.trackers[url] = s
+	}
+	s.LastAnnounce = time.Now()
+	s.Err = err
+	if err == nil {
+		s.SeederCnt, s.LeecherCnt = rsp.SeederCnt, rsp.LeecherCnt
+	}
+}
+
+/*
+Announces job to its trackers until ctx is done, feeding peers returned to onPeers.
+
+Trackers are announced to one at a time as per BEP 12: trackers of each tier are shuffled, then tried in order
+of tiers, and of trackers within tier, till one succeeds. Tracker succeeding moves to the front of its tier and
+is announced to till it fails, whereupon trying starts over from the first tier. Trackers which gtr can't talk
+to have the error recorded in job's tracker statuses. completed is closed once download of the job completes;
+see tracker.Announcer for details.
+*/
+func (bter *Bter) announce(ctx context.Context, job *Job, stats func() tracker.Stats, completed <-chan struct{}, onPeers func([]*bcodec.Peer)) {
+	tiers := shuffleTiers(job.torrent().Tiers())
+	for {
+		anySucceeded, anyUsable := false, false
+	pass:
+		for _, tier := range tiers {
+			for i, url := range tier {
+				succeeded, usable := bter.announceTo(ctx, job, url, stats, completed, onPeers)
+				if ctx.Err() != nil {
+					return
+				}
+				anyUsable = anyUsable || usable
+				if succeeded {
+					promote(tier, i)
+					anySucceeded = true
+					break pass
+				}
+			}
+		}
+		if !anyUsable {
+			return
+		}
+		if !anySucceeded {
+			// all trackers fail, so give them a break before starting over
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tierRetryInterval):
+			}
+		}
+	}
+}
+
+// returns copy of tiers with trackers of each tier shuffled
+func shuffleTiers(tiers [][]string) [][]string {
+	r := mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	res := make([][]string, len(tiers))
+	for i, tier := range tiers {
+		res[i] = append([]string(nil), tier...)
+		r.Shuffle(len(res[i]), func(j, k int) { res[i][j], res[i][k] = res[i][k], res[i][j] })
+	}
+	return res
+}
+
+// moves tracker i of tier to the front, keeping order of the others
+func promote(tier []string, i int) {
+	url := tier[i]
+	copy(tier[1:i+1], tier[:i])
+	tier[0] = url
+}
+
+/*
+Announces job to tracker at url until ctx is done or its latest announce fails. Returns whether any announce
+succeeds meanwhile, and whether tracker is one gtr can talk to.
+*/
+func (bter *Bter) announceTo(ctx context.Context, job *Job, url string, stats func() tracker.Stats, completed <-chan struct{}, onPeers func([]*bcodec.Peer)) (succeeded bool, usable bool) {
+	client, err := tracker.NewClient(url, bter.HTTP)
+	if err != nil {
+		job.setTrackerStatus(url, nil, err)
+		return false, false
+	}
+	if closer, ok := client.(io.Closer); ok {
+		defer closer.Close()
+	}
+	trackerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tr := job.torrent()
+	a := &tracker.Announcer{
+		Client: client,
+		Req: tracker.AnnounceReq{
+			InfoHash: tr.Info.Hash,
+			PeerID:   bter.PeerID,
+			Port:     bter.port(),
+			NumWant:  numWant,
+			Key:      crc32.ChecksumIEEE(bter.PeerID),
+		},
+		Stats: stats,
+		OnAnnounce: func(rsp *bcodec.TrackerRsp, err error) {
+			if trackerCtx.Err() != nil {
+				// stopped event as tracker is left; failure which makes us leave stays on record unless job stops
+				if ctx.Err() != nil {
+					job.setTrackerStatus(url, rsp, err)
+				}
+				return
+			}
+			job.setTrackerStatus(url, rsp, err)
+			if err != nil {
+				cancel()
+				return
+			}
+			succeeded = true
+			if len(rsp.Peers) > 0 && onPeers != nil {
+				onPeers(rsp.Peers)
+			}
+		},
+	}
+	a.Run(trackerCtx, completed)
+	return succeeded, true
+}
@@ -0,0 +1,149 @@
+package bt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/tracker"
+)
+
+func TestNewPeerID(t *testing.T) {
+	id := NewPeerID()
+	assert.Equal(t, 20, len(id))
+	assert.Equal(t, peerIDPrefix, string(id[:len(peerIDPrefix)]))
+	assert.NotEqual(t, id, NewPeerID())
+}
+
+func TestAnnounceTrackerStatuses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:completei3e10:incompletei4e8:intervali1800e5:peers6:\x43\xd7\xf6\xca\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	job := &Job{Torrent: &bcodec.Torrent{
+		Info:     &bcodec.TorrentInfo{Hash: make([]byte, 20)},
+		Trackers: []string{srv.URL + "/announce", "wss://tracker.net/announce"},
+	}}
+	bter := &Bter{HTTP: srv.Client(), PeerID: NewPeerID(), Port: 6881}
+	ctx, cancel := context.WithCancel(context.Background())
+	var mtx sync.Mutex
+	var peers []*bcodec.Peer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bter.announce(ctx, job, func() tracker.Stats { return tracker.Stats{} }, nil, func(ps []*bcodec.Peer) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			peers = append(peers, ps...)
+		})
+	}()
+	assert.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(peers) == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	statuses := map[string]TrackerStatus{}
+	for _, s := range job.TrackerStatuses() {
+		statuses[s.URL] = s
+	}
+	assert.Nil(t, statuses[srv.URL+"/announce"].Err)
+	assert.Equal(t, 3, *statuses[srv.URL+"/announce"].SeederCnt)
+	// the first tier works, so the next one isn't announced to
+	assert.Equal(t, 1, len(statuses))
+}
+
+func TestAnnounceTierFailover(t *testing.T) {
+	var mtx sync.Mutex
+	hits := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		hits[r.URL.Path]++
+		mtx.Unlock()
+		if r.URL.Path == "/bad" {
+			w.Write([]byte("d14:failure reason4:nopee"))
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers6:\x43\xd7\xf6\xca\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	job := &Job{Torrent: &bcodec.Torrent{
+		Info:         &bcodec.TorrentInfo{Hash: make([]byte, 20)},
+		TrackerTiers: [][]string{{"wss://tracker.net/announce", srv.URL + "/bad"}, {srv.URL + "/good"}, {srv.URL + "/spare"}},
+	}}
+	bter := &Bter{HTTP: srv.Client(), PeerID: NewPeerID(), Port: 6881}
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := make(chan []*bcodec.Peer, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bter.announce(ctx, job, func() tracker.Stats { return tracker.Stats{} }, nil, func(ps []*bcodec.Peer) { peers <- ps })
+	}()
+	assert.Equal(t, 1, len(<-peers))
+	cancel()
+	<-done
+	statuses := map[string]TrackerStatus{}
+	for _, s := range job.TrackerStatuses() {
+		statuses[s.URL] = s
+	}
+	assert.ErrorIs(t, statuses["wss://tracker.net/announce"].Err, tracker.ErrUnsupported)
+	var failure *tracker.FailureError
+	assert.ErrorAs(t, statuses[srv.URL+"/bad"].Err, &failure)
+	// stopped event is sent to the tracker announced to
+	assert.Nil(t, statuses[srv.URL+"/good"].Err)
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, map[string]int{"/bad": 1, "/good": 2}, hits)
+}
+
+func TestAnnounceTrackersOfTierInTurn(t *testing.T) {
+	var mtx sync.Mutex
+	hits := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		hits[r.URL.Path]++
+		mtx.Unlock()
+		w.Write([]byte("d8:intervali1800e5:peers6:\x43\xd7\xf6\xca\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	job := &Job{Torrent: &bcodec.Torrent{
+		Info:         &bcodec.TorrentInfo{Hash: make([]byte, 20)},
+		TrackerTiers: [][]string{{srv.URL + "/a", srv.URL + "/b", srv.URL + "/c"}},
+	}}
+	bter := &Bter{HTTP: srv.Client(), PeerID: NewPeerID(), Port: 6881}
+	ctx, cancel := context.WithCancel(context.Background())
+	peers := make(chan []*bcodec.Peer, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bter.announce(ctx, job, func() tracker.Stats { return tracker.Stats{} }, nil, func(ps []*bcodec.Peer) { peers <- ps })
+	}()
+	<-peers
+	cancel()
+	<-done
+	// only the first tracker in turn is announced to, with started and stopped events
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, 1, len(hits))
+	for _, n := range hits {
+		assert.Equal(t, 2, n)
+	}
+	// torrent's own tiers are left as they are
+	assert.Equal(t, []string{srv.URL + "/a", srv.URL + "/b", srv.URL + "/c"}, job.Torrent.TrackerTiers[0])
+}
+
+func TestPromote(t *testing.T) {
+	tier := []string{"a", "b", "c", "d"}
+	promote(tier, 2)
+	assert.Equal(t, []string{"c", "a", "b", "d"}, tier)
+	promote(tier, 0)
+	assert.Equal(t, []string{"c", "a", "b", "d"}, tier)
+	promote(tier, 3)
+	assert.Equal(t, []string{"d", "c", "a", "b"}, tier)
+}
@@ -1,10 +1,18 @@
 package bt
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+	"wuyrush.io/gtr/choker"
+	"wuyrush.io/gtr/dht"
 )
 
 /*
@@ -14,70 +22,464 @@ shall it be goroutine safe? likely so
 */
 type Bter struct {
 	HTTP *http.Client
+	// 20-byte peer id announced to trackers and peers, see NewPeerID
+	PeerID []byte
+	// port we listen on for incoming peer connections; read it with port() once jobs run, as Listen may set it
+	Port uint16
+	// directory content of jobs created is saved to
+	SaveDir string
+	// upload slots shared by all jobs running; unlimited if not positive
+	UploadSlots int
+	// limits of peer connections, see ConnLimits
+	ConnLimits ConnLimits
+	// DHT node to get peers from when trackers fail; DHT isn't used if nil
+	DHT *dht.Server
 	// TODO factor below to a dedicated entity - JobStore
 	Jobs *JobStore
+	// peer connections of all jobs
+	conns *connManager
+	// mutex guarding Port
+	portMtx sync.Mutex
+}
+
+// NewBter creates Bter listening for peers on port.
+func NewBter(port uint16) *Bter {
+	return &Bter{
+		HTTP:   &http.Client{Timeout: 30 * time.Second},
+		PeerID: NewPeerID(),
+		Port:   port,
+		Jobs:   NewJobStore(),
+		conns:  newConnManager(),
+	}
+}
+
+// returns port we listen on
+func (bter *Bter) port() uint16 {
+	bter.portMtx.Lock()
+	defer bter.portMtx.Unlock()
+	return bter.Port
+}
+
+// outcome of creating job out of a torrent
+type CreateJobResult struct {
+	// job created, or the existing one torrent is merged into; nil if Err is set
+	Job *Job
+	// torrent has the same info hash as an existing job, whose trackers and web seeds are merged with its
+	Merged bool
+	Err    error
 }
 
 /*
-TODO
-
-bter behaviors:
-    CreateJob
-    DelJob
-    StartJob
-    StopJob
-    JobProgress
-        - need to monitor and manage the progress of jobs as well
-    ListJobs
+Creates one bittorrent download job per torrent, and starts each of them in its own goroutine.
+
+Jobs are identified by info hash: a torrent whose info hash is the same as that of an existing job (or of
+a preceding torrent) doesn't create a new job, but merges its trackers and web seeds into that job instead.
+Results are in the same order as torrents.
+
+Jobs are persisted if JobStore is backed by a directory; a job which can't be persisted isn't created.
 */
+func (bter *Bter) CreateJob(torrents ...*bcodec.Torrent) []*CreateJobResult {
+	res := make([]*CreateJobResult, len(torrents))
+	for i, tr := range torrents {
+		if tr == nil || tr.Info == nil || len(tr.Info.Hash) != 20 {
+			res[i] = &CreateJobResult{Err: fmt.Errorf("torrent #%d has no valid meta info", i)}
+			continue
+		}
+		job, merged := bter.Jobs.addOrMerge(newJob(tr, bter.SaveDir))
+		if err := bter.Jobs.save(job); err != nil && !merged {
+			bter.Jobs.remove(job.ID)
+			res[i] = &CreateJobResult{Err: err}
+			continue
+		}
+		res[i] = &CreateJobResult{Job: job, Merged: merged}
+		if !merged {
+			go bter.run(job)
+		}
+	}
+	return res
+}
+
+// ErrJobNotFound is returned when there's no job with the given id.
+var ErrJobNotFound = errors.New("job not found")
 
 /*
-Creates one or more bittorrent download job.
+Starts job with id if it's stopped, errored or completed, or resumes it if it's paused. Starting a job which
+is running already is a no-op.
+*/
+func (bter *Bter) StartJob(id string) error {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	var err error
+	switch job.Status {
+	case JobStatusStopped, JobStatusErrored:
+		if err = job.transitionLocked(JobStatusQueued, nil); err == nil {
+			go bter.run(job)
+		}
+	case JobStatusCompleted:
+		// completed job starts seeding once its pieces are checked
+		if err = job.transitionLocked(JobStatusChecking, nil); err == nil {
+			go bter.run(job)
+		}
+	case JobStatusPaused:
+		err = bter.resumeLocked(job)
+	default:
+		job.mtx.Unlock()
+		return nil
+	}
+	job.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return bter.Jobs.save(job)
+}
 
-It queues the jobs for start after creation by default.
+// resumes paused job to the status it's paused from; caller must hold job.mtx
+func (bter *Bter) resumeLocked(job *Job) error {
+	switch job.pausedFrom {
+	case JobStatusChecking:
+		// check interrupted starts over
+		if err := job.transitionLocked(JobStatusChecking, nil); err != nil {
+			return err
+		}
+		go bter.run(job)
+	case JobStatusDownloading, JobStatusSeeding:
+		if err := job.transitionLocked(job.pausedFrom, nil); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		job.cancel = cancel
+		go bter.transfer(ctx, job)
+	default:
+		return job.transitionLocked(job.pausedFrom, nil)
+	}
+	return nil
+}
 
-For now it just creates and starts the jobs right away.
+// Starts jobs which are queued, e.g. those loaded by OpenJobStore, and seeds jobs which are completed.
+func (bter *Bter) ResumeJobs() {
+	for _, job := range bter.Jobs.List() {
+		switch job.State().Status {
+		case JobStatusQueued:
+			go bter.run(job)
+		case JobStatusCompleted:
+			bter.StartJob(job.ID)
+		}
+	}
+}
 
-1. create jobs from torrent, each with an id to be consumed by other components of this software; We shall use a different, more human-friendly set of ids on UI.
-    1. avoid duplicated jobs by checking info hash: merge data from given torrents to that of existing job instead
-2. submit each job for execution in concurrent.
-3. actual job execution
-    one job per goroutine
-    limit # network connections used to:
-        communicate with tracker (announce / scrape)
-        exchange bytes with peers
+// Stops job with id, which stays in JobStore till it's deleted.
+func (bter *Bter) StopJob(id string) error {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	if job.Status == JobStatusStopped {
+		job.mtx.Unlock()
+		return nil
+	}
+	err := job.transitionLocked(JobStatusStopped, nil)
+	job.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return bter.Jobs.save(job)
+}
 
+/*
+Pauses job with id, which stops announcing, dialing and serving peers till it's resumed by StartJob. Pausing a
+paused job is a no-op.
 */
-func (bter *Bter) CreateJob(torrents ...*bcodec.Torrent) {
+func (bter *Bter) PauseJob(id string) error {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	if job.Status == JobStatusPaused {
+		job.mtx.Unlock()
+		return nil
+	}
+	err := job.transitionLocked(JobStatusPaused, nil)
+	job.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return bter.Jobs.save(job)
+}
 
+// Stops job with id and removes it from JobStore.
+func (bter *Bter) DelJob(id string) error {
+	job := bter.Jobs.remove(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	if job.Status != JobStatusStopped {
+		// stopping is allowed from any status but stopped
+		job.transitionLocked(JobStatusStopped, nil)
+	}
+	job.mtx.Unlock()
+	return bter.Jobs.deleteFile(id)
+}
+
+/*
+Runs job till it's stopped or paused: pieces already saved are checked first, then job proceeds to download or seed.
+Job whose meta info is pending, e.g. one created out of a magnet link, is fetching metadata instead.
+
+Job must be queued, or checking in case of recheck.
+*/
+func (bter *Bter) run(job *Job) {
+	job.mtx.Lock()
+	if !job.Torrent.Info.HasMetadata() {
+		// nothing to check till meta info is known
+		// TODO fetch meta info from peers as per BEP 9
+		err := job.transitionLocked(JobStatusFetchingMetadata, nil)
+		job.mtx.Unlock()
+		if err == nil {
+			bter.Jobs.save(job)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// job may be stopped before it gets to run
+	if job.Status != JobStatusChecking {
+		if err := job.transitionLocked(JobStatusChecking, nil); err != nil {
+			job.mtx.Unlock()
+			cancel()
+			return
+		}
+	}
+	job.cancel = cancel
+	job.checkedPieces = 0
+	job.mtx.Unlock()
+	// in-memory state stays authoritative if saving fails; it's saved again on the next change
+	bter.Jobs.save(job)
+	pieces, err := bter.check(ctx, job)
+	job.mtx.Lock()
+	// job may be stopped or rechecked meanwhile, in which case it's no longer ours
+	if ctx.Err() != nil {
+		job.mtx.Unlock()
+		return
+	}
+	if err != nil {
+		job.transitionLocked(JobStatusErrored, err)
+		job.mtx.Unlock()
+		bter.Jobs.save(job)
+		return
+	}
+	job.pieces = pieces
+	to := JobStatusDownloading
+	if pieces.All() {
+		to = JobStatusSeeding
+	}
+	if err := job.transitionLocked(to, nil); err != nil {
+		job.mtx.Unlock()
+		return
+	}
+	job.mtx.Unlock()
+	bter.Jobs.save(job)
+	bter.transfer(ctx, job)
+}
+
+/*
+Downloads or seeds job till ctx is done, i.e. till it's stopped, paused or rechecked: peers are dialed and
+served, and job is announced to trackers and DHT.
+*/
+func (bter *Bter) transfer(ctx context.Context, job *Job) {
+	sw := newSwarm(job, func() int {
+		if slots := bter.uploadSlots()[job.ID]; slots > 0 {
+			return slots
+		}
+		// job is no longer running
+		return choker.DefaultSlots
+	})
+	job.mtx.Lock()
+	// job may be stopped or paused meanwhile, in which case it's no longer ours
+	if ctx.Err() != nil {
+		job.mtx.Unlock()
+		return
+	}
+	job.swarm = sw
+	job.mtx.Unlock()
+	go sw.rechokeLoop(ctx)
+	go bter.dialLoop(ctx, job, sw)
+	if bter.DHT != nil {
+		go bter.dhtLoop(ctx, job)
+	}
+	// TODO download pieces from peers connected
+	bter.announce(ctx, job, job.announceStats, nil, func(peers []*bcodec.Peer) {
+		bter.conns.addCandidates(job.ID, peers)
+	})
+	// job keeps serving peers even if it has no tracker to announce to
+	<-ctx.Done()
+	bter.conns.removeCandidates(job.ID)
+	job.mtx.Lock()
+	if job.swarm == sw {
+		job.swarm = nil
+		job.connectedPeers, job.connectedSeeds = 0, 0
+	}
+	job.mtx.Unlock()
+	sw.close()
+}
+
+// returns torrent of job, which may be replaced when another torrent is merged into job
+func (job *Job) torrent() *bcodec.Torrent {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	return job.Torrent
+}
+
+// creates queued job out of torrent with valid meta info, whose content is saved to savePath
+func newJob(tr *bcodec.Torrent, savePath string) *Job {
+	return &Job{
+		Torrent:     tr,
+		ID:          hex.EncodeToString(tr.Info.Hash),
+		Status:      JobStatusQueued,
+		StatusSince: time.Now(),
+		SavePath:    savePath,
+		pieces:      bitfield.New(int(tr.Info.PieceCnt())),
+	}
 }
 
 // A bittorent download job.
 type Job struct {
 	*bcodec.Torrent
-	ID     string
-	Status JobStatus
+	ID string
+	// status and the time it's entered; use State to read them and transition to change them
+	Status      JobStatus
+	StatusSince time.Time
+	// cause of JobStatusErrored
+	Err error
+	// directory job content is saved to
+	SavePath string
+	// upload slots of job, choker.DefaultSlots if not positive; it may get fewer due to Bter.UploadSlots
+	UploadSlots int
+	// mutex guarding states above except ID, states below, as well as trackers and web seeds of torrent
+	mtx sync.Mutex
+	// pieces downloaded and verified
+	pieces *bitfield.Bitfield
+	// # pieces checked so far while job is checking
+	checkedPieces int
+	// peers served while job is downloading or seeding, nil otherwise
+	swarm *swarm
+	// payload bytes transferred over the lifetime of job
+	uploaded   int64
+	downloaded int64
+	upRate     rateMeter
+	downRate   rateMeter
+	// # peers connected, seeds included
+	connectedPeers int
+	connectedSeeds int
+	// status to resume to once job is unpaused
+	pausedFrom JobStatus
+	// stops job goroutine
+	cancel context.CancelFunc
+	// announce states keyed by tracker url
+	trackers map[string]*TrackerStatus
 }
 
-type JobStatus string
-
-const (
-	JobStatusQueued      JobStatus = "Queued"
-	JobStatusDownlaoding JobStatus = "Downloading"
-	JobStatusStopped     JobStatus = "Stopped"
-	JobStatusCompleted   JobStatus = "Completed"
-)
-
 type JobStore struct {
 	// TODO we expect per-job update will be frequent in our case, so maybe switch to https://github.com/orcaman/concurrent-map at some point
 	jobs map[string]*Job
 	// mutex guarding jobs map
 	mtx *sync.Mutex
+	// directory jobs are persisted to, see OpenJobStore; jobs are kept in memory only if empty
+	dir string
+	// mutex serializing writes to dir
+	saveMtx *sync.Mutex
 }
 
 func NewJobStore() *JobStore {
 	return &JobStore{
-		jobs: make(map[string]*Job),
-		mtx:  &sync.Mutex{},
+		jobs:    make(map[string]*Job),
+		mtx:     &sync.Mutex{},
+		saveMtx: &sync.Mutex{},
+	}
+}
+
+// removes job with id from store, returning the job removed or nil if there's no such job
+func (store *JobStore) remove(id string) *Job {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	job := store.jobs[id]
+	delete(store.jobs, id)
+	return job
+}
+
+// Get returns job with id, or nil if there's no such job.
+func (store *JobStore) Get(id string) *Job {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	return store.jobs[id]
+}
+
+// List returns all jobs in no particular order.
+func (store *JobStore) List() []*Job {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	res := make([]*Job, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		res = append(res, job)
+	}
+	return res
+}
+
+/*
+Adds job to store unless there's a job with the same id, in which case trackers and web seeds of job are
+merged into the existing one. Returns job in store and whether job is merged.
+*/
+func (store *JobStore) addOrMerge(job *Job) (*Job, bool) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	existing, ok := store.jobs[job.ID]
+	if !ok {
+		store.jobs[job.ID] = job
+		return job, false
+	}
+	existing.mtx.Lock()
+	defer existing.mtx.Unlock()
+	existing.Torrent = mergeTorrent(existing.Torrent, job.Torrent)
+	return existing, true
+}
+
+/*
+Returns copy of dst with trackers and web seeds of src added. Copy is made so that those who're reading
+trackers of dst, e.g. announcers, don't race with merging.
+*/
+func mergeTorrent(dst *bcodec.Torrent, src *bcodec.Torrent) *bcodec.Torrent {
+	res := *dst
+	res.TrackerTiers = append([][]string{}, dst.Tiers()...)
+	res.Trackers = append([]string{}, dst.Trackers...)
+	for _, tier := range src.Tiers() {
+		var added []string
+		for _, url := range tier {
+			if !containsStr(res.Trackers, url) {
+				added = append(added, url)
+				res.Trackers = append(res.Trackers, url)
+			}
+		}
+		if len(added) > 0 {
+			res.TrackerTiers = append(res.TrackerTiers, added)
+		}
+	}
+	res.WebSeeds = append([]string{}, dst.WebSeeds...)
+	for _, url := range src.WebSeeds {
+		if !containsStr(res.WebSeeds, url) {
+			res.WebSeeds = append(res.WebSeeds, url)
+		}
+	}
+	return &res
+}
+
+func containsStr(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
 	}
+	return false
 }
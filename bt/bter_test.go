@@ -0,0 +1,92 @@
+package bt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/magnet"
+)
+
+func TestCreateJob(t *testing.T) {
+	bter := NewBter(6881)
+	info := &bcodec.TorrentInfo{Name: "foo", Hash: bytes.Repeat([]byte{1}, 20)}
+	res := bter.CreateJob(
+		&bcodec.Torrent{Info: info, Trackers: []string{"wss://a.net/announce"}, WebSeeds: []string{"http://seed.net/"}},
+		nil,
+		&bcodec.Torrent{Info: &bcodec.TorrentInfo{Name: "bar", Hash: bytes.Repeat([]byte{2}, 20)}},
+		&bcodec.Torrent{Info: info, Trackers: []string{"wss://a.net/announce", "wss://b.net/announce"}, WebSeeds: []string{"http://seed.net/", "http://seed2.net/"}},
+	)
+	assert.Equal(t, 4, len(res))
+	assert.Nil(t, res[0].Err)
+	assert.False(t, res[0].Merged)
+	assert.Equal(t, "0101010101010101010101010101010101010101", res[0].Job.ID)
+	assert.NotNil(t, res[1].Err)
+	assert.Nil(t, res[1].Job)
+	assert.Nil(t, res[2].Err)
+	assert.False(t, res[2].Merged)
+	assert.Nil(t, res[3].Err)
+	assert.True(t, res[3].Merged)
+	assert.Same(t, res[0].Job, res[3].Job)
+	assert.Equal(t, 2, len(bter.Jobs.List()))
+
+	tr := res[0].Job.torrent()
+	assert.Equal(t, []string{"wss://a.net/announce", "wss://b.net/announce"}, tr.Trackers)
+	assert.Equal(t, [][]string{{"wss://a.net/announce"}, {"wss://b.net/announce"}}, tr.Tiers())
+	assert.Equal(t, []string{"http://seed.net/", "http://seed2.net/"}, tr.WebSeeds)
+	assert.Same(t, res[0].Job, bter.Jobs.Get(res[0].Job.ID))
+	assert.Nil(t, bter.Jobs.Get("nope"))
+}
+
+func TestJobLifecycle(t *testing.T) {
+	bter := NewBter(6881)
+	// content isn't on disk so job has to download it
+	info := &bcodec.TorrentInfo{Name: "foo", Hash: bytes.Repeat([]byte{1}, 20), PieceLenBytes: 4, LenBytes: 4, Pieces: make([]byte, 20)}
+	bter.SaveDir = t.TempDir()
+	res := bter.CreateJob(&bcodec.Torrent{Info: info})
+	id := res[0].Job.ID
+	status := func() JobStatus { return bter.Jobs.Get(id).State().Status }
+	assert.Eventually(t, func() bool { return status() == JobStatusDownloading }, time.Second, time.Millisecond)
+
+	assert.Nil(t, bter.PauseJob(id))
+	assert.Equal(t, JobStatusPaused, status())
+	// pausing twice is a no-op
+	assert.Nil(t, bter.PauseJob(id))
+	assert.Nil(t, bter.StartJob(id))
+	assert.Equal(t, JobStatusDownloading, status())
+	assert.Nil(t, bter.StopJob(id))
+	assert.Equal(t, JobStatusStopped, status())
+	// stopping twice is a no-op
+	assert.Nil(t, bter.StopJob(id))
+	assert.Nil(t, bter.StartJob(id))
+	assert.Eventually(t, func() bool { return status() == JobStatusDownloading }, time.Second, time.Millisecond)
+	// starting a running job is a no-op
+	assert.Nil(t, bter.StartJob(id))
+
+	assert.Nil(t, bter.DelJob(id))
+	assert.Equal(t, JobStatusStopped, res[0].Job.State().Status)
+	assert.Nil(t, bter.Jobs.Get(id))
+	assert.ErrorIs(t, bter.DelJob(id), ErrJobNotFound)
+	assert.ErrorIs(t, bter.StartJob(id), ErrJobNotFound)
+	assert.ErrorIs(t, bter.StopJob(id), ErrJobNotFound)
+	assert.ErrorIs(t, bter.PauseJob(id), ErrJobNotFound)
+}
+
+func TestCreateJobFromMagnet(t *testing.T) {
+	m, err := magnet.Parse("magnet:?xt=urn:btih:" + strings.Repeat("ab", 20) + "&dn=foo")
+	assert.Nil(t, err)
+	bter := NewBter(6881)
+	bter.SaveDir = t.TempDir()
+	job := bter.CreateJob(m.Torrent())[0].Job
+	status := func() JobStatus { return job.State().Status }
+	// nothing is checked, let alone seeded, till meta info is known
+	assert.Eventually(t, func() bool { return status() == JobStatusFetchingMetadata }, time.Second, time.Millisecond)
+	assert.Nil(t, bter.RecheckJob(job.ID))
+	assert.Equal(t, JobStatusFetchingMetadata, status())
+	assert.Nil(t, bter.StopJob(job.ID))
+	assert.Nil(t, bter.StartJob(job.ID))
+	assert.Eventually(t, func() bool { return status() == JobStatusFetchingMetadata }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,82 @@
+package bt
+
+import (
+	"context"
+	"errors"
+
+	"wuyrush.io/gtr/bitfield"
+	"wuyrush.io/gtr/storage"
+)
+
+// # goroutines hashing pieces of a job being checked
+const checkWorkers = 4
+
+// ErrV2OnlyUnsupported is returned when checking a job whose torrent has no v1 piece hashes.
+var ErrV2OnlyUnsupported = errors.New("v2-only torrents are not supported yet")
+
+/*
+Checks pieces of job with id saved on disk again, e.g. after its files are altered outside of gtr. Job which
+is running gets interrupted and proceeds as per the result of check; job which is stopped or errored is
+started.
+*/
+func (bter *Bter) RecheckJob(id string) error {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	var err error
+	switch job.Status {
+	case JobStatusQueued, JobStatusChecking, JobStatusFetchingMetadata:
+		// job goroutine is about to check, or checking already; there's nothing to check without meta info
+		job.mtx.Unlock()
+		return nil
+	case JobStatusStopped, JobStatusErrored:
+		err = job.transitionLocked(JobStatusQueued, nil)
+	default:
+		if job.cancel != nil {
+			job.cancel()
+			job.cancel = nil
+		}
+		err = job.transitionLocked(JobStatusChecking, nil)
+	}
+	job.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	go bter.run(job)
+	return nil
+}
+
+/*
+Hashes content of job saved under its save path and returns pieces which are intact. Files missing or
+truncated only fail the pieces they span.
+
+Jobs of v2-only torrents fail with ErrV2OnlyUnsupported: their pieces are aligned to file boundaries and
+hashed into merkle trees, neither of which storage and verification handle yet.
+*/
+func (bter *Bter) check(ctx context.Context, job *Job) (*bitfield.Bitfield, error) {
+	info := job.torrent().Info
+	if info.PieceCnt() == 0 {
+		return bitfield.New(0), nil
+	}
+	if !info.HasV1() {
+		return nil, ErrV2OnlyUnsupported
+	}
+	job.mtx.Lock()
+	dir := job.SavePath
+	job.mtx.Unlock()
+	s, err := storage.NewFile(info, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return storage.Verify(ctx, info, s, checkWorkers, func(int, bool) {
+		job.mtx.Lock()
+		defer job.mtx.Unlock()
+		// count of a recheck superseding this one starts over
+		if ctx.Err() == nil {
+			job.checkedPieces++
+		}
+	})
+}
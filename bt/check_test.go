@@ -0,0 +1,56 @@
+package bt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+func TestRecheckJob(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo")
+	assert.Nil(t, os.WriteFile(path, make([]byte, 40<<10), 0o644))
+	tr, err := bcodec.NewTorrent(path, &bcodec.CreateOpts{PieceLenBytes: 16 << 10})
+	assert.Nil(t, err)
+	bter := NewBter(6881)
+	bter.SaveDir = dir
+	job := bter.CreateJob(tr)[0].Job
+	status := func() JobStatus { return job.State().Status }
+	assert.Eventually(t, func() bool { return status() == JobStatusSeeding }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(0), job.Progress().LeftBytes)
+
+	assert.Nil(t, os.Truncate(path, 20<<10))
+	assert.Nil(t, bter.RecheckJob(job.ID))
+	assert.Eventually(t, func() bool { return status() == JobStatusDownloading }, time.Second, time.Millisecond)
+	p := job.Progress()
+	assert.Equal(t, int64(24<<10), p.LeftBytes)
+	assert.True(t, p.Pieces.Has(0))
+	assert.False(t, p.Pieces.Has(1))
+
+	assert.Nil(t, bter.StopJob(job.ID))
+	assert.Nil(t, bter.RecheckJob(job.ID))
+	assert.Eventually(t, func() bool { return status() == JobStatusDownloading }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, bter.RecheckJob("nope"), ErrJobNotFound)
+}
+
+func TestCheckV2Only(t *testing.T) {
+	info := &bcodec.TorrentInfo{
+		Name:          "foo",
+		Hash:          bytes.Repeat([]byte{1}, 20),
+		HashV2:        bytes.Repeat([]byte{1}, 32),
+		MetaVersion:   2,
+		PieceLenBytes: 16 << 10,
+		LenBytes:      40 << 10,
+		PiecesRoot:    bytes.Repeat([]byte{2}, 32),
+	}
+	bter := NewBter(6881)
+	bter.SaveDir = t.TempDir()
+	job := bter.CreateJob(&bcodec.Torrent{Info: info})[0].Job
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusErrored }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, job.State().Err, ErrV2OnlyUnsupported)
+}
@@ -0,0 +1,41 @@
+package bt
+
+import (
+	"wuyrush.io/gtr/choker"
+)
+
+// Sets upload slots of job with id; see Job.UploadSlots.
+func (bter *Bter) SetUploadSlots(id string, slots int) error {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return ErrJobNotFound
+	}
+	job.mtx.Lock()
+	job.UploadSlots = slots
+	job.mtx.Unlock()
+	return bter.Jobs.save(job)
+}
+
+// returns upload slots of each job transferring data, keyed by job id, with Bter.UploadSlots split among them
+func (bter *Bter) uploadSlots() map[string]int {
+	var ids []string
+	var wants []int
+	for _, job := range bter.Jobs.List() {
+		job.mtx.Lock()
+		status, slots := job.Status, job.UploadSlots
+		job.mtx.Unlock()
+		if status != JobStatusDownloading && status != JobStatusSeeding {
+			continue
+		}
+		if slots <= 0 {
+			slots = choker.DefaultSlots
+		}
+		ids = append(ids, job.ID)
+		wants = append(wants, slots)
+	}
+	res := make(map[string]int, len(ids))
+	for i, slots := range choker.Share(bter.UploadSlots, wants) {
+		res[ids[i]] = slots
+	}
+	return res
+}
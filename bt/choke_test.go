@@ -0,0 +1,78 @@
+package bt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/choker"
+	"wuyrush.io/gtr/peer"
+)
+
+func TestUploadSlots(t *testing.T) {
+	bter := NewBter(6881)
+	bter.UploadSlots = 6
+	for i := byte(1); i <= 3; i++ {
+		job, _ := bter.Jobs.addOrMerge(newJob(&bcodec.Torrent{Info: &bcodec.TorrentInfo{Hash: bytes.Repeat([]byte{i}, 20)}}, ""))
+		job.Status = JobStatusDownloading
+	}
+	bter.Jobs.Get("0303030303030303030303030303030303030303").Status = JobStatusStopped
+	assert.Nil(t, bter.SetUploadSlots("0101010101010101010101010101010101010101", 2))
+	assert.ErrorIs(t, bter.SetUploadSlots("nope", 2), ErrJobNotFound)
+	assert.Equal(t, map[string]int{
+		"0101010101010101010101010101010101010101": 2,
+		"0202020202020202020202020202020202020202": 4,
+	}, bter.uploadSlots())
+}
+
+// returns choker stats of the only peer job is connected to
+func chokerPeerOf(job *Job) *choker.Peer {
+	job.mtx.Lock()
+	sw := job.swarm
+	job.mtx.Unlock()
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	for s := range sw.sessions {
+		return s.chokerPeer(time.Now())
+	}
+	return nil
+}
+
+func TestChokerPeerStats(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo")
+	assert.Nil(t, os.WriteFile(path, make([]byte, 40<<10), 0o644))
+	tr, err := bcodec.NewTorrent(path, &bcodec.CreateOpts{PieceLenBytes: 16 << 10})
+	assert.Nil(t, err)
+	// only the first piece is intact
+	assert.Nil(t, os.Truncate(path, 20<<10))
+	bter := NewBter(6881)
+	bter.SaveDir = dir
+	job := bter.CreateJob(tr)[0].Job
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusDownloading }, time.Second, time.Millisecond)
+	t.Cleanup(func() { bter.StopJob(job.ID) })
+
+	_, dec, enc := dialSeeder(t, bter, tr, true)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgBitfield, msg.Type)
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgHaveAll})
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgInterested, msg.Type)
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgPiece, Index: 1, Block: make([]byte, 16<<10)})
+	assert.Eventually(t, func() bool { return !chokerPeerOf(job).LastBlock.IsZero() }, time.Second, time.Millisecond)
+	p := chokerPeerOf(job)
+	assert.True(t, p.AmInterested)
+	assert.True(t, p.DownloadRate > 0)
+	// peer isn't snubbing us as we've requested nothing
+	assert.False(t, p.Snubbed(time.Now().Add(2*choker.SnubTimeout)))
+
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgHaveNone})
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgNotInterested, msg.Type)
+	assert.False(t, chokerPeerOf(job).AmInterested)
+}
@@ -0,0 +1,376 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/peer"
+)
+
+// defaults of ConnLimits
+const (
+	DefaultMaxConns       = 200
+	DefaultMaxConnsPerJob = 50
+	DefaultMaxHalfOpen    = 8
+)
+
+const (
+	// max time to establish TCP connection to a peer
+	dialTimeout = 10 * time.Second
+	// interval between rounds of dialing peers of a job
+	dialInterval = time.Second
+	// backoff before redialing a peer, doubled after each failure in a row
+	minRedialBackoff = 30 * time.Second
+	maxRedialBackoff = 30 * time.Minute
+	// peer is forgotten once it fails this many times in a row
+	maxDialFailures = 6
+	// max # peers of a job kept to connect to
+	maxCandidates = 500
+)
+
+var (
+	// ErrTooManyConns is returned when a connection would exceed Bter.ConnLimits.
+	ErrTooManyConns = errors.New("too many peer connections")
+	// ErrDuplicateConn is returned when we're connected to the peer for the same job already.
+	ErrDuplicateConn = errors.New("duplicate peer connection")
+)
+
+// limits of peer connections; defaults are used for limits not positive
+type ConnLimits struct {
+	// connections of all jobs, half-open ones included
+	Global int
+	// connections of each job, half-open ones included
+	PerJob int
+	// outgoing connections of all jobs being established
+	HalfOpen int
+}
+
+func (x ConnLimits) orDefault() ConnLimits {
+	if x.Global <= 0 {
+		x.Global = DefaultMaxConns
+	}
+	if x.PerJob <= 0 {
+		x.PerJob = DefaultMaxConnsPerJob
+	}
+	if x.HalfOpen <= 0 {
+		x.HalfOpen = DefaultMaxHalfOpen
+	}
+	return x
+}
+
+/*
+Listen listens for incoming peer connections on Bter.Port of all local addresses, IPv4 and IPv6 alike. Port is
+picked by the system if Bter.Port is 0, in which case Bter.Port is updated; call it before starting jobs so that
+trackers are told the right port.
+*/
+func (bter *Bter) Listen() (net.Listener, error) {
+	bter.portMtx.Lock()
+	defer bter.portMtx.Unlock()
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(bter.Port))))
+	if err != nil {
+		return nil, fmt.Errorf("error listening for peers: %w", err)
+	}
+	bter.Port = uint16(ln.Addr().(*net.TCPAddr).Port)
+	return ln, nil
+}
+
+// Serve accepts connections on ln and serves each of them with HandleConn, till ctx is done or ln fails.
+func (bter *Bter) Serve(ctx context.Context, ln net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return fmt.Errorf("error accepting peer connection: %w", err)
+		}
+		go bter.HandleConn(conn)
+	}
+}
+
+/*
+Connects to peers of job till ctx is done. Peers become candidates once they're known e.g. from trackers, and
+are dialed as connection limits allow; those which fail or disconnect are redialed with backoff.
+*/
+func (bter *Bter) dialLoop(ctx context.Context, job *Job, sw *swarm) {
+	ticker := time.NewTicker(dialInterval)
+	defer ticker.Stop()
+	for {
+		for _, c := range bter.conns.dialable(job.ID, bter.ConnLimits, time.Now()) {
+			c := c
+			go func() {
+				err := bter.dial(ctx, job, sw, c)
+				bter.conns.hangUp(job.ID, c, err, time.Now())
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connects to candidate c reserved by connManager.dialable, and serves it till connection ends
+func (bter *Bter) dial(ctx context.Context, job *Job, sw *swarm, c *candidate) error {
+	ours, err := peer.NewHandshake(job.torrent().Info.Hash, bter.PeerID, bter.reserved())
+	if err != nil {
+		bter.conns.established(c, false, time.Now())
+		return err
+	}
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		bter.conns.established(c, false, time.Now())
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	theirs, err := peer.Exchange(conn, ours, c.peerID)
+	bter.conns.established(c, err == nil, time.Now())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return bter.serveConn(sw, conn, ours, theirs)
+}
+
+// serves conn handshaken already, unless we're connected to the peer for the same job already
+func (bter *Bter) serveConn(sw *swarm, conn net.Conn, ours *peer.Handshake, theirs *peer.Handshake) error {
+	defer conn.Close()
+	peerID := string(theirs.PeerID[:])
+	if !bter.conns.addPeer(sw.job.ID, peerID) {
+		return ErrDuplicateConn
+	}
+	defer bter.conns.removePeer(sw.job.ID, peerID)
+	return sw.serve(conn, ours, theirs)
+}
+
+// tracks peer connections of all jobs to enforce connection limits and dedupe peers, as well as peers to dial
+type connManager struct {
+	// mutex guarding states below
+	mtx sync.Mutex
+	// # connections, half-open ones included
+	total    int
+	halfOpen int
+	jobs     map[string]*jobConns
+}
+
+// connections of a job
+type jobConns struct {
+	// # connections, half-open ones included
+	cnt int
+	// ids of peers connected
+	peers map[string]struct{}
+	// peers to dial keyed by address
+	candidates map[string]*candidate
+}
+
+// peer to dial
+type candidate struct {
+	addr string
+	// peer id told by tracker, nil if unknown
+	peerID []byte
+	// # failures in a row
+	failures int
+	// candidate is being dialed or is connected
+	busy     bool
+	halfOpen bool
+	// time connection is established, zero if it's not
+	connectedAt time.Time
+	nextDial    time.Time
+}
+
+func newConnManager() *connManager {
+	return &connManager{jobs: make(map[string]*jobConns)}
+}
+
+// caller must hold m.mtx
+func (m *connManager) job(id string) *jobConns {
+	jc := m.jobs[id]
+	if jc == nil {
+		jc = &jobConns{peers: make(map[string]struct{}), candidates: make(map[string]*candidate)}
+		m.jobs[id] = jc
+	}
+	return jc
+}
+
+// forgets job with id once it has nothing to track; caller must hold m.mtx
+func (m *connManager) gc(id string) {
+	if jc := m.jobs[id]; jc != nil && jc.cnt == 0 && len(jc.peers) == 0 && len(jc.candidates) == 0 {
+		delete(m.jobs, id)
+	}
+}
+
+// reserves a connection of job with id, e.g. an incoming one; returns false if limits don't allow
+func (m *connManager) reserve(id string, limits ConnLimits) bool {
+	limits = limits.orDefault()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	jc := m.job(id)
+	if m.total >= limits.Global || jc.cnt >= limits.PerJob {
+		m.gc(id)
+		return false
+	}
+	m.total++
+	jc.cnt++
+	return true
+}
+
+// releases connection reserved by reserve
+func (m *connManager) release(id string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.total--
+	m.job(id).cnt--
+	m.gc(id)
+}
+
+// records that job with id is connected to peer with peerID, returning false if it's connected already
+func (m *connManager) addPeer(id string, peerID string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	jc := m.job(id)
+	if _, ok := jc.peers[peerID]; ok {
+		return false
+	}
+	jc.peers[peerID] = struct{}{}
+	return true
+}
+
+func (m *connManager) removePeer(id string, peerID string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.job(id).peers, peerID)
+	m.gc(id)
+}
+
+// adds peers of job with id to dial, skipping those known already
+func (m *connManager) addCandidates(id string, peers []*bcodec.Peer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	jc := m.job(id)
+	for _, p := range peers {
+		if !p.AddrPort.IsValid() || p.AddrPort.Port() == 0 {
+			continue
+		}
+		addr := p.AddrPort.String()
+		if _, ok := jc.candidates[addr]; ok || len(jc.candidates) >= maxCandidates {
+			continue
+		}
+		c := &candidate{addr: addr}
+		if len(p.ID) == 20 {
+			c.peerID = p.ID
+		}
+		jc.candidates[addr] = c
+	}
+}
+
+// forgets peers of job with id to dial, e.g. once job stops; connections are tracked till they're released
+func (m *connManager) removeCandidates(id string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if jc := m.jobs[id]; jc != nil {
+		jc.candidates = make(map[string]*candidate)
+		m.gc(id)
+	}
+}
+
+/*
+Returns candidates of job with id due to be dialed at now, as many as limits allow. Each of them is reserved as a
+half-open connection, which caller must report with established once connection is established or fails, and
+with hangUp once it ends.
+*/
+func (m *connManager) dialable(id string, limits ConnLimits, now time.Time) []*candidate {
+	limits = limits.orDefault()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	jc := m.job(id)
+	var res []*candidate
+	for _, c := range jc.candidates {
+		if m.halfOpen >= limits.HalfOpen || m.total >= limits.Global || jc.cnt >= limits.PerJob {
+			break
+		}
+		if c.busy || now.Before(c.nextDial) {
+			continue
+		}
+		c.busy, c.halfOpen = true, true
+		m.halfOpen++
+		m.total++
+		jc.cnt++
+		res = append(res, c)
+	}
+	m.gc(id)
+	return res
+}
+
+// records that dialing c is done, with connection established or not
+func (m *connManager) established(c *candidate, ok bool, now time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !c.halfOpen {
+		return
+	}
+	c.halfOpen = false
+	m.halfOpen--
+	if ok {
+		c.connectedAt = now
+	}
+}
+
+/*
+Records that connection to c of job with id ends at now with err, and schedules redialing it: a peer which stays
+connected for long is redialed soon, while one failing in a row backs off exponentially till it's forgotten. Peer
+which turns out to be ourselves is forgotten right away.
+*/
+func (m *connManager) hangUp(id string, c *candidate, err error, now time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if c.halfOpen {
+		c.halfOpen = false
+		m.halfOpen--
+	}
+	m.total--
+	jc := m.job(id)
+	jc.cnt--
+	if !c.connectedAt.IsZero() && now.Sub(c.connectedAt) >= minRedialBackoff {
+		c.failures = 0
+	} else {
+		c.failures++
+	}
+	c.busy, c.connectedAt = false, time.Time{}
+	if c.failures >= maxDialFailures || errors.Is(err, peer.ErrSelfConnection) {
+		if jc.candidates[c.addr] == c {
+			delete(jc.candidates, c.addr)
+		}
+	} else {
+		c.nextDial = now.Add(redialBackoff(c.failures))
+	}
+	m.gc(id)
+}
+
+// backoff before redialing peer which fails the given times in a row
+func redialBackoff(failures int) time.Duration {
+	backoff := minRedialBackoff
+	for i := 1; i < failures && backoff < maxRedialBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRedialBackoff {
+		backoff = maxRedialBackoff
+	}
+	return backoff
+}
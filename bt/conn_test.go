@@ -0,0 +1,178 @@
+package bt
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/peer"
+)
+
+func candidatesOf(addrs ...string) []*bcodec.Peer {
+	res := make([]*bcodec.Peer, len(addrs))
+	for i, addr := range addrs {
+		res[i] = &bcodec.Peer{AddrPort: netip.MustParseAddrPort(addr)}
+	}
+	return res
+}
+
+func TestConnLimits(t *testing.T) {
+	m := newConnManager()
+	limits := ConnLimits{Global: 3, PerJob: 2, HalfOpen: 1}
+	now := time.Now()
+	m.addCandidates("a", candidatesOf("1.1.1.1:1", "1.1.1.2:1", "1.1.1.3:1", "1.1.1.1:1"))
+	assert.Equal(t, 3, len(m.jobs["a"].candidates))
+
+	// half-open limit
+	dialing := m.dialable("a", limits, now)
+	assert.Equal(t, 1, len(dialing))
+	assert.Equal(t, 0, len(m.dialable("a", limits, now)))
+	m.established(dialing[0], true, now)
+	// per-job limit
+	assert.Equal(t, 1, len(m.dialable("a", limits, now)))
+	assert.Equal(t, 0, len(m.dialable("a", limits, now)))
+	assert.False(t, m.reserve("a", limits))
+	// global limit
+	assert.True(t, m.reserve("b", limits))
+	assert.False(t, m.reserve("c", limits))
+	m.release("b")
+	assert.True(t, m.reserve("c", limits))
+	m.release("c")
+	assert.Equal(t, 2, m.total)
+	assert.Equal(t, 1, m.halfOpen)
+	_, ok := m.jobs["b"]
+	assert.False(t, ok)
+
+	m.hangUp("a", dialing[0], nil, now.Add(time.Minute))
+	assert.Equal(t, 1, m.total)
+	assert.Equal(t, 1, m.halfOpen)
+	m.removeCandidates("a")
+	assert.Equal(t, 0, len(m.dialable("a", limits, now)))
+}
+
+func TestConnDedupe(t *testing.T) {
+	m := newConnManager()
+	assert.True(t, m.addPeer("a", "x"))
+	assert.False(t, m.addPeer("a", "x"))
+	assert.True(t, m.addPeer("b", "x"))
+	m.removePeer("a", "x")
+	assert.True(t, m.addPeer("a", "x"))
+}
+
+func TestRedialBackoff(t *testing.T) {
+	m := newConnManager()
+	limits := ConnLimits{}
+	now := time.Now()
+	m.addCandidates("a", candidatesOf("1.1.1.1:1"))
+	for i := 1; i < maxDialFailures; i++ {
+		c := m.dialable("a", limits, now)[0]
+		m.established(c, false, now)
+		m.hangUp("a", c, nil, now)
+		assert.Equal(t, i, c.failures)
+		assert.Equal(t, 0, len(m.dialable("a", limits, now.Add(redialBackoff(i)-time.Second))))
+		now = now.Add(redialBackoff(i))
+	}
+	assert.Equal(t, maxRedialBackoff, redialBackoff(maxDialFailures*2))
+	// connection which lasts resets failures
+	c := m.dialable("a", limits, now)[0]
+	m.established(c, true, now)
+	now = now.Add(time.Hour)
+	m.hangUp("a", c, nil, now)
+	assert.Equal(t, 0, c.failures)
+	assert.Equal(t, 0, len(m.dialable("a", limits, now)))
+	now = now.Add(minRedialBackoff)
+	for i := 0; i < maxDialFailures; i++ {
+		c := m.dialable("a", limits, now)[0]
+		m.established(c, false, now)
+		m.hangUp("a", c, nil, now)
+		now = now.Add(maxRedialBackoff)
+	}
+	// peer failing too many times is forgotten
+	_, ok := m.jobs["a"]
+	assert.False(t, ok)
+
+	m.addCandidates("a", candidatesOf("1.1.1.1:1"))
+	c = m.dialable("a", limits, now)[0]
+	m.established(c, false, now)
+	m.hangUp("a", c, peer.ErrSelfConnection, now)
+	_, ok = m.jobs["a"]
+	assert.False(t, ok)
+}
+
+// # peers job is connected to
+func sessionCnt(job *Job) int {
+	job.mtx.Lock()
+	sw := job.swarm
+	job.mtx.Unlock()
+	if sw == nil {
+		return 0
+	}
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	return len(sw.sessions)
+}
+
+func TestListenAndDial(t *testing.T) {
+	var ln net.Listener
+	seeder, tr, _ := startSeeding(t, func(bter *Bter) {
+		bter.Port = 0
+		var err error
+		ln, err = bter.Listen()
+		assert.Nil(t, err)
+	})
+	assert.NotEqual(t, uint16(0), seeder.Port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- seeder.Serve(ctx, ln) }()
+
+	leecher := NewBter(0)
+	leecher.SaveDir = t.TempDir()
+	job := leecher.CreateJob(tr)[0].Job
+	defer leecher.StopJob(job.ID)
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusDownloading }, time.Second, time.Millisecond)
+	addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), seeder.Port).String()
+	leecher.conns.addCandidates(job.ID, candidatesOf(addr, addr))
+	assert.Eventually(t, func() bool {
+		return sessionCnt(job) == 1 && sessionCnt(seeder.Jobs.Get(job.ID)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// seeder is connected to leecher already
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	hs, err := peer.NewHandshake(tr.Info.Hash, leecher.PeerID, peer.Reserved{})
+	assert.Nil(t, err)
+	errs := make(chan error, 1)
+	go func() { errs <- seeder.HandleConn(theirs) }()
+	_, err = peer.Exchange(ours, hs, nil)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, <-errs, ErrDuplicateConn)
+
+	// stopping job disconnects its peers
+	assert.Nil(t, leecher.StopJob(job.ID))
+	assert.Eventually(t, func() bool { return sessionCnt(seeder.Jobs.Get(job.ID)) == 0 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.Nil(t, <-served)
+}
+
+func TestIncomingConnLimit(t *testing.T) {
+	bter, tr, _ := startSeeding(t, func(bter *Bter) { bter.ConnLimits = ConnLimits{PerJob: 1} })
+	_, dec, _ := dialSeeder(t, bter, tr, true)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgHaveAll, msg.Type)
+	// the only slot is taken, so the second connection is closed during handshake
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- bter.HandleConn(theirs) }()
+	hs, err := peer.NewHandshake(tr.Info.Hash, NewPeerID(), peer.Reserved{})
+	assert.Nil(t, err)
+	_, err = peer.Exchange(ours, hs, nil)
+	assert.NotNil(t, err)
+	assert.ErrorIs(t, <-errs, ErrTooManyConns)
+}
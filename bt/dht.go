@@ -0,0 +1,80 @@
+package bt
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+const (
+	// interval between DHT announces of a job, well within the time DHT nodes keep peers
+	dhtAnnounceInterval = 15 * time.Minute
+	// interval between checks whether trackers of a job fail or port changes, as well as retries of failed DHT
+	// announces
+	dhtRetryInterval = time.Minute
+)
+
+/*
+Gets peers of job from DHT till ctx is done, while its trackers fail or it has none. Nodes in torrent are added
+to DHT first. Private torrents don't use DHT as per BEP 27.
+
+Job is announced on the port we listen on at the time; it's announced again as soon as the port changes, e.g.
+once Listen is called after the job starts.
+*/
+func (bter *Bter) dhtLoop(ctx context.Context, job *Job) {
+	tr := job.torrent()
+	if tr.Info.Private {
+		return
+	}
+	addrs := make([]string, 0, len(tr.DhtNodes))
+	for _, n := range tr.DhtNodes {
+		addrs = append(addrs, net.JoinHostPort(n.Host, strconv.FormatInt(n.Port, 10)))
+	}
+	bter.DHT.AddNodes(ctx, addrs...)
+	// time and port of the latest lookup succeeded
+	var last time.Time
+	var lastPort uint16
+	for {
+		port := bter.port()
+		if job.trackersFail() && (time.Since(last) >= dhtAnnounceInterval || port != lastPort) {
+			var peers []*bcodec.Peer
+			var err error
+			// peers can't connect to us unless we listen
+			if port == 0 {
+				peers, err = bter.DHT.GetPeers(ctx, tr.Info.Hash)
+			} else {
+				peers, err = bter.DHT.Announce(ctx, tr.Info.Hash, port)
+			}
+			if err == nil {
+				bter.conns.addCandidates(job.ID, peers)
+				last, lastPort = time.Now(), port
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dhtRetryInterval):
+		}
+	}
+}
+
+/*
+Whether no tracker of job succeeds in its last announce; trackers yet to announce don't fail, which they do
+once their announce times out. Job without trackers counts as its trackers failing, so that it gets peers from
+DHT instead.
+*/
+func (job *Job) trackersFail() bool {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	for _, tier := range job.Torrent.Tiers() {
+		for _, url := range tier {
+			if s := job.trackers[url]; s == nil || s.Err == nil {
+				return false
+			}
+		}
+	}
+	return true
+}
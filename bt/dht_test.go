@@ -0,0 +1,73 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/dht"
+)
+
+// starts DHT server on loopback bootstrapping from routers
+func startDHT(t *testing.T, routers ...string) *dht.Server {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	x := dht.NewServer(conn, &dht.ServerOpts{Routers: routers, Timeout: time.Second})
+	go x.Serve()
+	t.Cleanup(func() { conn.Close() })
+	return x
+}
+
+func TestPeersFromDHT(t *testing.T) {
+	routerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer routerConn.Close()
+	router := dht.NewServer(routerConn, nil)
+	go router.Serve()
+	routerAddr := routerConn.LocalAddr().String()
+
+	seeder, tr, _ := startSeeding(t, func(bter *Bter) {
+		bter.Port = 0
+		ln, err := bter.Listen()
+		assert.Nil(t, err)
+		t.Cleanup(func() { ln.Close() })
+		go bter.Serve(context.Background(), ln)
+		bter.DHT = startDHT(t, routerAddr)
+	})
+	// torrent has no tracker, so seeder announces to DHT right away
+	assert.Equal(t, 0, len(tr.Tiers()))
+	assert.Eventually(t, func() bool { return router.Stats().Peers == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	leecher := NewBter(0)
+	leecher.SaveDir = t.TempDir()
+	leecher.DHT = startDHT(t, routerAddr)
+	job := leecher.CreateJob(tr)[0].Job
+	defer leecher.StopJob(job.ID)
+	assert.Eventually(t, func() bool {
+		return sessionCnt(job) == 1 && sessionCnt(seeder.Jobs.Get(job.ID)) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	// leecher isn't listening, so it only gets peers
+	assert.Equal(t, 1, router.Stats().Peers)
+}
+
+func TestTrackersFail(t *testing.T) {
+	info := &bcodec.TorrentInfo{Name: "foo", Hash: make([]byte, 20)}
+	// job without trackers has nothing but DHT to get peers from
+	job := newJob(&bcodec.Torrent{Info: info}, "")
+	assert.True(t, job.trackersFail())
+	job = newJob(&bcodec.Torrent{Info: info, Trackers: []string{""}, TrackerTiers: [][]string{{}}}, "")
+	assert.True(t, job.trackersFail())
+	job = newJob(&bcodec.Torrent{Info: info, Trackers: []string{"http://a.net/announce"}, TrackerTiers: [][]string{{"http://b.net/announce"}}}, "")
+	// trackers yet to announce
+	assert.False(t, job.trackersFail())
+	job.setTrackerStatus("http://a.net/announce", nil, errors.New("boom"))
+	assert.False(t, job.trackersFail())
+	job.setTrackerStatus("http://b.net/announce", &bcodec.TrackerRsp{}, nil)
+	assert.False(t, job.trackersFail())
+	job.setTrackerStatus("http://b.net/announce", nil, errors.New("boom"))
+	assert.True(t, job.trackersFail())
+}
@@ -0,0 +1,202 @@
+package bt
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+)
+
+const (
+	// extension of job state files
+	jobFileExt = ".job"
+	// extension state files are renamed to once they're found corrupted, so that they can be inspected
+	corruptFileExt = ".corrupt"
+)
+
+// persisted state of a job
+type jobRecord struct {
+	Torrent     bencode.Bytes `bencode:"torrent"`
+	Status      JobStatus     `bencode:"status"`
+	StatusSince int64         `bencode:"status since"`
+	Err         string        `bencode:"error,omitempty"`
+	SavePath    string        `bencode:"save path"`
+	Pieces      []byte        `bencode:"pieces"`
+	Uploaded    int64         `bencode:"uploaded"`
+	Downloaded  int64         `bencode:"downloaded"`
+	UploadSlots int           `bencode:"upload slots,omitempty"`
+}
+
+/*
+Opens job store persisting jobs to dir, one state file per job, and loads jobs persisted there previously.
+
+A state file which can't be loaded doesn't fail the others; it's renamed with suffix .corrupt and its name is
+returned in corrupted. Jobs which were running when persisted are loaded as queued; see Bter.ResumeJobs.
+*/
+func OpenJobStore(dir string) (store *JobStore, corrupted []string, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("error creating job state directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading job state directory: %w", err)
+	}
+	store = NewJobStore()
+	store.dir = dir
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, jobFileExt+".tmp") {
+			// left behind by a save interrupted before rename; the previous state file, if any, is intact
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, jobFileExt) {
+			continue
+		}
+		job, err := loadJob(filepath.Join(dir, name))
+		if err != nil || job.ID+jobFileExt != name {
+			os.Rename(filepath.Join(dir, name), filepath.Join(dir, name+corruptFileExt))
+			corrupted = append(corrupted, name)
+			continue
+		}
+		store.jobs[job.ID] = job
+	}
+	return store, corrupted, nil
+}
+
+func loadJob(path string) (*Job, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &jobRecord{}
+	if err := bencode.Unmarshal(b, rec); err != nil {
+		return nil, fmt.Errorf("error decoding job state: %w", err)
+	}
+	tr, err := bcodec.DecodeTorrent(rec.Torrent)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding torrent of job: %w", err)
+	}
+	pieces, err := bitfield.FromBytes(rec.Pieces, int(tr.Info.PieceCnt()))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding pieces of job: %w", err)
+	}
+	if _, ok := jobTransitions[rec.Status]; !ok {
+		return nil, fmt.Errorf("unknown job status %q", rec.Status)
+	}
+	job := &Job{
+		Torrent:     tr,
+		ID:          hex.EncodeToString(tr.Info.Hash),
+		Status:      rec.Status,
+		StatusSince: time.Unix(rec.StatusSince, 0),
+		SavePath:    rec.SavePath,
+		UploadSlots: rec.UploadSlots,
+		pieces:      pieces,
+		uploaded:    rec.Uploaded,
+		downloaded:  rec.Downloaded,
+	}
+	switch job.Status {
+	case JobStatusStopped, JobStatusCompleted:
+	case JobStatusErrored:
+		job.Err = errors.New(rec.Err)
+	default:
+		job.Status = JobStatusQueued
+	}
+	return job, nil
+}
+
+// persists job if store is backed by a directory
+func (store *JobStore) save(job *Job) error {
+	if store.dir == "" {
+		return nil
+	}
+	// job is snapshotted while holding saveMtx, so that an older snapshot never overwrites a newer one
+	store.saveMtx.Lock()
+	defer store.saveMtx.Unlock()
+	job.mtx.Lock()
+	torrent := job.Torrent
+	rec := &jobRecord{
+		Status:      job.Status,
+		StatusSince: job.StatusSince.Unix(),
+		SavePath:    job.SavePath,
+		UploadSlots: job.UploadSlots,
+		Pieces:      append([]byte{}, job.pieces.Bytes()...),
+		Uploaded:    job.uploaded,
+		Downloaded:  job.downloaded,
+	}
+	if job.Err != nil {
+		rec.Err = job.Err.Error()
+	}
+	job.mtx.Unlock()
+	b, err := bencode.Marshal(torrent)
+	if err != nil {
+		return fmt.Errorf("error encoding torrent of job %s: %w", job.ID, err)
+	}
+	rec.Torrent = b
+	if b, err = bencode.Marshal(rec); err != nil {
+		return fmt.Errorf("error encoding state of job %s: %w", job.ID, err)
+	}
+	// a deleted job must not be brought back
+	if store.Get(job.ID) != job {
+		return nil
+	}
+	if err := writeFileAtomic(filepath.Join(store.dir, job.ID+jobFileExt), b); err != nil {
+		return fmt.Errorf("error saving state of job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// removes state file of job with id if store is backed by a directory
+func (store *JobStore) deleteFile(id string) error {
+	if store.dir == "" {
+		return nil
+	}
+	store.saveMtx.Lock()
+	defer store.saveMtx.Unlock()
+	if err := os.Remove(filepath.Join(store.dir, id+jobFileExt)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting state of job %s: %w", id, err)
+	}
+	return nil
+}
+
+/*
+Writes b to file at path so that path holds either its previous content or b even if we crash halfway: b is
+written to a temporary file first, which is synced and then renamed to path.
+*/
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// persist the rename itself
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
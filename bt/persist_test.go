@@ -0,0 +1,152 @@
+package bt
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+func newTestTorrent(t *testing.T, content string) *bcodec.Torrent {
+	path := filepath.Join(t.TempDir(), "content")
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+	tr, err := bcodec.NewTorrent(path, &bcodec.CreateOpts{Trackers: []string{"http://127.0.0.1:1/announce"}, PieceLenBytes: 16 << 10})
+	assert.Nil(t, err)
+	return tr
+}
+
+func TestJobStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+	store, corrupted, err := OpenJobStore(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, corrupted)
+	bter := NewBter(6881)
+	bter.SaveDir = t.TempDir()
+	bter.Jobs = store
+	foo, bar := newTestTorrent(t, "foo"), newTestTorrent(t, string(make([]byte, 40<<10)))
+	res := bter.CreateJob(foo, bar)
+	fooID, barID := res[0].Job.ID, res[1].Job.ID
+	for _, r := range res {
+		job := r.Job
+		assert.Eventually(t, func() bool { return job.State().Status == JobStatusDownloading }, time.Second, time.Millisecond)
+	}
+	stopAndWait(t, bter, res[0].Job)
+	stopAndWait(t, bter, res[1].Job)
+	assert.Nil(t, bter.StartJob(barID))
+	assert.Eventually(t, func() bool { return res[1].Job.State().Status == JobStatusDownloading }, time.Second, time.Millisecond)
+	stopAndWait(t, bter, res[1].Job)
+	// gtr exits while job is running
+	res[1].Job.mtx.Lock()
+	res[1].Job.Status = JobStatusDownloading
+	res[1].Job.pieces.Set(2)
+	res[1].Job.uploaded, res[1].Job.downloaded = 3, 5
+	res[1].Job.mtx.Unlock()
+	assert.Nil(t, bter.Jobs.save(res[1].Job))
+	// garbage and a save interrupted before rename
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "0123456789012345678901234567890123456789.job"), []byte("d7:torrent"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, fooID+".job.tmp"), []byte("d"), 0o644))
+
+	store, corrupted, err = OpenJobStore(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0123456789012345678901234567890123456789.job"}, corrupted)
+	assert.Equal(t, 2, len(store.List()))
+	job := store.Get(fooID)
+	assert.Equal(t, JobStatusStopped, job.Status)
+	assert.Equal(t, bter.SaveDir, job.SavePath)
+	assert.Equal(t, foo.Info.Hash, job.Info.Hash)
+	assert.Equal(t, foo.Trackers, job.Trackers)
+	job = store.Get(barID)
+	// job running when persisted is queued to be resumed
+	assert.Equal(t, JobStatusQueued, job.Status)
+	assert.Equal(t, 3, job.pieces.Len())
+	assert.True(t, job.pieces.Has(2))
+	assert.Equal(t, 1, job.pieces.Count())
+	assert.Equal(t, int64(3), job.uploaded)
+	assert.Equal(t, int64(5), job.downloaded)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{fooID + ".job", barID + ".job", "0123456789012345678901234567890123456789.job.corrupt"}, names)
+
+	bter = NewBter(6881)
+	bter.Jobs = store
+	bter.ResumeJobs()
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusDownloading }, time.Second, time.Millisecond)
+	assert.Nil(t, bter.DelJob(barID))
+	_, err = os.Stat(filepath.Join(dir, barID+".job"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// stops job and waits till its goroutine is done with saving it, i.e. once its swarm is gone
+func stopAndWait(t *testing.T, bter *Bter, job *Job) {
+	assert.Nil(t, bter.StopJob(job.ID))
+	assert.Eventually(t, func() bool {
+		job.mtx.Lock()
+		defer job.mtx.Unlock()
+		return job.swarm == nil
+	}, time.Second, time.Millisecond)
+}
+
+func TestSaveOrder(t *testing.T) {
+	store, _, err := OpenJobStore(t.TempDir())
+	assert.Nil(t, err)
+	job, _ := store.addOrMerge(newJob(newTestTorrent(t, "foo"), ""))
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.save(job)
+		}()
+	}
+	assert.Nil(t, job.transition(JobStatusStopped, nil))
+	assert.Nil(t, store.save(job))
+	wg.Wait()
+	// whichever save lands last, it's never older than the state job is in
+	loaded, err := loadJob(filepath.Join(store.dir, job.ID+jobFileExt))
+	assert.Nil(t, err)
+	assert.Equal(t, JobStatusStopped, loaded.Status)
+}
+
+func TestLoadJob(t *testing.T) {
+	t.Parallel()
+	tr := newTestTorrent(t, "foo")
+	cases := []struct {
+		name   string
+		mutate func(job *Job)
+		ok     bool
+	}{
+		{"valid", func(job *Job) {}, true},
+		{"errored", func(job *Job) { job.Status, job.Err = JobStatusErrored, os.ErrPermission }, true},
+		{"unknown status", func(job *Job) { job.Status = "Flying" }, false},
+		{"spare bits set", func(job *Job) { job.pieces.Bytes()[0] = 0xff }, false},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			store, _, err := OpenJobStore(t.TempDir())
+			assert.Nil(t, err)
+			job, _ := store.addOrMerge(newJob(tr, ""))
+			c.mutate(job)
+			assert.Nil(t, store.save(job))
+			loaded, err := loadJob(filepath.Join(store.dir, job.ID+jobFileExt))
+			if !c.ok {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, job.Status, loaded.Status)
+			if job.Err != nil {
+				assert.Equal(t, job.Err.Error(), loaded.Err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package bt
+
+import (
+	"context"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+	"wuyrush.io/gtr/tracker"
+)
+
+// # seconds transfer rates are averaged over
+const rateWindowSecs = 10
+
+// snapshot of how a job is doing
+type JobProgress struct {
+	ID   string
+	Name string
+	JobState
+	TotalBytes     int64
+	CompletedBytes int64
+	LeftBytes      int64
+	// payload bytes transferred over the lifetime of job
+	Uploaded   int64
+	Downloaded int64
+	// bytes per second, averaged over the last rateWindowSecs seconds
+	UploadRate   float64
+	DownloadRate float64
+	// estimated time to complete download at the current download rate; negative if unknown
+	ETA time.Duration
+	// uploaded over downloaded bytes, 0 if nothing is downloaded
+	Ratio float64
+	// # peers we're connected to, including seeds
+	ConnectedPeers int
+	ConnectedSeeds int
+	// swarm size reported by trackers, the largest among them; peers include seeds
+	AvailablePeers int
+	AvailableSeeds int
+	Trackers       []TrackerStatus
+	// progress of files in the same order as in torrent, padding files excluded
+	Files []FileProgress
+	// pieces downloaded and verified, a copy owned by the snapshot
+	Pieces *bitfield.Bitfield
+}
+
+// download progress of a single file of torrent
+type FileProgress struct {
+	Path           string
+	LenBytes       int64
+	CompletedBytes int64
+}
+
+// Progress returns snapshot of how job is doing.
+func (job *Job) Progress() *JobProgress {
+	tr := job.torrent()
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	now := time.Now()
+	res := &JobProgress{
+		ID:             job.ID,
+		Name:           tr.Info.Name,
+		JobState:       job.stateLocked(),
+		TotalBytes:     tr.Info.LenBytes,
+		Uploaded:       job.uploaded,
+		Downloaded:     job.downloaded,
+		UploadRate:     job.upRate.rate(now),
+		DownloadRate:   job.downRate.rate(now),
+		ConnectedPeers: job.connectedPeers,
+		ConnectedSeeds: job.connectedSeeds,
+		Trackers:       make([]TrackerStatus, 0, len(job.trackers)),
+		Pieces:         job.pieces.Clone(),
+	}
+	var fileCompleted []int64
+	res.CompletedBytes, fileCompleted = completedBytes(tr.Info, job.pieces)
+	res.LeftBytes = res.TotalBytes - res.CompletedBytes
+	switch {
+	case res.LeftBytes == 0:
+	case res.DownloadRate > 0:
+		res.ETA = time.Duration(float64(res.LeftBytes) / res.DownloadRate * float64(time.Second))
+	default:
+		res.ETA = -1
+	}
+	if res.Downloaded > 0 {
+		res.Ratio = float64(res.Uploaded) / float64(res.Downloaded)
+	}
+	for _, s := range job.trackers {
+		res.Trackers = append(res.Trackers, *s)
+		if s.Err != nil || s.SeederCnt == nil || s.LeecherCnt == nil {
+			continue
+		}
+		if n := *s.SeederCnt + *s.LeecherCnt; n > res.AvailablePeers {
+			res.AvailablePeers = n
+		}
+		if *s.SeederCnt > res.AvailableSeeds {
+			res.AvailableSeeds = *s.SeederCnt
+		}
+	}
+	if len(tr.Info.Files) == 0 {
+		res.Files = []FileProgress{{Path: tr.Info.Name, LenBytes: tr.Info.LenBytes, CompletedBytes: res.CompletedBytes}}
+		return res
+	}
+	for i, f := range tr.Info.Files {
+		if !f.IsPadding() {
+			res.Files = append(res.Files, FileProgress{Path: f.Path, LenBytes: f.LenBytes, CompletedBytes: fileCompleted[i]})
+		}
+	}
+	return res
+}
+
+// interval between progress updates of Subscribe if none is given
+const DefaultSubscribeInterval = time.Second
+
+// JobProgress returns snapshot of how job with id is doing.
+func (bter *Bter) JobProgress(id string) (*JobProgress, error) {
+	job := bter.Jobs.Get(id)
+	if job == nil {
+		return nil, ErrJobNotFound
+	}
+	return job.Progress(), nil
+}
+
+/*
+Subscribe streams progress of all jobs every interval till ctx is done, starting right away;
+DefaultSubscribeInterval applies if interval isn't positive. The channel returned is closed once ctx is done.
+
+Updates aren't queued up for a subscriber falling behind: a pending update is replaced by the newer one so
+that subscriber always gets the latest.
+*/
+func (bter *Bter) Subscribe(ctx context.Context, interval time.Duration) <-chan []*JobProgress {
+	ch := make(chan []*JobProgress, 1)
+	go func() {
+		defer close(ch)
+		if interval <= 0 {
+			interval = DefaultSubscribeInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			jobs := bter.Jobs.List()
+			update := make([]*JobProgress, len(jobs))
+			for i, job := range jobs {
+				update[i] = job.Progress()
+			}
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- update
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch
+}
+
+/*
+Returns # bytes covered by pieces set, in total and per file of info. Files are laid out back to back in
+pieces, padding files included.
+*/
+func completedBytes(info *bcodec.TorrentInfo, pieces *bitfield.Bitfield) (total int64, files []int64) {
+	lens := []int64{info.LenBytes}
+	if len(info.Files) > 0 {
+		lens = make([]int64, len(info.Files))
+		for i, f := range info.Files {
+			lens[i] = f.LenBytes
+		}
+	}
+	files = make([]int64, len(lens))
+	// file i spans [fileOff, fileOff+lens[i]) of content
+	i, fileOff := 0, int64(0)
+	for p := 0; p < pieces.Len(); p++ {
+		if !pieces.Has(p) {
+			continue
+		}
+		start := int64(p) * info.PieceLenBytes
+		end := start + info.PieceLenBytes
+		if end > info.LenBytes {
+			end = info.LenBytes
+		}
+		total += end - start
+		for i < len(lens) && fileOff+lens[i] <= start {
+			fileOff += lens[i]
+			i++
+		}
+		for j, off := i, fileOff; j < len(lens) && off < end; off, j = off+lens[j], j+1 {
+			lo, hi := off, off+lens[j]
+			if lo < start {
+				lo = start
+			}
+			if hi > end {
+				hi = end
+			}
+			if hi > lo {
+				files[j] += hi - lo
+			}
+		}
+	}
+	return total, files
+}
+
+// Records payload bytes uploaded to and downloaded from peers.
+func (job *Job) addTransferred(up int64, down int64) {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	now := time.Now()
+	job.uploaded += up
+	job.downloaded += down
+	job.upRate.add(up, now)
+	job.downRate.add(down, now)
+}
+
+// Records # peers swarm of job is connected to, seeds included. Counts of a swarm superseded are dropped.
+func (job *Job) setPeerCnts(sw *swarm, peers int, seeds int) {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	if job.swarm != sw {
+		return
+	}
+	job.connectedPeers, job.connectedSeeds = peers, seeds
+}
+
+// transfer statistics of job reported to trackers
+func (job *Job) announceStats() tracker.Stats {
+	tr := job.torrent()
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	completed, _ := completedBytes(tr.Info, job.pieces)
+	return tracker.Stats{Uploaded: job.uploaded, Downloaded: job.downloaded, Left: tr.Info.LenBytes - completed}
+}
+
+// moving sum of bytes transferred in per-second buckets
+type rateMeter struct {
+	buckets [rateWindowSecs]int64
+	// unix second of the latest bucket
+	last int64
+}
+
+func (m *rateMeter) add(n int64, now time.Time) {
+	m.advance(now.Unix())
+	m.buckets[m.last%rateWindowSecs] += n
+}
+
+// returns bytes per second averaged over the window ending at now
+func (m *rateMeter) rate(now time.Time) float64 {
+	m.advance(now.Unix())
+	var sum int64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	return float64(sum) / rateWindowSecs
+}
+
+// zeroes buckets which fall out of window ending at sec
+func (m *rateMeter) advance(sec int64) {
+	if sec <= m.last {
+		// clock may step backwards, in which case latest bucket keeps accumulating
+		return
+	}
+	if sec-m.last >= rateWindowSecs {
+		m.buckets = [rateWindowSecs]int64{}
+	} else {
+		for s := m.last + 1; s <= sec; s++ {
+			m.buckets[s%rateWindowSecs] = 0
+		}
+	}
+	m.last = sec
+}
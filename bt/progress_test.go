@@ -0,0 +1,133 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+)
+
+func TestCompletedBytes(t *testing.T) {
+	t.Parallel()
+	multi := &bcodec.TorrentInfo{
+		PieceLenBytes: 4,
+		LenBytes:      14,
+		Files: []*bcodec.FileSpec{
+			{Path: "a", LenBytes: 3},
+			{Path: "pad", LenBytes: 1, Attr: "p"},
+			{Path: "b", LenBytes: 0},
+			{Path: "c", LenBytes: 10},
+		},
+	}
+	single := &bcodec.TorrentInfo{PieceLenBytes: 4, LenBytes: 10}
+	cases := []struct {
+		name      string
+		info      *bcodec.TorrentInfo
+		pieces    []int
+		wantTotal int64
+		wantFiles []int64
+	}{
+		{"none", multi, nil, 0, []int64{0, 0, 0, 0}},
+		{"first piece", multi, []int{0}, 4, []int64{3, 1, 0, 0}},
+		{"last piece shorter", multi, []int{3}, 2, []int64{0, 0, 0, 2}},
+		{"all", multi, []int{0, 1, 2, 3}, 14, []int64{3, 1, 0, 10}},
+		{"single file", single, []int{1, 2}, 6, []int64{6}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			pieces := bitfield.New(int(c.info.PieceCnt()))
+			for _, i := range c.pieces {
+				pieces.Set(i)
+			}
+			total, files := completedBytes(c.info, pieces)
+			assert.Equal(t, c.wantTotal, total)
+			assert.Equal(t, c.wantFiles, files)
+		})
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	t.Parallel()
+	m := &rateMeter{}
+	now := time.Unix(1000, 0)
+	m.add(100, now)
+	m.add(100, now.Add(time.Second))
+	assert.Equal(t, 20.0, m.rate(now.Add(time.Second)))
+	// first bucket falls out of window
+	assert.Equal(t, 10.0, m.rate(now.Add(rateWindowSecs*time.Second)))
+	assert.Equal(t, 0.0, m.rate(now.Add(time.Hour)))
+}
+
+func setPieceDone(job *Job, i int) {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	job.pieces.Set(i)
+}
+
+func TestJobProgress(t *testing.T) {
+	bter := NewBter(6881)
+	info := &bcodec.TorrentInfo{
+		Name:          "foo",
+		Hash:          bytes.Repeat([]byte{1}, 20),
+		PieceLenBytes: 4,
+		LenBytes:      10,
+		Files:         []*bcodec.FileSpec{{Path: "a", LenBytes: 6}, {Path: "b", LenBytes: 4}},
+	}
+	job, _ := bter.Jobs.addOrMerge(newJob(&bcodec.Torrent{Info: info}, ""))
+	setPieceDone(job, 0)
+	job.addTransferred(2, 4)
+	job.connectedPeers, job.connectedSeeds = 3, 1
+	seeders, leechers := 2, 5
+	job.setTrackerStatus("http://a.net/announce", &bcodec.TrackerRsp{SeederCnt: &seeders, LeecherCnt: &leechers}, nil)
+
+	_, err := bter.JobProgress("nope")
+	assert.ErrorIs(t, err, ErrJobNotFound)
+	p, err := bter.JobProgress(job.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "foo", p.Name)
+	assert.Equal(t, JobStatusQueued, p.Status)
+	assert.Equal(t, int64(10), p.TotalBytes)
+	assert.Equal(t, int64(4), p.CompletedBytes)
+	assert.Equal(t, int64(6), p.LeftBytes)
+	assert.Equal(t, 0.5, p.Ratio)
+	assert.Equal(t, 0.4, p.DownloadRate)
+	assert.InDelta(t, 15*time.Second, p.ETA, float64(time.Millisecond))
+	assert.Equal(t, 3, p.ConnectedPeers)
+	assert.Equal(t, 1, p.ConnectedSeeds)
+	assert.Equal(t, 7, p.AvailablePeers)
+	assert.Equal(t, 2, p.AvailableSeeds)
+	assert.Equal(t, 1, len(p.Trackers))
+	assert.Equal(t, []FileProgress{{Path: "a", LenBytes: 6, CompletedBytes: 4}, {Path: "b", LenBytes: 4}}, p.Files)
+	assert.True(t, p.Pieces.Has(0))
+	// snapshot doesn't change with job
+	setPieceDone(job, 1)
+	assert.False(t, p.Pieces.Has(1))
+	assert.Equal(t, int64(2), job.announceStats().Left)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := bter.Subscribe(ctx, time.Millisecond)
+	update := <-updates
+	assert.Equal(t, 1, len(update))
+	assert.Equal(t, int64(8), update[0].CompletedBytes)
+	setPieceDone(job, 2)
+	assert.Eventually(t, func() bool { return (<-updates)[0].LeftBytes == 0 }, time.Second, time.Millisecond)
+	cancel()
+	for range updates {
+	}
+}
+
+func TestSubscribeDefaultInterval(t *testing.T) {
+	bter := NewBter(6881)
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := bter.Subscribe(ctx, 0)
+	assert.Equal(t, 0, len(<-updates))
+	cancel()
+	for range updates {
+	}
+}
@@ -0,0 +1,495 @@
+package bt
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"wuyrush.io/gtr/bitfield"
+	"wuyrush.io/gtr/choker"
+	"wuyrush.io/gtr/peer"
+	"wuyrush.io/gtr/storage"
+)
+
+const (
+	// max time to wait for handshake of incoming connections
+	handshakeTimeout = 10 * time.Second
+	// peer which doesn't send anything for this long is gone; peers send keep-alive every 2 minutes
+	idleTimeout = 3 * time.Minute
+	// we send keep-alive to peers we haven't sent anything for this long
+	keepAliveInterval = 90 * time.Second
+	// max time to wait for a message to be sent
+	writeTimeout = 30 * time.Second
+)
+
+var (
+	// ErrJobNotServing is returned when a connection is for a job which isn't transferring data.
+	ErrJobNotServing = errors.New("job not serving peers")
+	// peer requests a block larger than peer.MaxBlockLen without fast extension to reject it
+	errBadRequest = errors.New("bad block request")
+)
+
+/*
+HandleConn serves incoming connection from a peer, till either side closes it: handshake is routed to the job
+with the same info hash, whose pieces are then served to peer.
+
+Job must be downloading or seeding; connections to other jobs are dropped, as are those exceeding
+Bter.ConnLimits or duplicating a connection to the same peer.
+*/
+func (bter *Bter) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var sw *swarm
+	// connection is reserved before we answer handshake, so that peer rejected sees it closed during handshake
+	full := false
+	ours, theirs, err := peer.Accept(conn, func(infoHash [20]byte) *peer.Handshake {
+		job := bter.Jobs.Get(hex.EncodeToString(infoHash[:]))
+		if job == nil {
+			return nil
+		}
+		job.mtx.Lock()
+		sw = job.swarm
+		job.mtx.Unlock()
+		if sw == nil {
+			return nil
+		}
+		if !bter.conns.reserve(job.ID, bter.ConnLimits) {
+			sw, full = nil, true
+			return nil
+		}
+		hs, _ := peer.NewHandshake(infoHash[:], bter.PeerID, bter.reserved())
+		return hs
+	})
+	if sw != nil {
+		defer bter.conns.release(sw.job.ID)
+	}
+	if full {
+		return ErrTooManyConns
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	return bter.serveConn(sw, conn, ours, theirs)
+}
+
+// whether job has all pieces
+func (job *Job) hasAll() bool {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	return job.pieces.All()
+}
+
+// protocol extensions we support
+func (bter *Bter) reserved() peer.Reserved {
+	var res peer.Reserved
+	res.Set(peer.ExtFast)
+	return res
+}
+
+// peers of a job we're connected to, which we upload pieces to
+type swarm struct {
+	job *Job
+	// returns # upload slots of job
+	slots  func() int
+	choker *choker.Choker
+
+	// mutex guarding states below
+	mtx      sync.Mutex
+	sessions map[*session]struct{}
+	// opened on first request so that nothing is touched on disk till it's needed
+	store  storage.Storage
+	closed bool
+}
+
+// connection to a peer
+type session struct {
+	conn        net.Conn
+	id          string
+	connectedAt time.Time
+	// both sides support fast extension
+	fast bool
+
+	// mutex guarding states below and serializing writes to conn
+	mtx        sync.Mutex
+	enc        *peer.Encoder
+	lastSent   time.Time
+	choked     bool
+	interested bool
+	// we're interested in pieces peer has
+	amInterested bool
+	// pieces peer has, nil till peer tells
+	has      *bitfield.Bitfield
+	upRate   rateMeter
+	downRate rateMeter
+	// time we received the latest block from peer
+	lastBlock time.Time
+}
+
+func newSwarm(job *Job, slots func() int) *swarm {
+	return &swarm{
+		job:      job,
+		slots:    slots,
+		choker:   choker.New(0),
+		sessions: make(map[*session]struct{}),
+	}
+}
+
+/*
+Serves peer on conn handshaken already: our pieces are advertised, and peer's requests are answered while it's
+unchoked. Returns once connection fails or swarm closes.
+*/
+func (sw *swarm) serve(conn net.Conn, ours *peer.Handshake, theirs *peer.Handshake) error {
+	s := &session{
+		conn:        conn,
+		id:          conn.RemoteAddr().String(),
+		connectedAt: time.Now(),
+		fast:        ours.Reserved.Has(peer.ExtFast) && theirs.Reserved.Has(peer.ExtFast),
+		enc:         peer.NewEncoder(conn),
+		choked:      true,
+	}
+	sw.mtx.Lock()
+	if sw.closed {
+		sw.mtx.Unlock()
+		return ErrJobNotServing
+	}
+	sw.sessions[s] = struct{}{}
+	sw.updatePeerCntsLocked()
+	sw.mtx.Unlock()
+	defer func() {
+		sw.mtx.Lock()
+		delete(sw.sessions, s)
+		sw.updatePeerCntsLocked()
+		sw.mtx.Unlock()
+	}()
+	sw.job.mtx.Lock()
+	pieces := sw.job.pieces.Clone()
+	sw.job.mtx.Unlock()
+	var err error
+	switch {
+	case s.fast && pieces.All():
+		err = s.send(&peer.Message{Type: peer.MsgHaveAll})
+	case s.fast && pieces.Count() == 0:
+		err = s.send(&peer.Message{Type: peer.MsgHaveNone})
+	case pieces.Count() > 0:
+		err = s.send(&peer.Message{Type: peer.MsgBitfield, Bitfield: pieces.Bytes()})
+	}
+	if err != nil {
+		return err
+	}
+	dec := peer.NewDecoder(conn)
+	buf := make([]byte, peer.MaxBlockLen)
+	var msg peer.Message
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case peer.MsgInterested:
+			s.mtx.Lock()
+			s.interested = true
+			s.mtx.Unlock()
+			if err := sw.unchokeIfSlotFree(s); err != nil {
+				return err
+			}
+		case peer.MsgNotInterested:
+			s.mtx.Lock()
+			s.interested = false
+			s.mtx.Unlock()
+		case peer.MsgRequest:
+			if err := sw.serveRequest(s, &msg, buf); err != nil {
+				return err
+			}
+		case peer.MsgPiece:
+			now := time.Now()
+			s.mtx.Lock()
+			s.downRate.add(int64(len(msg.Block)), now)
+			s.lastBlock = now
+			s.mtx.Unlock()
+		case peer.MsgBitfield, peer.MsgHave, peer.MsgHaveAll, peer.MsgHaveNone:
+			if !s.fast && (msg.Type == peer.MsgHaveAll || msg.Type == peer.MsgHaveNone) {
+				// BEP 6 has the connection closed
+				return fmt.Errorf("peer sent %s without fast extension", msg.Type)
+			}
+			if err := s.updateHas(&msg, pieces.Len()); err != nil {
+				return err
+			}
+			sw.mtx.Lock()
+			sw.updatePeerCntsLocked()
+			sw.mtx.Unlock()
+			if err := sw.updateInterest(s); err != nil {
+				return err
+			}
+			// seeds have nothing to trade
+			if s.isSeed() && sw.job.hasAll() {
+				return nil
+			}
+		}
+	}
+}
+
+// reports # peers connected and seeds among them to job; caller must hold sw.mtx
+func (sw *swarm) updatePeerCntsLocked() {
+	seeds := 0
+	for s := range sw.sessions {
+		if s.isSeed() {
+			seeds++
+		}
+	}
+	sw.job.setPeerCnts(sw, len(sw.sessions), seeds)
+}
+
+// tells peer we're interested once it has pieces we lack, and not interested once it no longer does
+func (sw *swarm) updateInterest(s *session) error {
+	sw.job.mtx.Lock()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	interested := false
+	if s.has != nil && !sw.job.pieces.All() {
+		for i := 0; i < s.has.Len() && !interested; i++ {
+			interested = s.has.Has(i) && !sw.job.pieces.Has(i)
+		}
+	}
+	sw.job.mtx.Unlock()
+	if interested == s.amInterested {
+		return nil
+	}
+	s.amInterested = interested
+	if interested {
+		return s.sendLocked(&peer.Message{Type: peer.MsgInterested})
+	}
+	return s.sendLocked(&peer.Message{Type: peer.MsgNotInterested})
+}
+
+// answers block request of peer, or rejects it
+func (sw *swarm) serveRequest(s *session, msg *peer.Message, buf []byte) error {
+	if msg.Length == 0 || msg.Length > peer.MaxBlockLen {
+		if !s.fast {
+			return fmt.Errorf("%w: %d bytes at offset %d of piece %d", errBadRequest, msg.Length, msg.Begin, msg.Index)
+		}
+		return s.reject(msg)
+	}
+	s.mtx.Lock()
+	choked := s.choked
+	s.mtx.Unlock()
+	sw.job.mtx.Lock()
+	has := sw.job.pieces.Has(int(msg.Index))
+	sw.job.mtx.Unlock()
+	if choked || !has {
+		return s.reject(msg)
+	}
+	store, err := sw.storage()
+	if err != nil {
+		return err
+	}
+	block := buf[:msg.Length]
+	if err := store.ReadBlock(int(msg.Index), int64(msg.Begin), block); err != nil {
+		if errors.Is(err, storage.ErrOutOfRange) {
+			return s.reject(msg)
+		}
+		return err
+	}
+	if err := s.send(&peer.Message{Type: peer.MsgPiece, Index: msg.Index, Begin: msg.Begin, Block: block}); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.upRate.add(int64(len(block)), time.Now())
+	s.mtx.Unlock()
+	sw.job.addTransferred(int64(len(block)), 0)
+	return nil
+}
+
+// returns storage of job content, opening it if needed
+func (sw *swarm) storage() (storage.Storage, error) {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	if sw.closed {
+		return nil, ErrJobNotServing
+	}
+	if sw.store == nil {
+		tr := sw.job.torrent()
+		sw.job.mtx.Lock()
+		dir := sw.job.SavePath
+		sw.job.mtx.Unlock()
+		s, err := storage.NewFile(tr.Info, dir)
+		if err != nil {
+			return nil, err
+		}
+		sw.store = s
+	}
+	return sw.store, nil
+}
+
+// unchokes peer interested right away if there's a slot free, rather than making it wait for next rechoke
+func (sw *swarm) unchokeIfSlotFree(s *session) error {
+	sw.mtx.Lock()
+	unchoked := 0
+	for other := range sw.sessions {
+		other.mtx.Lock()
+		if !other.choked {
+			unchoked++
+		}
+		other.mtx.Unlock()
+	}
+	sw.mtx.Unlock()
+	if unchoked >= sw.slots() {
+		return nil
+	}
+	return s.setChoked(false)
+}
+
+// rechokes peers as per choker, and sends keep-alive to peers idle for long
+func (sw *swarm) rechoke(now time.Time) {
+	seeding := sw.job.hasAll()
+	sw.mtx.Lock()
+	sessions := make(map[string]*session, len(sw.sessions))
+	peers := make([]*choker.Peer, 0, len(sw.sessions))
+	for s := range sw.sessions {
+		sessions[s.id] = s
+		peers = append(peers, s.chokerPeer(now))
+	}
+	sw.choker.Slots = sw.slots()
+	unchoke := make(map[string]bool)
+	for _, id := range sw.choker.Rechoke(peers, seeding, now) {
+		unchoke[id] = true
+	}
+	sw.mtx.Unlock()
+	for id, s := range sessions {
+		// peers failing to receive get closed, which ends their sessions
+		if err := s.setChoked(!unchoke[id]); err != nil {
+			s.conn.Close()
+			continue
+		}
+		s.mtx.Lock()
+		idle := now.Sub(s.lastSent) > keepAliveInterval
+		s.mtx.Unlock()
+		if idle && s.send(&peer.Message{Type: peer.MsgKeepAlive}) != nil {
+			s.conn.Close()
+		}
+	}
+}
+
+// rechokes every choker.RechokeInterval till ctx is done
+func (sw *swarm) rechokeLoop(ctx context.Context) {
+	ticker := time.NewTicker(choker.RechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sw.rechoke(now)
+		}
+	}
+}
+
+// disconnects all peers and releases storage
+func (sw *swarm) close() {
+	sw.mtx.Lock()
+	defer sw.mtx.Unlock()
+	sw.closed = true
+	for s := range sw.sessions {
+		s.conn.Close()
+	}
+	if sw.store != nil {
+		sw.store.Close()
+	}
+}
+
+func (s *session) send(msg *peer.Message) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.sendLocked(msg)
+}
+
+// same as send but caller must hold s.mtx
+func (s *session) sendLocked(msg *peer.Message) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := s.enc.Encode(msg); err != nil {
+		return err
+	}
+	if err := s.enc.Flush(); err != nil {
+		return err
+	}
+	s.lastSent = time.Now()
+	return nil
+}
+
+// rejects request if fast extension is supported; request is silently dropped otherwise as per BEP 3
+func (s *session) reject(req *peer.Message) error {
+	if !s.fast {
+		return nil
+	}
+	return s.send(&peer.Message{Type: peer.MsgRejectRequest, Index: req.Index, Begin: req.Begin, Length: req.Length})
+}
+
+func (s *session) setChoked(choked bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.choked == choked {
+		return nil
+	}
+	s.choked = choked
+	if choked {
+		return s.sendLocked(&peer.Message{Type: peer.MsgChoke})
+	}
+	return s.sendLocked(&peer.Message{Type: peer.MsgUnchoke})
+}
+
+// returns stats of peer as of now which choker ranks peers by
+func (s *session) chokerPeer(now time.Time) *choker.Peer {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return &choker.Peer{
+		ID:           s.id,
+		Interested:   s.interested,
+		AmInterested: s.amInterested,
+		DownloadRate: s.downRate.rate(now),
+		UploadRate:   s.upRate.rate(now),
+		ConnectedAt:  s.connectedAt,
+		LastBlock:    s.lastBlock,
+		// TODO count requests pending once pieces are downloaded from peers; none is sent till then
+		PendingRequests: 0,
+	}
+}
+
+func (s *session) isSeed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.has != nil && s.has.All()
+}
+
+// records pieces peer has as per bitfield, have or fast extension message
+func (s *session) updateHas(msg *peer.Message, pieceCnt int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	switch msg.Type {
+	case peer.MsgBitfield:
+		has, err := bitfield.FromBytes(msg.Bitfield, pieceCnt)
+		if err != nil {
+			return fmt.Errorf("peer sent malformed bitfield: %w", err)
+		}
+		s.has = has
+	case peer.MsgHaveAll:
+		s.has = bitfield.New(pieceCnt)
+		for i := 0; i < pieceCnt; i++ {
+			s.has.Set(i)
+		}
+	case peer.MsgHaveNone:
+		s.has = bitfield.New(pieceCnt)
+	case peer.MsgHave:
+		if s.has == nil {
+			s.has = bitfield.New(pieceCnt)
+		}
+		if int(msg.Index) >= pieceCnt {
+			return fmt.Errorf("peer has piece %d out of %d pieces", msg.Index, pieceCnt)
+		}
+		s.has.Set(int(msg.Index))
+	}
+	return nil
+}
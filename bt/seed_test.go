@@ -0,0 +1,209 @@
+package bt
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/peer"
+)
+
+/*
+Starts seeding content of 3 pieces, the last one being shorter, and returns the torrent and content. configure
+is applied to Bter before the job starts.
+*/
+func startSeeding(t *testing.T, configure ...func(*Bter)) (*Bter, *bcodec.Torrent, []byte) {
+	dir := t.TempDir()
+	content := make([]byte, 40<<10)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	path := filepath.Join(dir, "foo")
+	assert.Nil(t, os.WriteFile(path, content, 0o644))
+	tr, err := bcodec.NewTorrent(path, &bcodec.CreateOpts{PieceLenBytes: 16 << 10})
+	assert.Nil(t, err)
+	bter := NewBter(6881)
+	bter.SaveDir = dir
+	for _, f := range configure {
+		f(bter)
+	}
+	job := bter.CreateJob(tr)[0].Job
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusSeeding }, time.Second, time.Millisecond)
+	t.Cleanup(func() { bter.StopJob(job.ID) })
+	return bter, tr, content
+}
+
+// connects to bter as a leecher, returning decoder and encoder of the connection
+func dialSeeder(t *testing.T, bter *Bter, tr *bcodec.Torrent, fast bool) (net.Conn, *peer.Decoder, *peer.Encoder) {
+	ours, theirs := net.Pipe()
+	go bter.HandleConn(theirs)
+	t.Cleanup(func() { ours.Close() })
+	var reserved peer.Reserved
+	if fast {
+		reserved.Set(peer.ExtFast)
+	}
+	hs, err := peer.NewHandshake(tr.Info.Hash, NewPeerID(), reserved)
+	assert.Nil(t, err)
+	_, err = peer.Exchange(ours, hs, nil)
+	assert.Nil(t, err)
+	return ours, peer.NewDecoder(ours), peer.NewEncoder(ours)
+}
+
+func sendMsg(t *testing.T, enc *peer.Encoder, msg *peer.Message) {
+	assert.Nil(t, enc.Encode(msg))
+	assert.Nil(t, enc.Flush())
+}
+
+func TestSeed(t *testing.T) {
+	bter, tr, content := startSeeding(t)
+	_, dec, enc := dialSeeder(t, bter, tr, true)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgHaveAll, msg.Type)
+
+	// requests while choked are rejected
+	req := peer.Message{Type: peer.MsgRequest, Index: 2, Begin: 4 << 10, Length: 4 << 10}
+	sendMsg(t, enc, &req)
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.Message{Type: peer.MsgRejectRequest, Index: 2, Begin: 4 << 10, Length: 4 << 10}, msg)
+
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgInterested})
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgUnchoke, msg.Type)
+	sendMsg(t, enc, &req)
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgPiece, msg.Type)
+	assert.Equal(t, uint32(2), msg.Index)
+	assert.Equal(t, content[36<<10:40<<10], msg.Block)
+
+	cases := []struct {
+		name string
+		req  peer.Message
+	}{
+		{"too long", peer.Message{Type: peer.MsgRequest, Index: 0, Begin: 0, Length: peer.MaxBlockLen + 1}},
+		{"empty", peer.Message{Type: peer.MsgRequest, Index: 0, Begin: 0, Length: 0}},
+		{"beyond last piece", peer.Message{Type: peer.MsgRequest, Index: 2, Begin: 8 << 10, Length: 1}},
+		{"no such piece", peer.Message{Type: peer.MsgRequest, Index: 3, Begin: 0, Length: 1}},
+	}
+	for _, c := range cases {
+		sendMsg(t, enc, &c.req)
+		assert.Nil(t, dec.Decode(&msg), c.name)
+		assert.Equal(t, peer.MsgRejectRequest, msg.Type, c.name)
+	}
+	p := bter.Jobs.Get(jobIDOf(tr)).Progress()
+	assert.Equal(t, int64(4<<10), p.Uploaded)
+	assert.Equal(t, int64(0), bter.Jobs.Get(jobIDOf(tr)).announceStats().Left)
+}
+
+func TestSeedPeerCnts(t *testing.T) {
+	bter, tr, _ := startSeeding(t)
+	job := bter.Jobs.Get(jobIDOf(tr))
+	conn, dec, enc := dialSeeder(t, bter, tr, true)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgHaveNone})
+	assert.Eventually(t, func() bool {
+		p := job.Progress()
+		return p.ConnectedPeers == 1 && p.ConnectedSeeds == 0
+	}, time.Second, time.Millisecond)
+	conn.Close()
+	assert.Eventually(t, func() bool { return job.Progress().ConnectedPeers == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPauseSeeding(t *testing.T) {
+	bter, tr, _ := startSeeding(t)
+	id := jobIDOf(tr)
+	conn, dec, _ := dialSeeder(t, bter, tr, true)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Nil(t, bter.PauseJob(id))
+	// peers are disconnected and new ones turned away while paused
+	assert.NotNil(t, dec.Decode(&msg))
+	conn.Close()
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	go bter.HandleConn(theirs)
+	hs, err := peer.NewHandshake(tr.Info.Hash, NewPeerID(), peer.Reserved{})
+	assert.Nil(t, err)
+	_, err = peer.Exchange(ours, hs, nil)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, bter.StartJob(id))
+	assert.Equal(t, JobStatusSeeding, bter.Jobs.Get(id).State().Status)
+	assert.Eventually(t, func() bool {
+		job := bter.Jobs.Get(id)
+		job.mtx.Lock()
+		defer job.mtx.Unlock()
+		return job.swarm != nil
+	}, time.Second, time.Millisecond)
+	_, dec, _ = dialSeeder(t, bter, tr, true)
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgHaveAll, msg.Type)
+}
+
+func TestSeedWithoutFastExtension(t *testing.T) {
+	bter, tr, _ := startSeeding(t)
+	conn, dec, enc := dialSeeder(t, bter, tr, false)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgBitfield, msg.Type)
+	assert.Equal(t, []byte{0xe0}, msg.Bitfield)
+	sendMsg(t, enc, &peer.Message{Type: peer.MsgInterested})
+	assert.Nil(t, dec.Decode(&msg))
+	assert.Equal(t, peer.MsgUnchoke, msg.Type)
+	// oversized request can't be rejected, so the connection is dropped
+	go func() {
+		enc.Encode(&peer.Message{Type: peer.MsgRequest, Index: 0, Begin: 0, Length: 1 << 20})
+		enc.Flush()
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	assert.NotNil(t, dec.Decode(&msg))
+}
+
+func TestHaveNoneWithoutFastExtension(t *testing.T) {
+	bter, tr, _ := startSeeding(t)
+	conn, dec, enc := dialSeeder(t, bter, tr, false)
+	var msg peer.Message
+	assert.Nil(t, dec.Decode(&msg))
+	go func() {
+		enc.Encode(&peer.Message{Type: peer.MsgHaveNone})
+		enc.Flush()
+	}()
+	// message of fast extension not negotiated gets the connection dropped
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	assert.ErrorIs(t, dec.Decode(&msg), io.EOF)
+}
+
+func TestHandleConnUnknownJob(t *testing.T) {
+	bter := NewBter(6881)
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	errs := make(chan error, 1)
+	go func() { errs <- bter.HandleConn(theirs) }()
+	hs, err := peer.NewHandshake(make([]byte, 20), NewPeerID(), peer.Reserved{})
+	assert.Nil(t, err)
+	b, _ := hs.MarshalBinary()
+	go ours.Write(b)
+	assert.ErrorIs(t, <-errs, peer.ErrInfoHashMismatch)
+}
+
+func jobIDOf(tr *bcodec.Torrent) string {
+	return newJob(tr, "").ID
+}
+
+func TestSeedCompletedJob(t *testing.T) {
+	bter, tr, _ := startSeeding(t)
+	job := bter.Jobs.Get(jobIDOf(tr))
+	assert.Nil(t, bter.StopJob(job.ID))
+	// a job which is done with downloading, e.g. loaded by OpenJobStore
+	job.mtx.Lock()
+	job.Status = JobStatusCompleted
+	job.mtx.Unlock()
+	bter.ResumeJobs()
+	assert.Eventually(t, func() bool { return job.State().Status == JobStatusSeeding }, time.Second, time.Millisecond)
+}
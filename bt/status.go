@@ -0,0 +1,120 @@
+package bt
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued JobStatus = "Queued"
+	// verifying pieces on disk
+	JobStatusChecking JobStatus = "Checking"
+	// fetching meta info from peers, e.g. for jobs created from magnet links
+	JobStatusFetchingMetadata JobStatus = "FetchingMetadata"
+	JobStatusDownloading      JobStatus = "Downloading"
+	// all pieces are downloaded and job keeps uploading them
+	JobStatusSeeding JobStatus = "Seeding"
+	// transfer is suspended till job resumes to the status it's paused from
+	JobStatusPaused    JobStatus = "Paused"
+	JobStatusStopped   JobStatus = "Stopped"
+	JobStatusCompleted JobStatus = "Completed"
+	// job can't proceed; see Job.Err for the cause
+	JobStatusErrored JobStatus = "Errored"
+
+	// Deprecated: use JobStatusDownloading.
+	JobStatusDownlaoding = JobStatusDownloading
+)
+
+// ErrInvalidTransition is returned when job can't move from its current status to the requested one.
+var ErrInvalidTransition = errors.New("invalid job status transition")
+
+// statuses reachable from each status
+var jobTransitions = map[JobStatus][]JobStatus{
+	JobStatusQueued:           {JobStatusChecking, JobStatusFetchingMetadata, JobStatusDownloading, JobStatusSeeding},
+	JobStatusChecking:         {JobStatusDownloading, JobStatusSeeding, JobStatusCompleted, JobStatusPaused},
+	JobStatusFetchingMetadata: {JobStatusChecking, JobStatusDownloading, JobStatusPaused},
+	JobStatusDownloading:      {JobStatusChecking, JobStatusSeeding, JobStatusCompleted, JobStatusPaused},
+	JobStatusSeeding:          {JobStatusChecking, JobStatusPaused},
+	JobStatusCompleted:        {JobStatusChecking, JobStatusSeeding},
+	JobStatusPaused:           {JobStatusChecking, JobStatusFetchingMetadata, JobStatusDownloading, JobStatusSeeding},
+	JobStatusStopped:          {JobStatusQueued},
+	JobStatusErrored:          {JobStatusQueued},
+}
+
+// snapshot of job status
+type JobState struct {
+	Status JobStatus
+	// time status is entered
+	Since time.Time
+	// cause of JobStatusErrored
+	Err error
+	// # pieces checked so far while status is checking
+	CheckedPieces int
+}
+
+// State returns current status of job.
+func (job *Job) State() JobState {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	return job.stateLocked()
+}
+
+// same as State but caller must hold job.mtx
+func (job *Job) stateLocked() JobState {
+	res := JobState{Status: job.Status, Since: job.StatusSince, Err: job.Err}
+	if job.Status == JobStatusChecking {
+		res.CheckedPieces = job.checkedPieces
+	}
+	return res
+}
+
+/*
+Moves job to status to, which must be reachable from the current one. cause is required by and only kept for
+JobStatusErrored.
+
+Every status but stopped can move to stopped or errored. Paused job otherwise only moves back to the status
+it's paused from. Job goroutine is stopped when job stops, errors or pauses.
+*/
+func (job *Job) transition(to JobStatus, cause error) error {
+	job.mtx.Lock()
+	defer job.mtx.Unlock()
+	return job.transitionLocked(to, cause)
+}
+
+// same as transition but caller must hold job.mtx
+func (job *Job) transitionLocked(to JobStatus, cause error) error {
+	resuming := job.Status == JobStatusPaused && to != JobStatusStopped && to != JobStatusErrored
+	if !validTransition(job.Status, to) || (resuming && to != job.pausedFrom) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, job.Status, to)
+	}
+	if to == JobStatusErrored && cause == nil {
+		return fmt.Errorf("%w: errored without cause", ErrInvalidTransition)
+	}
+	if to == JobStatusPaused {
+		job.pausedFrom = job.Status
+	}
+	if (to == JobStatusStopped || to == JobStatusErrored || to == JobStatusPaused) && job.cancel != nil {
+		job.cancel()
+		job.cancel = nil
+	}
+	job.Status, job.StatusSince, job.Err = to, time.Now(), nil
+	if to == JobStatusErrored {
+		job.Err = cause
+	}
+	return nil
+}
+
+func validTransition(from JobStatus, to JobStatus) bool {
+	if to == JobStatusStopped || to == JobStatusErrored {
+		return from != JobStatusStopped && from != to
+	}
+	for _, s := range jobTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package bt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobTransition(t *testing.T) {
+	boom := errors.New("boom")
+	tcs := []struct {
+		name  string
+		from  JobStatus
+		to    JobStatus
+		cause error
+		ok    bool
+	}{
+		{name: "queued to checking", from: JobStatusQueued, to: JobStatusChecking, ok: true},
+		{name: "checking to seeding", from: JobStatusChecking, to: JobStatusSeeding, ok: true},
+		{name: "downloading to completed", from: JobStatusDownloading, to: JobStatusCompleted, ok: true},
+		{name: "downloading to paused", from: JobStatusDownloading, to: JobStatusPaused, ok: true},
+		{name: "seeding to stopped", from: JobStatusSeeding, to: JobStatusStopped, ok: true},
+		{name: "errored to stopped", from: JobStatusErrored, to: JobStatusStopped, ok: true},
+		{name: "downloading to errored", from: JobStatusDownloading, to: JobStatusErrored, cause: boom, ok: true},
+		{name: "errored w/o cause", from: JobStatusDownloading, to: JobStatusErrored},
+		{name: "stopped to downloading", from: JobStatusStopped, to: JobStatusDownloading},
+		{name: "stopped to stopped", from: JobStatusStopped, to: JobStatusStopped},
+		{name: "completed to downloading", from: JobStatusCompleted, to: JobStatusDownloading},
+		{name: "seeding to queued", from: JobStatusSeeding, to: JobStatusQueued},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			job := &Job{Status: c.from}
+			before := time.Now()
+			err := job.transition(c.to, c.cause)
+			state := job.State()
+			if !c.ok {
+				assert.ErrorIs(t, err, ErrInvalidTransition)
+				assert.Equal(t, c.from, state.Status)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.to, state.Status)
+			assert.Equal(t, c.cause, state.Err)
+			assert.False(t, state.Since.Before(before))
+		})
+	}
+}
+
+func TestJobTransitionStopsJob(t *testing.T) {
+	canceled := false
+	job := &Job{Status: JobStatusDownloading, cancel: func() { canceled = true }}
+	assert.Nil(t, job.transition(JobStatusPaused, nil))
+	assert.True(t, canceled)
+	canceled = false
+	job.cancel = func() { canceled = true }
+	assert.Nil(t, job.transition(JobStatusErrored, errors.New("disk full")))
+	assert.True(t, canceled)
+	// cause is cleared once job leaves errored
+	assert.Nil(t, job.transition(JobStatusQueued, nil))
+	assert.Nil(t, job.State().Err)
+}
+
+func TestJobTransitionFromPaused(t *testing.T) {
+	job := &Job{Status: JobStatusSeeding}
+	assert.Nil(t, job.transition(JobStatusPaused, nil))
+	// paused job only resumes to the status it's paused from
+	assert.ErrorIs(t, job.transition(JobStatusFetchingMetadata, nil), ErrInvalidTransition)
+	assert.ErrorIs(t, job.transition(JobStatusDownloading, nil), ErrInvalidTransition)
+	assert.ErrorIs(t, job.transition(JobStatusChecking, nil), ErrInvalidTransition)
+	assert.Nil(t, job.transition(JobStatusSeeding, nil))
+	assert.Nil(t, job.transition(JobStatusPaused, nil))
+	assert.Nil(t, job.transition(JobStatusStopped, nil))
+}
@@ -0,0 +1,184 @@
+// Package choker decides which peers to upload to, using tit-for-tat with optimistic unchoking.
+package choker
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// # upload slots of a job if not configured, the optimistic one included
+	DefaultSlots = 4
+	// interval between rechokes
+	RechokeInterval = 10 * time.Second
+	// interval between optimistic unchoke rotations
+	OptimisticInterval = 30 * time.Second
+	// peer which hasn't sent us a block for this long while we want some is snubbing us
+	SnubTimeout = time.Minute
+	// peers connected within this long are 3 times as likely to be unchoked optimistically, so that they get
+	// something to trade with
+	newPeerAge = time.Minute
+)
+
+// state of connection to peer the choker decides on
+type Peer struct {
+	ID string
+	// peer is interested in pieces we have
+	Interested bool
+	// we're interested in pieces peer has
+	AmInterested bool
+	// payload bytes per second we download from and upload to peer, averaged over the last 10 seconds or so
+	DownloadRate float64
+	UploadRate   float64
+	ConnectedAt  time.Time
+	// time we received the latest block from peer; zero if we haven't received any
+	LastBlock time.Time
+	// # block requests we sent to peer which are yet to be answered
+	PendingRequests int
+}
+
+/*
+Snubbed tells whether peer hasn't sent us anything for SnubTimeout while we're interested in it and waiting for
+blocks we requested.
+*/
+func (p *Peer) Snubbed(now time.Time) bool {
+	last := p.LastBlock
+	if last.IsZero() {
+		last = p.ConnectedAt
+	}
+	return p.AmInterested && p.PendingRequests > 0 && now.Sub(last) > SnubTimeout
+}
+
+/*
+Choker unchokes peers of a job: every rechoke, interested peers which are the fastest to download from (or to
+upload to, once we're seeding) get regular slots, and another one picked at random gets the optimistic slot
+which rotates every OptimisticInterval. Peers snubbing us don't get regular slots while we're downloading.
+
+It's not goroutine safe.
+*/
+type Choker struct {
+	// # upload slots, the optimistic one included; DefaultSlots if not positive
+	Slots int
+
+	optimistic      string
+	optimisticSince time.Time
+	rand            *rand.Rand
+}
+
+func New(slots int) *Choker {
+	return &Choker{Slots: slots, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+/*
+Rechoke returns ids of peers to unchoke at now, in which the last one is the optimistic unchoke if any. All
+other peers shall be choked. Peers are ranked by upload rate instead of download rate if seeding.
+*/
+func (c *Choker) Rechoke(peers []*Peer, seeding bool, now time.Time) []string {
+	slots := c.Slots
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+	var candidates []*Peer
+	for _, p := range peers {
+		if p.Interested && (seeding || !p.Snubbed(now)) {
+			candidates = append(candidates, p)
+		}
+	}
+	rate := func(p *Peer) float64 {
+		if seeding {
+			return p.UploadRate
+		}
+		return p.DownloadRate
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return rate(candidates[i]) > rate(candidates[j]) })
+	regular := slots - 1
+	if regular > len(candidates) {
+		regular = len(candidates)
+	}
+	res := make([]string, 0, slots)
+	unchoked := make(map[string]bool, slots)
+	for _, p := range candidates[:regular] {
+		res = append(res, p.ID)
+		unchoked[p.ID] = true
+	}
+	if opt := c.pickOptimistic(peers, unchoked, now); opt != "" {
+		res = append(res, opt)
+	}
+	return res
+}
+
+// keeps optimistic unchoke till it expires, leaves or gets a regular slot, and picks a new one otherwise
+func (c *Choker) pickOptimistic(peers []*Peer, unchoked map[string]bool, now time.Time) string {
+	if c.optimistic != "" && now.Sub(c.optimisticSince) < OptimisticInterval && !unchoked[c.optimistic] {
+		for _, p := range peers {
+			if p.ID == c.optimistic && p.Interested {
+				return c.optimistic
+			}
+		}
+	}
+	// peers are weighted, new peers counting 3 times
+	var pool []*Peer
+	var prev *Peer
+	for _, p := range peers {
+		if !p.Interested || unchoked[p.ID] {
+			continue
+		}
+		if p.ID == c.optimistic {
+			prev = p
+			continue
+		}
+		pool = append(pool, p)
+		if now.Sub(p.ConnectedAt) < newPeerAge {
+			pool = append(pool, p, p)
+		}
+	}
+	if len(pool) == 0 && prev != nil {
+		// nobody else to rotate to
+		pool = append(pool, prev)
+	}
+	if len(pool) == 0 {
+		c.optimistic = ""
+		return ""
+	}
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(now.UnixNano()))
+	}
+	c.optimistic, c.optimisticSince = pool[c.rand.Intn(len(pool))].ID, now
+	return c.optimistic
+}
+
+/*
+Share splits global upload slots among jobs wanting slots each, so that no job gets more than it wants and
+jobs left get shares as equal as possible. Every job gets at least a slot so that it can give back to the
+swarm. Jobs get what they want if global isn't positive.
+*/
+func Share(global int, wants []int) []int {
+	res := make([]int, len(wants))
+	if global <= 0 {
+		copy(res, wants)
+		return res
+	}
+	// jobs by ascending wants, so that spare slots of jobs wanting fewer go to the rest
+	idxs := make([]int, len(wants))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	sort.SliceStable(idxs, func(i, j int) bool { return wants[idxs[i]] < wants[idxs[j]] })
+	left := global
+	for k, i := range idxs {
+		share := left / (len(idxs) - k)
+		if share < 1 {
+			share = 1
+		}
+		if share > wants[i] {
+			share = wants[i]
+		}
+		res[i] = share
+		left -= share
+		if left < 0 {
+			left = 0
+		}
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package choker
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRechoke(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(100000, 0)
+	old := now.Add(-time.Hour)
+	peers := []*Peer{
+		{ID: "slow", Interested: true, DownloadRate: 10, UploadRate: 400, ConnectedAt: old, LastBlock: now},
+		{ID: "fast", Interested: true, DownloadRate: 300, UploadRate: 10, ConnectedAt: old, LastBlock: now},
+		{ID: "medium", Interested: true, DownloadRate: 200, UploadRate: 20, ConnectedAt: old, LastBlock: now},
+		{ID: "snubbing", Interested: true, AmInterested: true, DownloadRate: 1000, ConnectedAt: old, LastBlock: old, PendingRequests: 1},
+		{ID: "uninterested", DownloadRate: 5000, ConnectedAt: old, LastBlock: now},
+	}
+	c := New(3)
+	res := c.Rechoke(peers, false, now)
+	assert.Equal(t, 3, len(res))
+	assert.Equal(t, []string{"fast", "medium"}, res[:2])
+	assert.Contains(t, []string{"slow", "snubbing"}, res[2])
+	// optimistic unchoke sticks till it expires
+	opt := res[2]
+	for i := 0; i < 2; i++ {
+		now = now.Add(RechokeInterval)
+		assert.Equal(t, opt, c.Rechoke(peers, false, now)[2])
+	}
+	now = now.Add(RechokeInterval)
+	res = c.Rechoke(peers, false, now)
+	assert.NotEqual(t, opt, res[2])
+
+	// ranked by upload rate when seeding, where snubbing doesn't matter
+	res = c.Rechoke(peers, true, now)
+	assert.Equal(t, []string{"slow", "medium"}, res[:2])
+
+	assert.Empty(t, New(0).Rechoke([]*Peer{{ID: "a"}}, false, now))
+	assert.Equal(t, []string{"a"}, New(0).Rechoke([]*Peer{{ID: "a", Interested: true, ConnectedAt: now}}, false, now))
+}
+
+func TestSnubbed(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(100000, 0)
+	cases := []struct {
+		name string
+		peer Peer
+		want bool
+	}{
+		{"recent block", Peer{AmInterested: true, PendingRequests: 1, LastBlock: now.Add(-time.Second)}, false},
+		{"stale block", Peer{AmInterested: true, PendingRequests: 1, LastBlock: now.Add(-2 * SnubTimeout)}, true},
+		{"not interested", Peer{PendingRequests: 1, LastBlock: now.Add(-2 * SnubTimeout)}, false},
+		{"no request pending", Peer{AmInterested: true, LastBlock: now.Add(-2 * SnubTimeout)}, false},
+		{"no block since connected", Peer{AmInterested: true, PendingRequests: 1, ConnectedAt: now.Add(-2 * SnubTimeout)}, true},
+		{"newly connected", Peer{AmInterested: true, PendingRequests: 1, ConnectedAt: now}, false},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.want, c.peer.Snubbed(now))
+		})
+	}
+}
+
+/*
+Simulates a swarm where each peer uploads to us at its capacity only while we unchoke it, the way tit-for-tat
+peers reciprocate, except free riders which never upload. Checks reciprocating peers get unchoked the most,
+and that optimistic unchoking gives every peer a chance.
+*/
+func TestFairness(t *testing.T) {
+	t.Parallel()
+	const rounds = 600
+	now := time.Unix(100000, 0)
+	r := rand.New(rand.NewSource(1))
+	var peers []*Peer
+	capacity := make(map[string]float64)
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("peer%d", i)
+		peers = append(peers, &Peer{ID: id, Interested: true, AmInterested: true, ConnectedAt: now, LastBlock: now, PendingRequests: 1})
+		capacity[id] = float64(100 * (i + 1))
+		if i < 3 {
+			capacity[id] = 0
+		}
+	}
+	c := &Choker{Slots: 4, rand: r}
+	unchokedCnt := make(map[string]int)
+	for round := 0; round < rounds; round++ {
+		now = now.Add(RechokeInterval)
+		unchoked := make(map[string]bool)
+		for _, id := range c.Rechoke(peers, false, now) {
+			unchoked[id] = true
+			unchokedCnt[id]++
+		}
+		for _, p := range peers {
+			rate := 0.0
+			if unchoked[p.ID] {
+				rate = capacity[p.ID]
+			}
+			// moving average over 2 rechoke intervals
+			p.DownloadRate = (p.DownloadRate + rate) / 2
+			if rate > 0 {
+				p.LastBlock = now
+			}
+		}
+	}
+	for _, p := range peers {
+		// optimistic slot rotates every 3 rounds among up to 7 peers
+		assert.Greater(t, unchokedCnt[p.ID], rounds/3/7/3, p.ID)
+	}
+	// the 3 fastest reciprocating peers hold regular slots most of the time
+	for _, id := range []string{"peer7", "peer8", "peer9"} {
+		assert.Greater(t, unchokedCnt[id], rounds*3/4, id)
+	}
+	for _, id := range []string{"peer0", "peer1", "peer2"} {
+		assert.Less(t, unchokedCnt[id], rounds/4, id)
+	}
+}
+
+func TestShare(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name   string
+		global int
+		wants  []int
+		want   []int
+	}{
+		{"unlimited", 0, []int{4, 8}, []int{4, 8}},
+		{"enough", 20, []int{4, 8}, []int{4, 8}},
+		{"equal split", 8, []int{8, 8}, []int{4, 4}},
+		{"spare goes to others", 10, []int{2, 8, 8}, []int{2, 4, 4}},
+		{"at least one each", 2, []int{4, 4, 4}, []int{1, 1, 1}},
+		{"none", 4, nil, []int{}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.want, Share(c.global, c.wants))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/anacrolix/torrent/bencode"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gtr create [options] <path>\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var trackers, webSeeds stringsFlag
+	fs.Var(&trackers, "tracker", "tracker announce url; can be repeated, the first one is the primary tracker")
+	fs.Var(&webSeeds, "web-seed", "web seed url; can be repeated")
+	comment := fs.String("comment", "", "free-form comment")
+	pieceLen := fs.Int64("piece-size", 0, "piece size in bytes; picked automatically based on content size if not set")
+	private := fs.Bool("private", false, "mark the torrent private so that peers are only obtained from its trackers")
+	out := fs.String("o", "", "output file path; defaults to <name>.torrent in current directory")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *pieceLen < 0 || (*pieceLen > 0 && *pieceLen%(16<<10) != 0) {
+		return fmt.Errorf("piece size must be a positive multiple of 16KiB")
+	}
+	opts := &bcodec.CreateOpts{
+		Trackers:      trackers,
+		PieceLenBytes: *pieceLen,
+		WebSeeds:      webSeeds,
+		Private:       *private,
+	}
+	if *comment != "" {
+		opts.Comment = comment
+	}
+	tr, err := bcodec.NewTorrent(fs.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	b, err := bencode.Marshal(tr)
+	if err != nil {
+		return fmt.Errorf("error encoding torrent: %w", err)
+	}
+	if *out == "" {
+		*out = tr.Info.Name + ".torrent"
+	}
+	if err := os.WriteFile(*out, b, 0o644); err != nil {
+		return fmt.Errorf("error writing torrent file: %w", err)
+	}
+	fmt.Printf("created %s: info hash %x, %d pieces of %d bytes\n", *out, tr.Info.Hash, len(tr.Info.Pieces)/20, tr.Info.PieceLenBytes)
+	return nil
+}
@@ -0,0 +1,666 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"wuyrush.io/gtr/bcodec"
+)
+
+const (
+	// time to wait for response of a query
+	DefaultTimeout = 2 * time.Second
+	// # queries in flight per lookup, i.e. alpha of Kademlia
+	lookupConcurrency = 3
+	// secret of tokens rotates this often; tokens of the previous secret are still accepted
+	tokenRotation = 5 * time.Minute
+	// peers announced are dropped after this long unless they announce again
+	peerTTL = 30 * time.Minute
+	// caps of peers stored so that they cost bounded memory
+	maxPeersPerInfoHash = 500
+	maxInfoHashes       = 10000
+	// buckets not touched for this long are refreshed
+	refreshInterval = 15 * time.Minute
+	// interval between maintenance rounds, i.e. bucket refresh, bootstrap and expiring peers
+	maintainInterval = time.Minute
+	maxPacketBytes   = 64 << 10
+)
+
+// DefaultRouters are well-known nodes to bootstrap from.
+var DefaultRouters = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var (
+	// ErrNoNodes is returned when a lookup finds no node responding.
+	ErrNoNodes = errors.New("no dht node responding")
+	// query isn't answered in time
+	errTimeout = errors.New("dht query timed out")
+)
+
+// options of DHT server
+type ServerOpts struct {
+	// node id; random if zero
+	ID ID
+	// host:port of nodes to bootstrap from when routing table is nearly empty, e.g. DefaultRouters
+	Routers []string
+	// time to wait for response of a query; DefaultTimeout if not positive
+	Timeout time.Duration
+}
+
+// counts of DHT server states
+type Stats struct {
+	// # nodes in routing table
+	Nodes int
+	// # info hashes and peers announced to us
+	InfoHashes int
+	Peers      int
+}
+
+/*
+Server is a mainline DHT node: it answers queries of other nodes, and looks up peers of torrents.
+
+It's goroutine safe.
+*/
+type Server struct {
+	conn    net.PacketConn
+	id      ID
+	routers []string
+	timeout time.Duration
+	// returns current time, for tests to override
+	now func() time.Time
+
+	// mutex guarding states below
+	mtx   sync.Mutex
+	table *table
+	// queries awaiting response keyed by transaction id
+	pending map[string]*pendingQuery
+	nextTID uint16
+	// secrets to derive tokens from, the current one first
+	secrets   [2][]byte
+	rotatedAt time.Time
+	// peers announced to us keyed by info hash, with the time they announce
+	peers map[ID]map[netip.AddrPort]time.Time
+}
+
+type pendingQuery struct {
+	addr netip.AddrPort
+	rsp  chan *msg
+}
+
+// NewServer creates DHT server communicating over conn, e.g. a UDP socket; call Serve to get it working.
+func NewServer(conn net.PacketConn, opts *ServerOpts) *Server {
+	if opts == nil {
+		opts = &ServerOpts{}
+	}
+	x := &Server{
+		conn:    conn,
+		id:      opts.ID,
+		routers: opts.Routers,
+		timeout: opts.Timeout,
+		now:     time.Now,
+		pending: make(map[string]*pendingQuery),
+		peers:   make(map[ID]map[netip.AddrPort]time.Time),
+	}
+	if x.id == (ID{}) {
+		x.id = NewID()
+	}
+	if x.timeout <= 0 {
+		x.timeout = DefaultTimeout
+	}
+	x.table = newTable(x.id)
+	x.secrets = [2][]byte{newSecret(), newSecret()}
+	return x
+}
+
+func newSecret() []byte {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// ID returns id of the node.
+func (x *Server) ID() ID {
+	return x.id
+}
+
+// Stats returns counts of routing table and peers stored.
+func (x *Server) Stats() Stats {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	res := Stats{Nodes: x.table.len(), InfoHashes: len(x.peers)}
+	for _, peers := range x.peers {
+		res.Peers += len(peers)
+	}
+	return res
+}
+
+/*
+Serve answers queries arriving on conn and receives responses of queries sent over it, until conn is closed.
+Routing table is bootstrapped from routers and kept fresh meanwhile.
+
+Queries of x, e.g. those of GetPeers, time out unless it's serving.
+*/
+func (x *Server) Serve() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go x.maintain(ctx)
+	buf := make([]byte, maxPacketBytes)
+	for {
+		n, addr, err := x.conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		from := udpAddr.AddrPort()
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		x.handle(m, from)
+	}
+}
+
+// bootstraps routing table, then refreshes it and expires peers every maintainInterval till ctx is done
+func (x *Server) maintain(ctx context.Context) {
+	x.lookup(ctx, x.id, methodFindNode)
+	ticker := time.NewTicker(maintainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := x.now()
+		x.mtx.Lock()
+		x.expirePeersLocked(now)
+		targets := x.table.stale(now, refreshInterval)
+		if x.table.len() < bucketSize {
+			targets = append(targets, x.id)
+		}
+		x.mtx.Unlock()
+		for _, target := range targets {
+			x.lookup(ctx, target, methodFindNode)
+		}
+	}
+}
+
+// handles message from addr
+func (x *Server) handle(m *msg, from netip.AddrPort) {
+	switch m.Y {
+	case msgResponse, msgError:
+		x.mtx.Lock()
+		q := x.pending[m.T]
+		if q != nil && q.addr == from {
+			delete(x.pending, m.T)
+		}
+		x.mtx.Unlock()
+		if q != nil && q.addr == from {
+			q.rsp <- m
+		}
+	case msgQuery:
+		rsp := x.answer(m, from)
+		rsp.T = m.T
+		x.send(rsp, from)
+	}
+}
+
+// answers query from addr
+func (x *Server) answer(m *msg, from netip.AddrPort) *msg {
+	fail := func(code int64, s string) *msg {
+		return &msg{Y: msgError, E: &Error{Code: code, Msg: s}}
+	}
+	if m.A == nil {
+		return fail(ErrCodeProtocol, "missing arguments")
+	}
+	id, ok := idFrom(m.A.ID)
+	if !ok {
+		return fail(ErrCodeProtocol, "invalid node id")
+	}
+	now := x.now()
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if ping := x.table.add(Node{ID: id, Addr: from}, now); ping != nil {
+		go x.ping(ping.Addr)
+	}
+	ret := &msgRet{ID: string(x.id[:])}
+	switch m.Q {
+	case methodPing:
+	case methodFindNode:
+		target, ok := idFrom(m.A.Target)
+		if !ok {
+			return fail(ErrCodeProtocol, "invalid target")
+		}
+		x.putNodesLocked(ret, target, from, m.A.Want)
+	case methodGetPeers:
+		infoHash, ok := idFrom(m.A.InfoHash)
+		if !ok {
+			return fail(ErrCodeProtocol, "invalid info hash")
+		}
+		x.rotateLocked(now)
+		ret.Token = token(x.secrets[0], from.Addr())
+		for addr, at := range x.peers[infoHash] {
+			// only peers of the same address family as querying node can be used by it
+			if now.Sub(at) < peerTTL && addr.Addr().Is4() == from.Addr().Is4() {
+				v4, v6 := bcodec.EncodeCompactPeers([]*bcodec.Peer{{AddrPort: addr}})
+				ret.Values = append(ret.Values, string(v4)+string(v6))
+			}
+		}
+		x.putNodesLocked(ret, infoHash, from, m.A.Want)
+	case methodAnnouncePeer:
+		infoHash, ok := idFrom(m.A.InfoHash)
+		if !ok {
+			return fail(ErrCodeProtocol, "invalid info hash")
+		}
+		x.rotateLocked(now)
+		if m.A.Token != token(x.secrets[0], from.Addr()) && m.A.Token != token(x.secrets[1], from.Addr()) {
+			return fail(ErrCodeProtocol, "invalid token")
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = int(from.Port())
+		}
+		if port <= 0 || port > 0xffff {
+			return fail(ErrCodeProtocol, "invalid port")
+		}
+		x.addPeerLocked(infoHash, netip.AddrPortFrom(from.Addr(), uint16(port)), now)
+	default:
+		return fail(ErrCodeMethodUnknown, "method unknown")
+	}
+	return &msg{Y: msgResponse, R: ret}
+}
+
+// puts nodes closest to target into ret, of address families wanted or that of from. Caller must hold x.mtx.
+func (x *Server) putNodesLocked(ret *msgRet, target ID, from netip.AddrPort, want []string) {
+	wantV4, wantV6 := from.Addr().Is4(), !from.Addr().Is4()
+	if len(want) > 0 {
+		wantV4, wantV6 = false, false
+		for _, w := range want {
+			wantV4 = wantV4 || w == "n4"
+			wantV6 = wantV6 || w == "n6"
+		}
+	}
+	v4, v6 := encodeNodes(x.table.closest(target, bucketSize))
+	if wantV4 {
+		ret.Nodes = string(v4)
+	}
+	if wantV6 {
+		ret.Nodes6 = string(v6)
+	}
+}
+
+// token of node at ip, which it presents when announcing to us
+func token(secret []byte, ip netip.Addr) string {
+	b := ip.As16()
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(b[:])
+	return string(h.Sum(nil)[:8])
+}
+
+// rotates token secrets if due. Caller must hold x.mtx.
+func (x *Server) rotateLocked(now time.Time) {
+	if x.rotatedAt.IsZero() {
+		x.rotatedAt = now
+	}
+	if now.Sub(x.rotatedAt) < tokenRotation {
+		return
+	}
+	x.secrets[1] = x.secrets[0]
+	if now.Sub(x.rotatedAt) >= 2*tokenRotation {
+		// tokens of the previous secret are expired as well
+		x.secrets[1] = newSecret()
+	}
+	x.secrets[0] = newSecret()
+	x.rotatedAt = now
+}
+
+// caller must hold x.mtx
+func (x *Server) addPeerLocked(infoHash ID, addr netip.AddrPort, now time.Time) {
+	peers := x.peers[infoHash]
+	if peers == nil {
+		if len(x.peers) >= maxInfoHashes {
+			return
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		x.peers[infoHash] = peers
+	}
+	if _, ok := peers[addr]; !ok && len(peers) >= maxPeersPerInfoHash {
+		// make room by dropping the peer announced least recently
+		var oldest netip.AddrPort
+		for a, at := range peers {
+			if !oldest.IsValid() || at.Before(peers[oldest]) {
+				oldest = a
+			}
+		}
+		delete(peers, oldest)
+	}
+	peers[addr] = now
+}
+
+// caller must hold x.mtx
+func (x *Server) expirePeersLocked(now time.Time) {
+	for h, peers := range x.peers {
+		for addr, at := range peers {
+			if now.Sub(at) >= peerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(x.peers, h)
+		}
+	}
+}
+
+func (x *Server) send(m *msg, to netip.AddrPort) error {
+	b, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = x.conn.WriteTo(b, net.UDPAddrFromAddrPort(to))
+	return err
+}
+
+/*
+Sends query to node at addr and waits for its response. Node responding is added to routing table, while one
+failing to is recorded so.
+*/
+func (x *Server) query(ctx context.Context, to netip.AddrPort, method string, args *msgArgs) (*msgRet, error) {
+	args.ID = string(x.id[:])
+	q := &pendingQuery{addr: to, rsp: make(chan *msg, 1)}
+	x.mtx.Lock()
+	var tid string
+	for {
+		x.nextTID++
+		tid = string([]byte{byte(x.nextTID >> 8), byte(x.nextTID)})
+		if _, ok := x.pending[tid]; !ok {
+			break
+		}
+	}
+	x.pending[tid] = q
+	x.mtx.Unlock()
+	defer func() {
+		x.mtx.Lock()
+		if x.pending[tid] == q {
+			delete(x.pending, tid)
+		}
+		x.mtx.Unlock()
+	}()
+	if err := x.send(&msg{T: tid, Y: msgQuery, Q: method, A: args}, to); err != nil {
+		return nil, fmt.Errorf("error sending %s query to %s: %w", method, to, err)
+	}
+	timer := time.NewTimer(x.timeout)
+	defer timer.Stop()
+	var rsp *msg
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		x.mtx.Lock()
+		x.table.failed(to)
+		x.mtx.Unlock()
+		return nil, fmt.Errorf("%w: %s to %s", errTimeout, method, to)
+	case rsp = <-q.rsp:
+	}
+	if rsp.Y == msgError {
+		if rsp.E == nil {
+			return nil, &Error{Code: ErrCodeGeneric, Msg: "error without details"}
+		}
+		return nil, rsp.E
+	}
+	var id ID
+	ok := false
+	if rsp.R != nil {
+		id, ok = idFrom(rsp.R.ID)
+	}
+	if !ok {
+		return nil, fmt.Errorf("malformed %s response from %s", method, to)
+	}
+	x.mtx.Lock()
+	ping := x.table.add(Node{ID: id, Addr: to}, x.now())
+	x.mtx.Unlock()
+	if ping != nil {
+		go x.ping(ping.Addr)
+	}
+	return rsp.R, nil
+}
+
+// pings node at addr, e.g. a questionable one in routing table
+func (x *Server) ping(addr netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(context.Background(), x.timeout)
+	defer cancel()
+	_, err := x.query(ctx, addr, methodPing, &msgArgs{})
+	return err
+}
+
+/*
+AddNodes pings nodes at addrs in form of host:port, e.g. those of bcodec.Torrent.DhtNodes, so that responding
+ones get into routing table. It returns once all of them respond or fail.
+*/
+func (x *Server) AddNodes(ctx context.Context, addrs ...string) {
+	var wg sync.WaitGroup
+	for _, addr := range x.resolve(ctx, addrs) {
+		addr := addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x.query(ctx, addr, methodPing, &msgArgs{})
+		}()
+	}
+	wg.Wait()
+}
+
+// resolves host:port addresses, dropping those failing to resolve
+func (x *Server) resolve(ctx context.Context, addrs []string) []netip.AddrPort {
+	var res []netip.AddrPort
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+		if err != nil || portNum <= 0 {
+			continue
+		}
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			res = append(res, netip.AddrPortFrom(ip.Unmap(), uint16(portNum)))
+		}
+	}
+	return res
+}
+
+// GetPeers looks up peers of torrent with infoHash.
+func (x *Server) GetPeers(ctx context.Context, infoHash []byte) ([]*bcodec.Peer, error) {
+	target, ok := idFrom(string(infoHash))
+	if !ok {
+		return nil, fmt.Errorf("info hash must be 20 bytes long")
+	}
+	_, peers, err := x.lookup(ctx, target, methodGetPeers)
+	return peers, err
+}
+
+/*
+Announce looks up peers of torrent with infoHash like GetPeers, and announces to nodes closest to it that we're
+a peer listening on port. Port of our DHT node is announced if port is 0.
+*/
+func (x *Server) Announce(ctx context.Context, infoHash []byte, port uint16) ([]*bcodec.Peer, error) {
+	target, ok := idFrom(string(infoHash))
+	if !ok {
+		return nil, fmt.Errorf("info hash must be 20 bytes long")
+	}
+	closest, peers, err := x.lookup(ctx, target, methodGetPeers)
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+		args := &msgArgs{InfoHash: string(infoHash), Port: int(port), Token: n.token}
+		if port == 0 {
+			args.ImpliedPort = 1
+		}
+		addr := n.Addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			x.query(ctx, addr, methodAnnouncePeer, args)
+		}()
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// node visited by a lookup
+type lookupNode struct {
+	Node
+	queried bool
+	failed  bool
+	// node is a router, whose id is unknown till it responds
+	router bool
+	// token of get_peers response
+	token string
+}
+
+type lookupReply struct {
+	node *lookupNode
+	ret  *msgRet
+	err  error
+}
+
+/*
+Looks up nodes closest to target with find_node or get_peers queries, which go to closer and closer nodes till
+the bucketSize closest nodes seen have all responded or failed. Returns the closest nodes responding, closest
+first, along with peers found by get_peers.
+
+Routers are queried as well if routing table is nearly empty.
+*/
+func (x *Server) lookup(ctx context.Context, target ID, method string) ([]*lookupNode, []*bcodec.Peer, error) {
+	x.mtx.Lock()
+	start := x.table.closest(target, bucketSize)
+	x.mtx.Unlock()
+	var shortlist []*lookupNode
+	seen := make(map[netip.AddrPort]bool)
+	for _, n := range start {
+		shortlist = append(shortlist, &lookupNode{Node: n})
+		seen[n.Addr] = true
+	}
+	replies := make(chan lookupReply)
+	inflight := 0
+	queryNode := func(n *lookupNode) {
+		n.queried = true
+		inflight++
+		args := &msgArgs{Target: string(target[:])}
+		if method == methodGetPeers {
+			args = &msgArgs{InfoHash: string(target[:])}
+		}
+		go func() {
+			ret, err := x.query(ctx, n.Addr, method, args)
+			replies <- lookupReply{node: n, ret: ret, err: err}
+		}()
+	}
+	if len(start) < bucketSize {
+		// routers don't compete with nodes by distance till they respond
+		for _, addr := range x.resolve(ctx, x.routers) {
+			if !seen[addr] {
+				seen[addr] = true
+				queryNode(&lookupNode{Node: Node{Addr: addr}, router: true})
+			}
+		}
+	}
+	var peers []*bcodec.Peer
+	seenPeers := make(map[netip.AddrPort]bool)
+	for {
+		// query closest nodes not queried yet
+		cnt := 0
+		for _, n := range shortlist {
+			if inflight >= lookupConcurrency || cnt >= bucketSize {
+				break
+			}
+			if n.failed {
+				continue
+			}
+			cnt++
+			if !n.queried {
+				queryNode(n)
+			}
+		}
+		if inflight == 0 {
+			break
+		}
+		r := <-replies
+		inflight--
+		if r.err != nil {
+			r.node.failed = true
+			continue
+		}
+		if r.node.router {
+			r.node.ID, _ = idFrom(r.ret.ID)
+			r.node.router = false
+			shortlist = append(shortlist, r.node)
+		}
+		r.node.token = r.ret.Token
+		nodes, _ := r.ret.nodes()
+		for _, n := range nodes {
+			if n.ID != x.id && !seen[n.Addr] {
+				seen[n.Addr] = true
+				shortlist = append(shortlist, &lookupNode{Node: n})
+			}
+		}
+		for _, v := range r.ret.Values {
+			addrLen := 4
+			if len(v) == 18 {
+				addrLen = 16
+			}
+			ps, err := bcodec.DecodeCompactPeers([]byte(v), addrLen)
+			if err != nil {
+				continue
+			}
+			for _, p := range ps {
+				if !seenPeers[p.AddrPort] {
+					seenPeers[p.AddrPort] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+		sort.SliceStable(shortlist, func(i, j int) bool { return closer(target, shortlist[i].ID, shortlist[j].ID) })
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, peers, err
+	}
+	var res []*lookupNode
+	for _, n := range shortlist {
+		if n.queried && !n.failed && len(res) < bucketSize {
+			res = append(res, n)
+		}
+	}
+	if len(res) == 0 {
+		return nil, peers, ErrNoNodes
+	}
+	return res, peers, nil
+}
@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+// starts DHT server on loopback bootstrapping from routers, returning it along with its address
+func startServer(t *testing.T, routers ...string) (*Server, netip.AddrPort) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	x := NewServer(conn, &ServerOpts{Routers: routers, Timeout: time.Second})
+	go x.Serve()
+	t.Cleanup(func() { conn.Close() })
+	return x, conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func peerAddrs(peers []*bcodec.Peer) []netip.AddrPort {
+	var res []netip.AddrPort
+	for _, p := range peers {
+		res = append(res, p.AddrPort)
+	}
+	return res
+}
+
+func TestSwarm(t *testing.T) {
+	_, routerAddr := startServer(t)
+	var nodes []*Server
+	var addrs []netip.AddrPort
+	for i := 0; i < 20; i++ {
+		x, addr := startServer(t, routerAddr.String())
+		nodes = append(nodes, x)
+		addrs = append(addrs, addr)
+	}
+	for _, x := range nodes {
+		x := x
+		assert.Eventually(t, func() bool { return x.Stats().Nodes > 0 }, 5*time.Second, 10*time.Millisecond)
+	}
+	ctx := context.Background()
+	infoHash := make([]byte, 20)
+	infoHash[0] = 0xab
+	peers, err := nodes[3].Announce(ctx, infoHash, 7000)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(peers))
+	// port of DHT node is announced if no port is given
+	_, err = nodes[4].Announce(ctx, infoHash, 0)
+	assert.Nil(t, err)
+
+	peers, err = nodes[10].GetPeers(ctx, infoHash)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:7000"), addrs[4]}, peerAddrs(peers))
+	_, err = nodes[10].GetPeers(ctx, infoHash[1:])
+	assert.NotNil(t, err)
+	peers, err = nodes[10].GetPeers(ctx, make([]byte, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(peers))
+
+	stored := 0
+	for _, x := range nodes {
+		stored += x.Stats().Peers
+	}
+	assert.True(t, stored >= 2, stored)
+}
+
+func TestQueryErrors(t *testing.T) {
+	x, addr := startServer(t)
+	client, _ := startServer(t)
+	ctx := context.Background()
+	var kerr *Error
+	_, err := client.query(ctx, addr, methodAnnouncePeer, &msgArgs{InfoHash: string(make([]byte, 20)), Port: 1, Token: "bad"})
+	assert.True(t, errors.As(err, &kerr))
+	assert.Equal(t, int64(ErrCodeProtocol), kerr.Code)
+	_, err = client.query(ctx, addr, "vote", &msgArgs{})
+	assert.True(t, errors.As(err, &kerr))
+	assert.Equal(t, int64(ErrCodeMethodUnknown), kerr.Code)
+	_, err = client.query(ctx, addr, methodFindNode, &msgArgs{Target: "short"})
+	assert.True(t, errors.As(err, &kerr))
+	assert.Equal(t, int64(ErrCodeProtocol), kerr.Code)
+
+	ret, err := client.query(ctx, addr, methodGetPeers, &msgArgs{InfoHash: string(make([]byte, 20))})
+	assert.Nil(t, err)
+	_, err = client.query(ctx, addr, methodAnnouncePeer, &msgArgs{InfoHash: string(make([]byte, 20)), Port: 1, Token: ret.Token})
+	assert.Nil(t, err)
+	assert.Equal(t, Stats{Nodes: 1, InfoHashes: 1, Peers: 1}, x.Stats())
+
+	// nodes which don't respond time out and count as failed
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer dead.Close()
+	deadAddr := dead.LocalAddr().(*net.UDPAddr).AddrPort()
+	client.AddNodes(ctx, addr.String(), deadAddr.String(), "nope")
+	_, err = client.query(ctx, deadAddr, methodPing, &msgArgs{})
+	assert.ErrorIs(t, err, errTimeout)
+	assert.Equal(t, 1, client.Stats().Nodes)
+}
+
+func TestTokenRotation(t *testing.T) {
+	x := NewServer(nil, nil)
+	now := time.Now()
+	ip := netip.MustParseAddr("10.0.0.1")
+	x.rotateLocked(now)
+	tok := token(x.secrets[0], ip)
+	assert.NotEqual(t, tok, token(x.secrets[0], netip.MustParseAddr("10.0.0.2")))
+	x.rotateLocked(now.Add(tokenRotation))
+	assert.Equal(t, tok, token(x.secrets[1], ip))
+	assert.NotEqual(t, tok, token(x.secrets[0], ip))
+	x.rotateLocked(now.Add(4 * tokenRotation))
+	assert.NotEqual(t, tok, token(x.secrets[1], ip))
+}
+
+func TestPeerStore(t *testing.T) {
+	x := NewServer(nil, nil)
+	now := time.Now()
+	for i := 0; i <= maxPeersPerInfoHash; i++ {
+		x.addPeerLocked(ID{}, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(i+1)), now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Equal(t, Stats{InfoHashes: 1, Peers: maxPeersPerInfoHash}, x.Stats())
+	_, ok := x.peers[ID{}][netip.MustParseAddrPort("10.0.0.1:1")]
+	assert.False(t, ok)
+	x.expirePeersLocked(now.Add(peerTTL + time.Duration(maxPeersPerInfoHash-1)*time.Second))
+	assert.Equal(t, Stats{InfoHashes: 1, Peers: 1}, x.Stats())
+	x.expirePeersLocked(now.Add(2 * peerTTL))
+	assert.Equal(t, Stats{}, x.Stats())
+}
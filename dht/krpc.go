@@ -0,0 +1,215 @@
+// Package dht implements a node of mainline DHT, see BEP 5.
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/netip"
+
+	"github.com/anacrolix/torrent/bencode"
+)
+
+// KRPC message types
+const (
+	msgQuery    = "q"
+	msgResponse = "r"
+	msgError    = "e"
+)
+
+// query methods
+const (
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+)
+
+// KRPC error codes
+const (
+	ErrCodeGeneric       = 201
+	ErrCodeServer        = 202
+	ErrCodeProtocol      = 203
+	ErrCodeMethodUnknown = 204
+)
+
+// ID of DHT node, or info hash as lookup target
+type ID [20]byte
+
+// NewID generates a random node id.
+func NewID() ID {
+	var x ID
+	if _, err := rand.Read(x[:]); err != nil {
+		panic(err)
+	}
+	return x
+}
+
+func (x ID) String() string {
+	return hex.EncodeToString(x[:])
+}
+
+// # leading bits x and y have in common, 160 if they're the same
+func commonPrefixLen(x ID, y ID) int {
+	for i := range x {
+		if d := x[i] ^ y[i]; d != 0 {
+			return i*8 + bits.LeadingZeros8(d)
+		}
+	}
+	return len(x) * 8
+}
+
+// whether a is closer to target than b by XOR metric
+func closer(target ID, a ID, b ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// returns b as ID if it's 20 bytes long
+func idFrom(b string) (ID, bool) {
+	var x ID
+	if len(b) != len(x) {
+		return x, false
+	}
+	copy(x[:], b)
+	return x, true
+}
+
+// DHT node reachable at Addr
+type Node struct {
+	ID   ID
+	Addr netip.AddrPort
+}
+
+// encodes nodes in compact node info format, IPv4 nodes in v4 and IPv6 nodes in v6
+func encodeNodes(nodes []Node) (v4 []byte, v6 []byte) {
+	for _, n := range nodes {
+		addr := n.Addr.Addr().Unmap()
+		port := n.Addr.Port()
+		if addr.Is4() {
+			b := addr.As4()
+			v4 = append(append(append(v4, n.ID[:]...), b[:]...), byte(port>>8), byte(port))
+		} else {
+			b := addr.As16()
+			v6 = append(append(append(v6, n.ID[:]...), b[:]...), byte(port>>8), byte(port))
+		}
+	}
+	return v4, v6
+}
+
+// decodes nodes in compact node info format, in which each node takes 20 + addrLen + 2 bytes
+func decodeNodes(b []byte, addrLen int) ([]Node, error) {
+	entryLen := 20 + addrLen + 2
+	if len(b)%entryLen != 0 {
+		return nil, fmt.Errorf("compact node info of %d bytes isn't multiple of %d", len(b), entryLen)
+	}
+	res := make([]Node, 0, len(b)/entryLen)
+	for ; len(b) > 0; b = b[entryLen:] {
+		addr, _ := netip.AddrFromSlice(b[20 : 20+addrLen])
+		port := uint16(b[20+addrLen])<<8 | uint16(b[21+addrLen])
+		if !addr.IsValid() || addr.IsUnspecified() || port == 0 {
+			continue
+		}
+		var n Node
+		copy(n.ID[:], b)
+		n.Addr = netip.AddrPortFrom(addr.Unmap(), port)
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// KRPC message
+type msg struct {
+	// transaction id
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	// method of query
+	Q string   `bencode:"q,omitempty"`
+	A *msgArgs `bencode:"a,omitempty"`
+	R *msgRet  `bencode:"r,omitempty"`
+	E *Error   `bencode:"e,omitempty"`
+}
+
+// arguments of query
+type msgArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+	// address families of nodes wanted, "n4" and/or "n6" as per BEP 32
+	Want []string `bencode:"want,omitempty"`
+}
+
+// return values of response
+type msgRet struct {
+	ID     string `bencode:"id"`
+	Nodes  string `bencode:"nodes,omitempty"`
+	Nodes6 string `bencode:"nodes6,omitempty"`
+	Token  string `bencode:"token,omitempty"`
+	// peers in compact peer info format, one per value
+	Values []string `bencode:"values,omitempty"`
+}
+
+// nodes in response, of both address families
+func (x *msgRet) nodes() ([]Node, error) {
+	v4, err := decodeNodes([]byte(x.Nodes), 4)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := decodeNodes([]byte(x.Nodes6), 16)
+	if err != nil {
+		return nil, err
+	}
+	return append(v4, v6...), nil
+}
+
+// Error is KRPC error replied by the queried node.
+type Error struct {
+	Code int64
+	Msg  string
+}
+
+func (x *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", x.Code, x.Msg)
+}
+
+func (x *Error) UnmarshalBencode(raw []byte) error {
+	var i interface{}
+	if err := bencode.Unmarshal(raw, &i); err != nil {
+		return fmt.Errorf("error decoding KRPC error: %w", err)
+	}
+	tmp, ok := i.([]interface{})
+	if !ok || len(tmp) != 2 {
+		return fmt.Errorf("KRPC error must have code and message: %v", tmp)
+	}
+	code, ok := tmp[0].(int64)
+	if !ok {
+		return fmt.Errorf("invalid KRPC error code: %v", tmp[0])
+	}
+	s, ok := tmp[1].(string)
+	if !ok {
+		return fmt.Errorf("invalid KRPC error message: %v", tmp[1])
+	}
+	x.Code, x.Msg = code, s
+	return nil
+}
+
+func (x *Error) MarshalBencode() ([]byte, error) {
+	return bencode.Marshal([]interface{}{x.Code, x.Msg})
+}
+
+func decodeMsg(b []byte) (*msg, error) {
+	var m msg
+	if err := bencode.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error decoding KRPC message: %w", err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/stretchr/testify/assert"
+)
+
+func idOf(b byte) ID {
+	var x ID
+	x[0] = b
+	return x
+}
+
+func TestMsgCodec(t *testing.T) {
+	tcs := []struct {
+		name string
+		msg  msg
+		wire string
+	}{
+		{
+			name: "ping",
+			msg:  msg{T: "aa", Y: msgQuery, Q: methodPing, A: &msgArgs{ID: "abcdefghij0123456789"}},
+			wire: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		{
+			name: "announce peer",
+			msg:  msg{T: "aa", Y: msgQuery, Q: methodAnnouncePeer, A: &msgArgs{ID: "abcdefghij0123456789", ImpliedPort: 1, InfoHash: "mnopqrstuvwxyz123456", Port: 6881, Token: "aoeusnth"}},
+			wire: "d1:ad2:id20:abcdefghij012345678912:implied_porti1e9:info_hash20:mnopqrstuvwxyz1234564:porti6881e5:token8:aoeusnthe1:q13:announce_peer1:t2:aa1:y1:qe",
+		},
+		{
+			name: "get peers response",
+			msg:  msg{T: "aa", Y: msgResponse, R: &msgRet{ID: "abcdefghij0123456789", Token: "aoeusnth", Values: []string{"axje.u", "idhtnm"}}},
+			wire: "d1:rd2:id20:abcdefghij01234567895:token8:aoeusnth6:valuesl6:axje.u6:idhtnmee1:t2:aa1:y1:re",
+		},
+		{
+			name: "error",
+			msg:  msg{T: "aa", Y: msgError, E: &Error{Code: ErrCodeGeneric, Msg: "A Generic Error Ocurred"}},
+			wire: "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			b, err := bencode.Marshal(&c.msg)
+			assert.Nil(t, err)
+			assert.Equal(t, c.wire, string(b))
+			m, err := decodeMsg(b)
+			assert.Nil(t, err)
+			assert.Equal(t, &c.msg, m)
+		})
+	}
+}
+
+func TestDecodeMalformedMsg(t *testing.T) {
+	for _, wire := range []string{"", "le", "d1:t2:aa1:y1:e1:eli201eee", "d1:t2:aa1:y1:e1:eli201ei1eee", "d1:ad2:id"} {
+		_, err := decodeMsg([]byte(wire))
+		assert.NotNil(t, err, wire)
+	}
+}
+
+func TestNodesCodec(t *testing.T) {
+	nodes := []Node{
+		{ID: idOf(1), Addr: netip.MustParseAddrPort("1.2.3.4:6881")},
+		{ID: idOf(2), Addr: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+		{ID: idOf(3), Addr: netip.MustParseAddrPort("[::ffff:5.6.7.8]:6883")},
+	}
+	v4, v6 := encodeNodes(nodes)
+	assert.Equal(t, 52, len(v4))
+	assert.Equal(t, 38, len(v6))
+	got, err := decodeNodes(v4, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []Node{nodes[0], {ID: idOf(3), Addr: netip.MustParseAddrPort("5.6.7.8:6883")}}, got)
+	got, err = decodeNodes(v6, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, nodes[1:2], got)
+	_, err = decodeNodes(v4[1:], 4)
+	assert.NotNil(t, err)
+	// nodes w/o valid address are dropped
+	got, err = decodeNodes(make([]byte, 26), 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(got))
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 160, commonPrefixLen(idOf(1), idOf(1)))
+	assert.Equal(t, 0, commonPrefixLen(idOf(0x80), idOf(0)))
+	assert.Equal(t, 7, commonPrefixLen(idOf(1), idOf(0)))
+	var x ID
+	x[19] = 1
+	assert.Equal(t, 159, commonPrefixLen(x, ID{}))
+	assert.True(t, closer(idOf(4), idOf(5), idOf(0)))
+	assert.False(t, closer(idOf(4), idOf(0), idOf(5)))
+	assert.False(t, closer(idOf(4), idOf(5), idOf(5)))
+}
@@ -0,0 +1,153 @@
+package dht
+
+import (
+	"net/netip"
+	"sort"
+	"time"
+)
+
+const (
+	// max # nodes per bucket, also # nodes returned by find_node and get_peers, i.e. k of Kademlia
+	bucketSize = 8
+	// node which hasn't been heard of for this long is questionable
+	questionableAfter = 15 * time.Minute
+	// node failing to respond this many times in a row is bad, and gets replaced by new nodes
+	maxNodeFailures = 2
+)
+
+/*
+Kademlia routing table. Nodes are put into buckets by the # leading bits their ids have in common with ours, so
+that bucket i covers nodes at distance [2^(159-i), 2^(160-i)), which is equivalent to splitting the bucket our
+own id falls in as per BEP 5.
+
+It's not goroutine safe.
+*/
+type table struct {
+	self    ID
+	buckets [160]bucket
+}
+
+type bucket struct {
+	// least recently seen first
+	nodes []*tableNode
+	// time bucket is last touched by a node, see refresh in BEP 5
+	lastChanged time.Time
+}
+
+type tableNode struct {
+	Node
+	lastSeen time.Time
+	// # queries in a row node fails to respond
+	failures int
+}
+
+func newTable(self ID) *table {
+	return &table{self: self}
+}
+
+func (x *table) bucketOf(id ID) *bucket {
+	return &x.buckets[commonPrefixLen(x.self, id)]
+}
+
+/*
+Records node heard of at now, e.g. by responding to our query or querying us. Full bucket only takes node by
+replacing a bad one; questionable node which is least recently seen is returned instead, for caller to ping so
+that it either proves good or fails towards being bad.
+*/
+func (x *table) add(n Node, now time.Time) (ping *Node) {
+	if n.ID == x.self || !n.Addr.IsValid() {
+		return nil
+	}
+	b := x.bucketOf(n.ID)
+	for i, tn := range b.nodes {
+		if tn.ID == n.ID {
+			tn.Addr, tn.lastSeen, tn.failures = n.Addr, now, 0
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), tn)
+			b.lastChanged = now
+			return nil
+		}
+	}
+	tn := &tableNode{Node: n, lastSeen: now}
+	if len(b.nodes) < bucketSize {
+		b.nodes = append(b.nodes, tn)
+		b.lastChanged = now
+		return nil
+	}
+	for i, old := range b.nodes {
+		if old.failures >= maxNodeFailures {
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), tn)
+			b.lastChanged = now
+			return nil
+		}
+	}
+	if lru := b.nodes[0]; now.Sub(lru.lastSeen) >= questionableAfter {
+		res := lru.Node
+		return &res
+	}
+	return nil
+}
+
+// records node at addr fails to respond
+func (x *table) failed(addr netip.AddrPort) {
+	for i := range x.buckets {
+		for _, tn := range x.buckets[i].nodes {
+			if tn.Addr == addr {
+				tn.failures++
+				return
+			}
+		}
+	}
+}
+
+// returns up to k nodes which aren't bad and are closest to target, closest first
+func (x *table) closest(target ID, k int) []Node {
+	var res []Node
+	for i := range x.buckets {
+		for _, tn := range x.buckets[i].nodes {
+			if tn.failures < maxNodeFailures {
+				res = append(res, tn.Node)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return closer(target, res[i].ID, res[j].ID) })
+	if len(res) > k {
+		res = res[:k]
+	}
+	return res
+}
+
+// # nodes in table
+func (x *table) len() int {
+	res := 0
+	for i := range x.buckets {
+		res += len(x.buckets[i].nodes)
+	}
+	return res
+}
+
+// returns random ids in range of buckets which have nodes but aren't touched for d, for caller to look up
+func (x *table) stale(now time.Time, d time.Duration) []ID {
+	var res []ID
+	for i := range x.buckets {
+		b := &x.buckets[i]
+		if len(b.nodes) > 0 && now.Sub(b.lastChanged) >= d {
+			res = append(res, x.randomID(i))
+			// bucket is touched by lookup, or considered refreshed if nothing responds
+			b.lastChanged = now
+		}
+	}
+	return res
+}
+
+// random id falling in bucket i
+func (x *table) randomID(i int) ID {
+	res := NewID()
+	// keep the first i bits of ours, flip the next one
+	for j := 0; j < i/8; j++ {
+		res[j] = x.self[j]
+	}
+	byteIdx, bit := i/8, byte(0x80)>>(i%8)
+	mask := ^(bit<<1 - 1)
+	res[byteIdx] = x.self[byteIdx]&mask | ^x.self[byteIdx]&bit | res[byteIdx]&(bit-1)
+	return res
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// node whose id shares prefixLen leading bits with ID{}, distinguished by i
+func nodeAt(prefixLen int, i int) Node {
+	var id ID
+	id[prefixLen/8] = 0x80 >> (prefixLen % 8)
+	id[19] |= byte(i)
+	return Node{ID: id, Addr: netip.MustParseAddrPort(fmt.Sprintf("10.0.%d.%d:6881", prefixLen, i))}
+}
+
+func TestTableAdd(t *testing.T) {
+	x := newTable(ID{})
+	now := time.Now()
+	assert.Nil(t, x.add(Node{Addr: netip.MustParseAddrPort("10.0.0.1:1")}, now))
+	assert.Equal(t, 0, x.len())
+	for i := 0; i < bucketSize; i++ {
+		assert.Nil(t, x.add(nodeAt(3, i), now.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Equal(t, bucketSize, x.len())
+	// full bucket drops new nodes while its nodes are good
+	assert.Nil(t, x.add(nodeAt(3, 100), now))
+	assert.Equal(t, bucketSize, x.len())
+	// other buckets are unaffected
+	assert.Nil(t, x.add(nodeAt(4, 0), now))
+	assert.Equal(t, bucketSize+1, x.len())
+
+	// least recently seen node which is questionable is to be pinged
+	later := now.Add(questionableAfter)
+	ping := x.add(nodeAt(3, 100), later)
+	assert.Equal(t, nodeAt(3, 0), *ping)
+	// node heard of again moves to the end
+	assert.Nil(t, x.add(nodeAt(3, 0), later))
+	assert.Equal(t, nodeAt(3, 1), *x.add(nodeAt(3, 100), later.Add(time.Second)))
+
+	// bad node is replaced
+	for i := 0; i < maxNodeFailures; i++ {
+		x.failed(nodeAt(3, 5).Addr)
+	}
+	assert.Nil(t, x.add(nodeAt(3, 100), later))
+	assert.Equal(t, bucketSize+1, x.len())
+	for _, n := range x.closest(ID{}, 100) {
+		assert.NotEqual(t, nodeAt(3, 5), n)
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	x := newTable(ID{})
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		x.add(nodeAt(i, 1), now)
+	}
+	// the farther bit a node differs in from target, the closer it is
+	res := x.closest(nodeAt(10, 3).ID, 3)
+	assert.Equal(t, []Node{nodeAt(10, 1), nodeAt(19, 1), nodeAt(18, 1)}, res)
+	x.failed(nodeAt(10, 1).Addr)
+	x.failed(nodeAt(10, 1).Addr)
+	assert.Equal(t, []Node{nodeAt(19, 1), nodeAt(18, 1)}, x.closest(nodeAt(10, 3).ID, 2))
+	assert.Equal(t, 19, len(x.closest(ID{}, 100)))
+}
+
+func TestTableStale(t *testing.T) {
+	self := NewID()
+	x := newTable(self)
+	now := time.Now()
+	for i := 0; i < 160; i++ {
+		id := x.randomID(i)
+		assert.Equal(t, i, commonPrefixLen(self, id), i)
+	}
+	x.add(Node{ID: x.randomID(7), Addr: netip.MustParseAddrPort("10.0.0.1:1")}, now)
+	x.add(Node{ID: x.randomID(9), Addr: netip.MustParseAddrPort("10.0.0.2:1")}, now.Add(time.Minute))
+	assert.Equal(t, 0, len(x.stale(now.Add(refreshInterval-time.Second), refreshInterval)))
+	ids := x.stale(now.Add(refreshInterval), refreshInterval)
+	assert.Equal(t, 1, len(ids))
+	assert.Equal(t, 7, commonPrefixLen(self, ids[0]))
+	// bucket is considered refreshed
+	assert.Equal(t, 0, len(x.stale(now.Add(refreshInterval), refreshInterval)))
+}
@@ -0,0 +1,261 @@
+// Package magnet parses and generates magnet URIs (BEP 9, BEP 53).
+package magnet
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	btmhPrefix = "urn:btmh:"
+	// multihash prefix of sha2-256 digest: function code 0x12 followed by digest length 0x20
+	sha256MultihashPrefix = "1220"
+)
+
+// magnet link content
+type Magnet struct {
+	InfoHash   []byte // v1 sha1 info hash
+	InfoHashV2 []byte // v2 sha256 info hash
+	Name       string
+	Trackers   []string
+	WebSeeds   []string
+	// addresses of peers to connect to, in form of host:port
+	Peers []string
+	// ranges of indices of files to download (BEP 53), sorted and disjoint; nil means all of them
+	SelectOnly []FileRange
+}
+
+// range of file indices, both ends included
+type FileRange struct {
+	First int
+	Last  int
+}
+
+// Parses magnet uri.
+func Parse(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet uri: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("uri scheme is %q instead of magnet", u.Scheme)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet uri query: %w", err)
+	}
+	x := &Magnet{}
+	for key, vals := range q {
+		// exact topics may come numbered, i.e. xt.1, xt.2...
+		if key == "xt" || strings.HasPrefix(key, "xt.") {
+			for _, v := range vals {
+				if err := x.parseExactTopic(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if x.InfoHash == nil && x.InfoHashV2 == nil {
+		return nil, fmt.Errorf("magnet uri has no btih or btmh exact topic")
+	}
+	if dn := q.Get("dn"); dn != "" {
+		x.Name = dn
+	}
+	x.Trackers = q["tr"]
+	x.WebSeeds = q["ws"]
+	for _, pe := range q["x.pe"] {
+		if _, _, err := net.SplitHostPort(pe); err != nil {
+			return nil, fmt.Errorf("malformed peer address %q in magnet uri: %w", pe, err)
+		}
+		x.Peers = append(x.Peers, pe)
+	}
+	if so := q.Get("so"); so != "" {
+		if x.SelectOnly, err = parseSelectOnly(so); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+func (x *Magnet) parseExactTopic(xt string) error {
+	switch {
+	case strings.HasPrefix(xt, btihPrefix):
+		h, err := decodeBtih(xt[len(btihPrefix):])
+		if err != nil {
+			return err
+		}
+		x.InfoHash = h
+	case strings.HasPrefix(xt, btmhPrefix):
+		mh := xt[len(btmhPrefix):]
+		if !strings.HasPrefix(mh, sha256MultihashPrefix) {
+			return fmt.Errorf("unsupported btmh multihash %q: only sha2-256 is supported", mh)
+		}
+		h, err := hex.DecodeString(mh[len(sha256MultihashPrefix):])
+		if err != nil || len(h) != 32 {
+			return fmt.Errorf("malformed btmh info hash %q", mh)
+		}
+		x.InfoHashV2 = h
+	}
+	// other exact topics are of no interest
+	return nil
+}
+
+// decodes v1 info hash in either 40-char hex or 32-char base32 form
+func decodeBtih(s string) ([]byte, error) {
+	switch len(s) {
+	case 40:
+		h, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("malformed hex btih info hash %q: %w", s, err)
+		}
+		return h, nil
+	case 32:
+		h, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return nil, fmt.Errorf("malformed base32 btih info hash %q: %w", s, err)
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("btih info hash %q is neither 40-char hex nor 32-char base32", s)
+	}
+}
+
+/*
+Parses select-only list like 0,2,4-6 into sorted disjoint ranges. Ranges are kept as such rather than expanded,
+so that a huge range in an untrusted uri costs no memory.
+*/
+func parseSelectOnly(so string) ([]FileRange, error) {
+	var ranges []FileRange
+	for _, item := range strings.Split(so, ",") {
+		lo, hi := item, item
+		if i := strings.IndexByte(item, '-'); i >= 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		from, err := strconv.Atoi(lo)
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("malformed select-only item %q in magnet uri", item)
+		}
+		to, err := strconv.Atoi(hi)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("malformed select-only item %q in magnet uri", item)
+		}
+		ranges = append(ranges, FileRange{First: from, Last: to})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].First < ranges[j].First })
+	// merge overlapping and adjacent ranges
+	res := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &res[len(res)-1]
+		if r.First <= last.Last || r.First-1 == last.Last {
+			if r.Last > last.Last {
+				last.Last = r.Last
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// Selected returns whether file with index i is to be downloaded as per SelectOnly.
+func (x *Magnet) Selected(i int) bool {
+	if x.SelectOnly == nil {
+		return true
+	}
+	j := sort.Search(len(x.SelectOnly), func(j int) bool { return x.SelectOnly[j].Last >= i })
+	return j < len(x.SelectOnly) && x.SelectOnly[j].First <= i
+}
+
+/*
+Returns a partial torrent out of magnet link.
+
+Its info dictionary is pending: apart from name and info hashes, content of it shall be fetched from peers.
+Name is escaped the same way as that of torrent files, as it's used as file or directory name; it's left empty
+if it isn't valid UTF-8.
+*/
+func (x *Magnet) Torrent() *bcodec.Torrent {
+	info := &bcodec.TorrentInfo{
+		Hash:        x.InfoHash,
+		HashV2:      x.InfoHashV2,
+		MetaVersion: 1,
+	}
+	if x.Name != "" {
+		info.Name, _ = bcodec.SanitizePath([]string{x.Name}, bcodec.PathPolicyEscape)
+	}
+	if x.InfoHashV2 != nil {
+		info.MetaVersion = 2
+	}
+	if x.InfoHash == nil {
+		// v2-only torrent goes by truncated v2 info hash
+		info.Hash = x.InfoHashV2[:20]
+	}
+	return &bcodec.Torrent{
+		Info:     info,
+		Trackers: x.Trackers,
+		WebSeeds: x.WebSeeds,
+	}
+}
+
+// Creates magnet link content out of torrent.
+func FromTorrent(tr *bcodec.Torrent) *Magnet {
+	x := &Magnet{
+		Trackers: tr.Trackers,
+		WebSeeds: tr.WebSeeds,
+	}
+	if tr.Info != nil {
+		x.Name = tr.Info.Name
+		// info hash of v2-only torrent is merely truncated v2 info hash
+		v2Only := len(tr.Info.HashV2) >= 20 && bytes.Equal(tr.Info.Hash, tr.Info.HashV2[:20])
+		if tr.Info.Hash != nil && !v2Only {
+			x.InfoHash = tr.Info.Hash
+		}
+		x.InfoHashV2 = tr.Info.HashV2
+	}
+	return x
+}
+
+// Generates magnet uri.
+func (x *Magnet) String() string {
+	var params []string
+	if x.InfoHash != nil {
+		params = append(params, "xt="+btihPrefix+hex.EncodeToString(x.InfoHash))
+	}
+	if x.InfoHashV2 != nil {
+		params = append(params, "xt="+btmhPrefix+sha256MultihashPrefix+hex.EncodeToString(x.InfoHashV2))
+	}
+	if x.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(x.Name))
+	}
+	for _, tr := range x.Trackers {
+		if tr != "" {
+			params = append(params, "tr="+url.QueryEscape(tr))
+		}
+	}
+	for _, ws := range x.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(ws))
+	}
+	for _, pe := range x.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(pe))
+	}
+	if len(x.SelectOnly) > 0 {
+		items := make([]string, len(x.SelectOnly))
+		for i, r := range x.SelectOnly {
+			items[i] = strconv.Itoa(r.First)
+			if r.Last != r.First {
+				items[i] += "-" + strconv.Itoa(r.Last)
+			}
+		}
+		params = append(params, "so="+strings.Join(items, ","))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
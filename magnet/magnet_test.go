@@ -0,0 +1,179 @@
+package magnet
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+func TestParse(t *testing.T) {
+	hash := []byte("\x7a\xe2\x52\xce\x0d\x5b\x2a\x2f\x7f\x01\x38\x76\x3b\x0e\xfe\x40\xd6\x6d\xb2\xe0")
+	type C struct {
+		name   string
+		uri    string
+		verify func(t *testing.T, x *Magnet, err error)
+	}
+	tcs := []*C{
+		{
+			name: "hex btih",
+			uri:  "magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0&dn=foo%20bar&tr=http%3A%2F%2Ftracker.net%2Fannounce&tr=udp%3A%2F%2Ftracker1.net%3A6881",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.Nil(t, err)
+				assert.Equal(t, hash, x.InfoHash)
+				assert.Nil(t, x.InfoHashV2)
+				assert.Equal(t, "foo bar", x.Name)
+				assert.Equal(t, []string{"http://tracker.net/announce", "udp://tracker1.net:6881"}, x.Trackers)
+			},
+		},
+		{
+			name: "base32 btih",
+			uri:  "magnet:?xt=urn:btih:PLRFFTQNLMVC67YBHB3DWDX6IDLG3MXA",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.Nil(t, err)
+				assert.Equal(t, hash, x.InfoHash)
+			},
+		},
+		{
+			name: "hybrid w/ web seeds, peers and select-only",
+			uri: "magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0" +
+				"&xt=urn:btmh:1220" + "abababababababababababababababababababababababababababababababab" +
+				"&ws=http%3A%2F%2Fseed.net%2Ffiles%2F&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6881&so=0,2,4-6",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.Nil(t, err)
+				assert.Equal(t, hash, x.InfoHash)
+				assert.Equal(t, bytes.Repeat([]byte{0xab}, 32), x.InfoHashV2)
+				assert.Equal(t, []string{"http://seed.net/files/"}, x.WebSeeds)
+				assert.Equal(t, []string{"10.0.0.1:6881", "[2001:db8::1]:6881"}, x.Peers)
+				assert.Equal(t, []FileRange{{0, 0}, {2, 2}, {4, 6}}, x.SelectOnly)
+			},
+		},
+		{
+			name: "missing info hash",
+			uri:  "magnet:?dn=foo",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "no btih or btmh exact topic")
+			},
+		},
+		{
+			name: "malformed btih",
+			uri:  "magnet:?xt=urn:btih:7ae252ce",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.NotNil(t, err)
+			},
+		},
+		{
+			name: "unsupported multihash",
+			uri:  "magnet:?xt=urn:btmh:1114abab",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.NotNil(t, err)
+				assert.Contains(t, err.Error(), "only sha2-256 is supported")
+			},
+		},
+		{
+			name: "not a magnet uri",
+			uri:  "http://tracker.net/announce",
+			verify: func(t *testing.T, x *Magnet, err error) {
+				assert.NotNil(t, err)
+			},
+		},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			x, err := Parse(c.uri)
+			c.verify(t, x, err)
+		})
+	}
+}
+
+func TestFromTorrent(t *testing.T) {
+	tr := &bcodec.Torrent{
+		Trackers: []string{"http://tracker.net/announce"},
+		Info: &bcodec.TorrentInfo{
+			Name:   "foo bar",
+			Hash:   []byte("\x7a\xe2\x52\xce\x0d\x5b\x2a\x2f\x7f\x01\x38\x76\x3b\x0e\xfe\x40\xd6\x6d\xb2\xe0"),
+			Pieces: []byte{},
+		},
+	}
+	uri := FromTorrent(tr).String()
+	assert.Equal(t, "magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0&dn=foo+bar&tr=http%3A%2F%2Ftracker.net%2Fannounce", uri)
+	x, err := Parse(uri)
+	assert.Nil(t, err)
+	partial := x.Torrent()
+	assert.Equal(t, tr.Info.Hash, partial.Info.Hash)
+	assert.Equal(t, "foo bar", partial.Info.Name)
+	assert.Equal(t, int64(1), partial.Info.MetaVersion)
+	assert.Equal(t, tr.Trackers, partial.Trackers)
+}
+
+func TestFromTorrentRoundTrip(t *testing.T) {
+	v1, v2 := strings.Repeat("cd", 20), strings.Repeat("ab", 32)
+	cases := []struct {
+		name string
+		uri  string
+	}{
+		{"v1", "magnet:?xt=urn:btih:" + v1 + "&dn=foo"},
+		{"v2", "magnet:?xt=urn:btmh:1220" + v2 + "&dn=foo"},
+		{"hybrid", "magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2 + "&dn=foo"},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			x, err := Parse(c.uri)
+			assert.Nil(t, err)
+			assert.Equal(t, c.uri, FromTorrent(x.Torrent()).String())
+		})
+	}
+}
+
+func TestSelectOnly(t *testing.T) {
+	tcs := []struct {
+		so     string
+		ranges []FileRange
+		str    string
+	}{
+		{so: "3,1", ranges: []FileRange{{1, 1}, {3, 3}}, str: "1,3"},
+		{so: "4-6,0-2,3,5-9", ranges: []FileRange{{0, 9}}, str: "0-9"},
+		// huge range costs nothing
+		{so: "0-1000000000,7", ranges: []FileRange{{0, 1000000000}}, str: "0-1000000000"},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.so, func(t *testing.T) {
+			t.Parallel()
+			x, err := Parse("magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0&so=" + c.so)
+			assert.Nil(t, err)
+			assert.Equal(t, c.ranges, x.SelectOnly)
+			assert.Equal(t, "magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0&so="+c.str, x.String())
+		})
+	}
+	x, err := Parse("magnet:?xt=urn:btih:7ae252ce0d5b2a2f7f0138763b0efe40d66db2e0&so=1,4-6")
+	assert.Nil(t, err)
+	for i, want := range []bool{false, true, false, false, true, true, true, false} {
+		assert.Equal(t, want, x.Selected(i), i)
+	}
+	assert.True(t, (&Magnet{}).Selected(100))
+	for _, so := range []string{"-1", "3-1", "a", "1-", ""} {
+		_, err := parseSelectOnly(so)
+		assert.NotNil(t, err, so)
+	}
+}
+
+func TestTorrentName(t *testing.T) {
+	x, err := Parse("magnet:?xt=urn:btmh:1220" + strings.Repeat("ab", 32) + "&dn=..%2F..%2Fetc")
+	assert.Nil(t, err)
+	assert.Equal(t, "../../etc", x.Name)
+	info := x.Torrent().Info
+	assert.Equal(t, ".._.._etc", info.Name)
+	assert.Equal(t, int64(2), info.MetaVersion)
+	assert.Equal(t, bytes.Repeat([]byte{0xab}, 20), info.Hash)
+	x.Name = "\xff"
+	assert.Equal(t, "", x.Torrent().Info.Name)
+}
@@ -0,0 +1,54 @@
+// gtr is a minimal bittorrent application.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `Usage:
+  gtr create [options] <path>    create a .torrent file out of a file or directory
+  gtr tracker [options]          run a bittorrent tracker serving HTTP and UDP clients
+  gtr verify <file.torrent> <dir>
+                                 verify content of a torrent saved under a directory
+
+Run "gtr <command> --help" to get help on a specific command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "create":
+		err = runCreate(args)
+	case "tracker":
+		err = runTracker(args)
+	case "verify":
+		err = runVerify(args)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gtr %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// flag value which can be specified multiple times
+type stringsFlag []string
+
+func (x *stringsFlag) String() string {
+	return strings.Join(*x, ",")
+}
+
+func (x *stringsFlag) Set(s string) error {
+	*x = append(*x, s)
+	return nil
+}
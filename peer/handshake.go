@@ -0,0 +1,163 @@
+// Package peer implements bittorrent peer wire protocol.
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// protocol string of handshake as per BEP 3
+const Protocol = "BitTorrent protocol"
+
+// length of handshake in bytes
+const HandshakeLen = 1 + len(Protocol) + 8 + 20 + 20
+
+var (
+	// remote doesn't speak bittorrent protocol
+	ErrBadProtocol = errors.New("bad protocol string in handshake")
+	// remote serves torrent other than the one we asked for
+	ErrInfoHashMismatch = errors.New("info hash mismatch in handshake")
+	// remote's peer id differs from the one tracker told us
+	ErrPeerIDMismatch = errors.New("peer id mismatch in handshake")
+	// we connected to ourselves
+	ErrSelfConnection = errors.New("connected to self")
+)
+
+// reserved bytes of handshake advertising protocol extensions
+type Reserved [8]byte
+
+// bit positions of protocol extensions in reserved bytes, counting from the least significant bit of the last byte
+const (
+	// BEP 5 DHT port message
+	ExtDHT = 0
+	// BEP 6 fast extension
+	ExtFast = 2
+	// BEP 10 extension protocol
+	ExtProtocol = 20
+)
+
+func (x *Reserved) Set(ext int) {
+	x[7-ext/8] |= 1 << (ext % 8)
+}
+
+func (x Reserved) Has(ext int) bool {
+	return x[7-ext/8]&(1<<(ext%8)) != 0
+}
+
+type Handshake struct {
+	Reserved Reserved
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// NewHandshake creates our handshake for torrent with infoHash, e.g. Job.Torrent.Info.Hash.
+func NewHandshake(infoHash []byte, peerID []byte, reserved Reserved) (*Handshake, error) {
+	if len(infoHash) != 20 || len(peerID) != 20 {
+		return nil, fmt.Errorf("info hash and peer id must be 20 bytes long")
+	}
+	x := &Handshake{Reserved: reserved}
+	copy(x.InfoHash[:], infoHash)
+	copy(x.PeerID[:], peerID)
+	return x, nil
+}
+
+func (x *Handshake) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, HandshakeLen)
+	b = append(b, byte(len(Protocol)))
+	b = append(b, Protocol...)
+	b = append(b, x.Reserved[:]...)
+	b = append(b, x.InfoHash[:]...)
+	return append(b, x.PeerID[:]...), nil
+}
+
+func (x *Handshake) UnmarshalBinary(b []byte) error {
+	if len(b) != HandshakeLen {
+		return fmt.Errorf("handshake must be %d bytes long, got %d", HandshakeLen, len(b))
+	}
+	if int(b[0]) != len(Protocol) || string(b[1:1+len(Protocol)]) != Protocol {
+		return ErrBadProtocol
+	}
+	b = b[1+len(Protocol):]
+	copy(x.Reserved[:], b[:8])
+	copy(x.InfoHash[:], b[8:28])
+	copy(x.PeerID[:], b[28:48])
+	return nil
+}
+
+// ReadHandshake reads handshake from r.
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	b := make([]byte, HandshakeLen)
+	// fail fast on protocol string before waiting for the rest
+	if _, err := io.ReadFull(r, b[:1+len(Protocol)]); err != nil {
+		return nil, fmt.Errorf("error reading handshake: %w", err)
+	}
+	if int(b[0]) != len(Protocol) || string(b[1:1+len(Protocol)]) != Protocol {
+		return nil, ErrBadProtocol
+	}
+	if _, err := io.ReadFull(r, b[1+len(Protocol):]); err != nil {
+		return nil, fmt.Errorf("error reading handshake: %w", err)
+	}
+	x := &Handshake{}
+	if err := x.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+/*
+Exchange sends our handshake over rw and reads that of the remote, verifying it's about the same torrent.
+
+wantPeerID is the peer id of remote known in advance e.g. from tracker, which remote must present if set.
+Connections to ourselves are rejected with ErrSelfConnection.
+*/
+func Exchange(rw io.ReadWriter, ours *Handshake, wantPeerID []byte) (*Handshake, error) {
+	b, _ := ours.MarshalBinary()
+	if _, err := rw.Write(b); err != nil {
+		return nil, fmt.Errorf("error sending handshake: %w", err)
+	}
+	theirs, err := ReadHandshake(rw)
+	if err != nil {
+		return nil, err
+	}
+	if err := ours.verify(theirs, wantPeerID); err != nil {
+		return nil, err
+	}
+	return theirs, nil
+}
+
+/*
+Accept reads handshake of the remote which connected to us, and answers with ours if remote asks for a torrent
+we serve. lookup returns our handshake for the info hash, or nil if we don't serve the torrent.
+*/
+func Accept(rw io.ReadWriter, lookup func(infoHash [20]byte) *Handshake) (ours *Handshake, theirs *Handshake, err error) {
+	theirs, err = ReadHandshake(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ours = lookup(theirs.InfoHash); ours == nil {
+		return nil, nil, ErrInfoHashMismatch
+	}
+	if err := ours.verify(theirs, nil); err != nil {
+		return nil, nil, err
+	}
+	b, _ := ours.MarshalBinary()
+	if _, err := rw.Write(b); err != nil {
+		return nil, nil, fmt.Errorf("error sending handshake: %w", err)
+	}
+	return ours, theirs, nil
+}
+
+func (x *Handshake) verify(theirs *Handshake, wantPeerID []byte) error {
+	if theirs.InfoHash != x.InfoHash {
+		return ErrInfoHashMismatch
+	}
+	if theirs.PeerID == x.PeerID {
+		return ErrSelfConnection
+	}
+	if wantPeerID != nil && !bytes.Equal(theirs.PeerID[:], wantPeerID) {
+		return ErrPeerIDMismatch
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package peer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserved(t *testing.T) {
+	var r Reserved
+	r.Set(ExtDHT)
+	r.Set(ExtFast)
+	r.Set(ExtProtocol)
+	assert.Equal(t, Reserved{0, 0, 0, 0, 0, 0x10, 0, 0x05}, r)
+	assert.True(t, r.Has(ExtProtocol))
+	assert.False(t, Reserved{}.Has(ExtDHT))
+}
+
+func TestHandshakeBinary(t *testing.T) {
+	h, err := NewHandshake(bytes.Repeat([]byte{1}, 20), []byte("-GT0001-0123456789ab"), Reserved{0, 0, 0, 0, 0, 0x10, 0, 0})
+	assert.Nil(t, err)
+	b, err := h.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, "\x13BitTorrent protocol\x00\x00\x00\x00\x00\x10\x00\x00"+string(bytes.Repeat([]byte{1}, 20))+"-GT0001-0123456789ab", string(b))
+	decoded, err := ReadHandshake(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.Equal(t, h, decoded)
+
+	_, err = ReadHandshake(bytes.NewReader([]byte("\x13BitTorrent protocoX")))
+	assert.ErrorIs(t, err, ErrBadProtocol)
+	_, err = NewHandshake(make([]byte, 32), make([]byte, 20), Reserved{})
+	assert.NotNil(t, err)
+}
+
+func TestExchange(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	ours, _ := NewHandshake(infoHash, []byte("-GT0001-aaaaaaaaaaaa"), Reserved{})
+	theirs, _ := NewHandshake(infoHash, []byte("-GT0001-bbbbbbbbbbbb"), Reserved{})
+	tcs := []struct {
+		name       string
+		served     *Handshake
+		wantPeerID []byte
+		err        error
+	}{
+		{name: "ok", served: theirs},
+		{name: "peer id known in advance", served: theirs, wantPeerID: []byte("-GT0001-bbbbbbbbbbbb")},
+		{name: "peer id mismatch", served: theirs, wantPeerID: []byte("-GT0001-cccccccccccc"), err: ErrPeerIDMismatch},
+		{name: "torrent not served"},
+		{name: "self connection", served: ours, err: ErrSelfConnection},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			local, remote := net.Pipe()
+			defer local.Close()
+			go func() {
+				defer remote.Close()
+				if _, err := ReadHandshake(remote); err != nil || c.served == nil {
+					return
+				}
+				b, _ := c.served.MarshalBinary()
+				remote.Write(b)
+			}()
+			h, err := Exchange(local, ours, c.wantPeerID)
+			if c.served == nil {
+				// remote hangs up
+				assert.NotNil(t, err)
+				return
+			}
+			if c.err != nil {
+				assert.ErrorIs(t, err, c.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, theirs, h)
+		})
+	}
+}
+
+func TestAccept(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	ours, _ := NewHandshake(infoHash, []byte("-GT0001-aaaaaaaaaaaa"), Reserved{})
+	theirs, _ := NewHandshake(infoHash, []byte("-GT0001-bbbbbbbbbbbb"), Reserved{})
+	lookup := func(h [20]byte) *Handshake {
+		if h == ours.InfoHash {
+			return ours
+		}
+		return nil
+	}
+	local, remote := net.Pipe()
+	go Exchange(remote, theirs, nil)
+	h, remoteH, err := Accept(local, lookup)
+	assert.Nil(t, err)
+	assert.Equal(t, ours, h)
+	assert.Equal(t, theirs, remoteH)
+	local.Close()
+
+	other, _ := NewHandshake(bytes.Repeat([]byte{2}, 20), []byte("-GT0001-bbbbbbbbbbbb"), Reserved{})
+	local, remote = net.Pipe()
+	defer local.Close()
+	go func() {
+		b, _ := other.MarshalBinary()
+		remote.Write(b)
+	}()
+	_, _, err = Accept(local, lookup)
+	assert.ErrorIs(t, err, ErrInfoHashMismatch)
+}
@@ -0,0 +1,255 @@
+package peer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// message id of peer wire protocol
+type MsgType int
+
+const (
+	// keep-alive has no id on the wire
+	MsgKeepAlive     MsgType = -1
+	MsgChoke         MsgType = 0
+	MsgUnchoke       MsgType = 1
+	MsgInterested    MsgType = 2
+	MsgNotInterested MsgType = 3
+	MsgHave          MsgType = 4
+	MsgBitfield      MsgType = 5
+	MsgRequest       MsgType = 6
+	MsgPiece         MsgType = 7
+	MsgCancel        MsgType = 8
+	MsgPort          MsgType = 9
+	// BEP 6 fast extension
+	MsgSuggestPiece  MsgType = 13
+	MsgHaveAll       MsgType = 14
+	MsgHaveNone      MsgType = 15
+	MsgRejectRequest MsgType = 16
+	MsgAllowedFast   MsgType = 17
+)
+
+const (
+	// largest block size peers request by convention
+	MaxBlockLen = 16 << 10
+	// default cap of message length, which fits bitfield of torrents with up to 1M pieces, i.e. a byte of
+	// message type followed by 128KiB of bitfield, as well as piece message carrying MaxBlockLen bytes of block
+	DefaultMaxMsgLen = 1 + (1<<20)/8
+)
+
+var (
+	// message is longer than what we accept
+	ErrMsgTooLong = errors.New("peer message too long")
+	// message length doesn't match its type
+	ErrMalformedMsg = errors.New("malformed peer message")
+)
+
+var msgNames = map[MsgType]string{
+	MsgKeepAlive:     "keep-alive",
+	MsgChoke:         "choke",
+	MsgUnchoke:       "unchoke",
+	MsgInterested:    "interested",
+	MsgNotInterested: "not interested",
+	MsgHave:          "have",
+	MsgBitfield:      "bitfield",
+	MsgRequest:       "request",
+	MsgPiece:         "piece",
+	MsgCancel:        "cancel",
+	MsgPort:          "port",
+	MsgSuggestPiece:  "suggest piece",
+	MsgHaveAll:       "have all",
+	MsgHaveNone:      "have none",
+	MsgRejectRequest: "reject request",
+	MsgAllowedFast:   "allowed fast",
+}
+
+func (x MsgType) String() string {
+	if s, ok := msgNames[x]; ok {
+		return s
+	}
+	return fmt.Sprintf("message %d", int(x))
+}
+
+/*
+Message of peer wire protocol. Fields irrelevant to Type are left zero.
+
+Messages of types unknown to this package, e.g. those of protocol extensions, have their payload in Payload.
+*/
+type Message struct {
+	Type MsgType
+	// piece index of have, request, piece, cancel and fast extension messages
+	Index uint32
+	// byte offset within piece of request, piece, cancel and reject request
+	Begin uint32
+	// block length of request, cancel and reject request
+	Length uint32
+	// payload of bitfield
+	Bitfield []byte
+	// block of piece
+	Block []byte
+	// DHT port of port
+	Port uint16
+	// raw payload of unknown message types
+	Payload []byte
+}
+
+// payload length of fixed-length messages
+var fixedPayloadLens = map[MsgType]int{
+	MsgChoke:         0,
+	MsgUnchoke:       0,
+	MsgInterested:    0,
+	MsgNotInterested: 0,
+	MsgHave:          4,
+	MsgRequest:       12,
+	MsgCancel:        12,
+	MsgPort:          2,
+	MsgSuggestPiece:  4,
+	MsgHaveAll:       0,
+	MsgHaveNone:      0,
+	MsgRejectRequest: 12,
+	MsgAllowedFast:   4,
+}
+
+/*
+Decoder reads length-prefixed messages off a stream.
+
+Slices of messages decoded, i.e. Bitfield, Block and Payload, share the decoder's buffer and are only valid till
+the next call of Decode, so that decoding doesn't allocate in steady state.
+*/
+type Decoder struct {
+	r *bufio.Reader
+	// messages longer than this are rejected with ErrMsgTooLong
+	MaxMsgLen int
+	buf       []byte
+	prefix    [4]byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), MaxMsgLen: DefaultMaxMsgLen}
+}
+
+// Decode reads the next message into msg.
+func (d *Decoder) Decode(msg *Message) error {
+	if _, err := io.ReadFull(d.r, d.prefix[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(d.prefix[:])
+	if n == 0 {
+		*msg = Message{Type: MsgKeepAlive}
+		return nil
+	}
+	if int64(n) > int64(d.MaxMsgLen) {
+		return fmt.Errorf("%w: %d bytes", ErrMsgTooLong, n)
+	}
+	if cap(d.buf) < int(n) {
+		d.buf = make([]byte, n)
+	}
+	b := d.buf[:n]
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return unexpectedEOF(err)
+	}
+	*msg = Message{Type: MsgType(b[0])}
+	payload := b[1:]
+	if want, ok := fixedPayloadLens[msg.Type]; ok && len(payload) != want {
+		return fmt.Errorf("%w: %s with %d bytes of payload", ErrMalformedMsg, msg.Type, len(payload))
+	}
+	switch msg.Type {
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
+		msg.Index = binary.BigEndian.Uint32(payload)
+	case MsgBitfield:
+		msg.Bitfield = payload
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		msg.Index = binary.BigEndian.Uint32(payload)
+		msg.Begin = binary.BigEndian.Uint32(payload[4:])
+		msg.Length = binary.BigEndian.Uint32(payload[8:])
+	case MsgPiece:
+		if len(payload) < 8 {
+			return fmt.Errorf("%w: piece with %d bytes of payload", ErrMalformedMsg, len(payload))
+		}
+		msg.Index = binary.BigEndian.Uint32(payload)
+		msg.Begin = binary.BigEndian.Uint32(payload[4:])
+		msg.Block = payload[8:]
+	case MsgPort:
+		msg.Port = binary.BigEndian.Uint16(payload)
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+	default:
+		msg.Payload = payload
+	}
+	return nil
+}
+
+// message cut short by EOF is unexpected
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+/*
+Encoder writes length-prefixed messages to a stream.
+
+Messages are buffered; call Flush to send them out.
+*/
+type Encoder struct {
+	w *bufio.Writer
+	// buffer of message header, i.e. everything but variable-length payload
+	hdr [17]byte
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriterSize(w, 2*MaxBlockLen)}
+}
+
+// Encode buffers msg for sending.
+func (e *Encoder) Encode(msg *Message) error {
+	b := e.hdr[:4]
+	switch msg.Type {
+	case MsgKeepAlive:
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested, MsgHaveAll, MsgHaveNone:
+		b = append(b, byte(msg.Type))
+	case MsgHave, MsgSuggestPiece, MsgAllowedFast:
+		b = appendUint32(append(b, byte(msg.Type)), msg.Index)
+	case MsgRequest, MsgCancel, MsgRejectRequest:
+		b = appendUint32(appendUint32(appendUint32(append(b, byte(msg.Type)), msg.Index), msg.Begin), msg.Length)
+	case MsgPort:
+		b = append(b, byte(msg.Type), byte(msg.Port>>8), byte(msg.Port))
+	case MsgPiece:
+		b = appendUint32(appendUint32(append(b, byte(msg.Type)), msg.Index), msg.Begin)
+		return e.write(b, msg.Block)
+	case MsgBitfield:
+		return e.write(append(b, byte(msg.Type)), msg.Bitfield)
+	default:
+		if msg.Type < 0 || msg.Type > 0xff {
+			return fmt.Errorf("invalid message type %d", int(msg.Type))
+		}
+		return e.write(append(b, byte(msg.Type)), msg.Payload)
+	}
+	return e.write(b, nil)
+}
+
+// writes header b, whose first 4 bytes are reserved for length prefix, followed by payload
+func (e *Encoder) write(b []byte, payload []byte) error {
+	n := uint64(len(b)) - 4 + uint64(len(payload))
+	if n > 0xffffffff {
+		return ErrMsgTooLong
+	}
+	binary.BigEndian.PutUint32(b, uint32(n))
+	if _, err := e.w.Write(b); err != nil {
+		return err
+	}
+	_, err := e.w.Write(payload)
+	return err
+}
+
+// Flush sends out messages buffered.
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
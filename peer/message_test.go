@@ -0,0 +1,107 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageCodec(t *testing.T) {
+	tcs := []struct {
+		msg  Message
+		wire string
+	}{
+		{msg: Message{Type: MsgKeepAlive}, wire: "\x00\x00\x00\x00"},
+		{msg: Message{Type: MsgChoke}, wire: "\x00\x00\x00\x01\x00"},
+		{msg: Message{Type: MsgUnchoke}, wire: "\x00\x00\x00\x01\x01"},
+		{msg: Message{Type: MsgInterested}, wire: "\x00\x00\x00\x01\x02"},
+		{msg: Message{Type: MsgNotInterested}, wire: "\x00\x00\x00\x01\x03"},
+		{msg: Message{Type: MsgHave, Index: 258}, wire: "\x00\x00\x00\x05\x04\x00\x00\x01\x02"},
+		{msg: Message{Type: MsgBitfield, Bitfield: []byte{0xff, 0x80}}, wire: "\x00\x00\x00\x03\x05\xff\x80"},
+		{msg: Message{Type: MsgRequest, Index: 1, Begin: 16384, Length: 16384}, wire: "\x00\x00\x00\x0d\x06\x00\x00\x00\x01\x00\x00\x40\x00\x00\x00\x40\x00"},
+		{msg: Message{Type: MsgPiece, Index: 1, Begin: 2, Block: []byte("abc")}, wire: "\x00\x00\x00\x0c\x07\x00\x00\x00\x01\x00\x00\x00\x02abc"},
+		{msg: Message{Type: MsgCancel, Index: 1, Begin: 16384, Length: 16384}, wire: "\x00\x00\x00\x0d\x08\x00\x00\x00\x01\x00\x00\x40\x00\x00\x00\x40\x00"},
+		{msg: Message{Type: MsgPort, Port: 6881}, wire: "\x00\x00\x00\x03\x09\x1a\xe1"},
+		{msg: Message{Type: MsgSuggestPiece, Index: 3}, wire: "\x00\x00\x00\x05\x0d\x00\x00\x00\x03"},
+		{msg: Message{Type: MsgHaveAll}, wire: "\x00\x00\x00\x01\x0e"},
+		{msg: Message{Type: MsgHaveNone}, wire: "\x00\x00\x00\x01\x0f"},
+		{msg: Message{Type: MsgRejectRequest, Index: 1, Begin: 16384, Length: 16384}, wire: "\x00\x00\x00\x0d\x10\x00\x00\x00\x01\x00\x00\x40\x00\x00\x00\x40\x00"},
+		{msg: Message{Type: MsgAllowedFast, Index: 3}, wire: "\x00\x00\x00\x05\x11\x00\x00\x00\x03"},
+		{msg: Message{Type: 20, Payload: []byte("\x00d1:md11:ut_metadatai1eee")}, wire: "\x00\x00\x00\x1a\x14\x00d1:md11:ut_metadatai1eee"},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.msg.Type.String(), func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			e := NewEncoder(&buf)
+			assert.Nil(t, e.Encode(&c.msg))
+			assert.Nil(t, e.Flush())
+			assert.Equal(t, c.wire, buf.String())
+			var msg Message
+			assert.Nil(t, NewDecoder(&buf).Decode(&msg))
+			assert.Equal(t, c.msg, msg)
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tcs := []struct {
+		name string
+		wire string
+		err  error
+	}{
+		{name: "too long", wire: "\x00\x10\x00\x00\x07", err: ErrMsgTooLong},
+		{name: "have w/ short payload", wire: "\x00\x00\x00\x02\x04\x00", err: ErrMalformedMsg},
+		{name: "choke w/ payload", wire: "\x00\x00\x00\x02\x00\x00", err: ErrMalformedMsg},
+		{name: "piece w/o begin", wire: "\x00\x00\x00\x05\x07\x00\x00\x00\x01", err: ErrMalformedMsg},
+		{name: "truncated", wire: "\x00\x00\x00\x05\x04\x00", err: io.ErrUnexpectedEOF},
+		{name: "eof", wire: "", err: io.EOF},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			var msg Message
+			assert.ErrorIs(t, NewDecoder(bytes.NewReader([]byte(c.wire))).Decode(&msg), c.err)
+		})
+	}
+}
+
+func TestDecodeMaxMsgLen(t *testing.T) {
+	// bitfield of 1M pieces is the longest message accepted by default
+	bitfield := bytes.Repeat([]byte{0xff}, (1<<20)/8)
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	assert.Nil(t, e.Encode(&Message{Type: MsgBitfield, Bitfield: bitfield}))
+	assert.Nil(t, e.Encode(&Message{Type: MsgBitfield, Bitfield: append(bitfield, 0xff)}))
+	assert.Nil(t, e.Flush())
+	d := NewDecoder(&buf)
+	var msg Message
+	assert.Nil(t, d.Decode(&msg))
+	assert.Equal(t, bitfield, msg.Bitfield)
+	assert.ErrorIs(t, d.Decode(&msg), ErrMsgTooLong)
+}
+
+func TestCodecAllocs(t *testing.T) {
+	block := make([]byte, MaxBlockLen)
+	e := NewEncoder(io.Discard)
+	var wire bytes.Buffer
+	we := NewEncoder(&wire)
+	for i := 0; i < 100; i++ {
+		we.Encode(&Message{Type: MsgPiece, Index: uint32(i), Block: block})
+	}
+	we.Flush()
+	d := NewDecoder(bytes.NewReader(wire.Bytes()))
+	var msg Message
+	// warm up decoder buffer
+	assert.Nil(t, d.Decode(&msg))
+	allocs := testing.AllocsPerRun(50, func() {
+		e.Encode(&Message{Type: MsgPiece, Index: 1, Block: block})
+		e.Encode(&Message{Type: MsgRequest, Index: 1, Length: MaxBlockLen})
+		d.Decode(&msg)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
@@ -0,0 +1,453 @@
+// Package picker decides which blocks of torrent content to request from peers.
+package picker
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+	"wuyrush.io/gtr/peer"
+)
+
+type Mode int
+
+const (
+	// rarest pieces first, except that the first few pieces are picked at random so that we soon have
+	// something to trade with
+	ModeRarestFirst Mode = iota
+	// pieces in index order, e.g. for streaming
+	ModeSequential
+	// pieces of higher priority first, rarest first among those of the same priority
+	ModePriority
+)
+
+// Priority of piece. Pieces of PrioritySkip are never picked; other priorities only matter in ModePriority.
+type Priority int8
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 4
+	PriorityHigh   Priority = 7
+)
+
+const (
+	// # pieces picked at random before rarest-first kicks in
+	randomPieceCnt = 4
+	// length of blocks requested, the largest peers are obliged to serve
+	blockLen = peer.MaxBlockLen
+)
+
+// block of piece to request, in the same form as in request messages
+type Block struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+/*
+Picker tracks availability of pieces among peers along with outstanding block requests, and picks blocks to
+request from each peer.
+
+Pieces in progress are always finished first. Once every missing block is requested, picker enters endgame
+mode where blocks outstanding are requested from more peers; the duplicates are to be canceled once one of
+them arrives, see BlockReceived.
+
+Peers are identified by an arbitrary string, e.g. their address. Picker is goroutine safe.
+*/
+type Picker struct {
+	pieceLenBytes int64
+	lenBytes      int64
+
+	// mutex guarding states below
+	mtx  sync.Mutex
+	mode Mode
+	have *bitfield.Bitfield
+	// # pieces we have
+	haveCnt int
+	// # pieces we don't have and don't skip
+	missingCnt int
+	// # peers having each piece
+	avail []int
+	prio  []Priority
+	// pieces in the order to pick them: by key, with ties broken at random. It's index order in ModeSequential.
+	order []int
+	// position of each piece in order
+	pos []int
+	// pieces before it are all we have in ModeSequential
+	seqCursor int
+	partials  map[int]*partial
+	rand      *rand.Rand
+}
+
+// piece in progress
+type partial struct {
+	// peers each block is requested from, nil once block is received
+	reqs [][]string
+	done []bool
+	// # blocks received
+	doneCnt int
+}
+
+// New creates picker in ModeRarestFirst for content of info, of which we have pieces in have.
+func New(info *bcodec.TorrentInfo, have *bitfield.Bitfield) *Picker {
+	n := have.Len()
+	p := &Picker{
+		pieceLenBytes: info.PieceLenBytes,
+		lenBytes:      info.LenBytes,
+		have:          have.Clone(),
+		haveCnt:       have.Count(),
+		avail:         make([]int, n),
+		prio:          make([]Priority, n),
+		order:         make([]int, n),
+		pos:           make([]int, n),
+		partials:      make(map[int]*partial),
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for i := range p.prio {
+		p.prio[i] = PriorityNormal
+	}
+	p.missingCnt = n - p.haveCnt
+	p.sortOrder()
+	return p
+}
+
+func (p *Picker) SetMode(mode Mode) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.mode != mode {
+		p.mode = mode
+		p.seqCursor = 0
+		p.sortOrder()
+	}
+}
+
+// SetPriority sets priority of pieces first through last, both inclusive, e.g. those spanned by a file.
+func (p *Picker) SetPriority(first int, last int, prio Priority) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i := first; i <= last && i < len(p.prio); i++ {
+		if !p.have.Has(i) {
+			if p.prio[i] == PrioritySkip && prio != PrioritySkip {
+				p.missingCnt++
+			} else if p.prio[i] != PrioritySkip && prio == PrioritySkip {
+				p.missingCnt--
+			}
+		}
+		p.prio[i] = prio
+	}
+	if p.mode == ModePriority {
+		p.sortOrder()
+	}
+}
+
+// PeerHave records a peer has piece, e.g. upon have message.
+func (p *Picker) PeerHave(piece int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if piece >= 0 && piece < len(p.avail) {
+		p.incAvail(piece)
+	}
+}
+
+// PeerBitfield records a peer has pieces, e.g. upon bitfield message.
+func (p *Picker) PeerBitfield(has *bitfield.Bitfield) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i := 0; i < has.Len() && i < len(p.avail); i++ {
+		if has.Has(i) {
+			p.incAvail(i)
+		}
+	}
+}
+
+// PeerGone forgets peer which had pieces in has, along with blocks requested from it.
+func (p *Picker) PeerGone(peer string, has *bitfield.Bitfield) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i := 0; i < has.Len() && i < len(p.avail); i++ {
+		if has.Has(i) {
+			p.decAvail(i)
+		}
+	}
+	for _, pt := range p.partials {
+		for b := range pt.reqs {
+			pt.reqs[b] = removeStr(pt.reqs[b], peer)
+		}
+	}
+}
+
+/*
+Pick returns up to n blocks to request from peer having pieces in has, and records them as requested from
+peer. Nothing is returned if peer has nothing we want.
+*/
+func (p *Picker) Pick(peer string, has *bitfield.Bitfield, n int) []Block {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	var res []Block
+	partials := p.sortedPartials()
+	for _, piece := range partials {
+		if len(res) >= n {
+			return res
+		}
+		if has.Has(piece) {
+			res = p.pickBlocks(res, piece, peer, n, false)
+		}
+	}
+	start, random := 0, false
+	switch {
+	case p.mode == ModeSequential:
+		for p.seqCursor < len(p.order) && p.have.Has(p.seqCursor) {
+			p.seqCursor++
+		}
+		start = p.seqCursor
+	case p.mode == ModeRarestFirst && p.haveCnt < randomPieceCnt && len(p.order) > 0:
+		start, random = p.rand.Intn(len(p.order)), true
+	}
+	for k := start; k < start+len(p.order) && len(res) < n; k++ {
+		piece := p.order[k%len(p.order)]
+		if p.have.Has(piece) {
+			// pieces we have are at the end of order in modes other than sequential
+			if !random && p.mode != ModeSequential {
+				break
+			}
+			continue
+		}
+		if p.prio[piece] == PrioritySkip || p.partials[piece] != nil || !has.Has(piece) {
+			continue
+		}
+		blockCnt := int((p.pieceLen(piece) + blockLen - 1) / blockLen)
+		p.partials[piece] = &partial{reqs: make([][]string, blockCnt), done: make([]bool, blockCnt)}
+		res = p.pickBlocks(res, piece, peer, n, false)
+	}
+	if len(res) == 0 && p.endgame() {
+		for _, piece := range partials {
+			if len(res) >= n {
+				break
+			}
+			if has.Has(piece) {
+				res = p.pickBlocks(res, piece, peer, n, true)
+			}
+		}
+	}
+	return res
+}
+
+/*
+BlockReceived records block is received from peer, and returns other peers the block is requested from in
+endgame mode, to which cancel messages shall be sent. complete tells whether all blocks of the piece are
+received, in which case piece shall be verified and reported with PieceDone or PieceFailed.
+
+Blocks not requested, or received already, are ignored.
+*/
+func (p *Picker) BlockReceived(peer string, b Block) (cancel []string, complete bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.partials[int(b.Index)]
+	blk := int(b.Begin / blockLen)
+	if pt == nil || blk >= len(pt.done) || pt.done[blk] {
+		return nil, false
+	}
+	for _, other := range pt.reqs[blk] {
+		if other != peer {
+			cancel = append(cancel, other)
+		}
+	}
+	pt.done[blk], pt.reqs[blk] = true, nil
+	pt.doneCnt++
+	return cancel, pt.doneCnt == len(pt.done)
+}
+
+// Unrequest records block is no longer requested from peer, e.g. because peer rejected it or choked us.
+func (p *Picker) Unrequest(peer string, b Block) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pt := p.partials[int(b.Index)]
+	blk := int(b.Begin / blockLen)
+	if pt != nil && blk < len(pt.reqs) {
+		pt.reqs[blk] = removeStr(pt.reqs[blk], peer)
+	}
+}
+
+// PieceDone records piece is downloaded and verified.
+func (p *Picker) PieceDone(piece int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.partials, piece)
+	if piece < 0 || piece >= p.have.Len() || p.have.Has(piece) {
+		return
+	}
+	old := p.key(piece)
+	p.have.Set(piece)
+	p.haveCnt++
+	if p.prio[piece] != PrioritySkip {
+		p.missingCnt--
+	}
+	p.reposition(piece, old)
+}
+
+// PieceFailed records piece fails verification, so that it's downloaded again from scratch.
+func (p *Picker) PieceFailed(piece int) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.partials, piece)
+}
+
+// appends blocks of partial piece to request from peer to res, till res has n blocks
+func (p *Picker) pickBlocks(res []Block, piece int, peer string, n int, endgame bool) []Block {
+	pt := p.partials[piece]
+	pieceLen := p.pieceLen(piece)
+	for blk := 0; blk < len(pt.done) && len(res) < n; blk++ {
+		if pt.done[blk] || !endgame && len(pt.reqs[blk]) > 0 || containsStr(pt.reqs[blk], peer) {
+			continue
+		}
+		begin := int64(blk) * blockLen
+		length := pieceLen - begin
+		if length > blockLen {
+			length = blockLen
+		}
+		pt.reqs[blk] = append(pt.reqs[blk], peer)
+		res = append(res, Block{Index: uint32(piece), Begin: uint32(begin), Length: uint32(length)})
+	}
+	return res
+}
+
+// whether every block missing is requested, i.e. all pieces missing are in progress and fully requested
+func (p *Picker) endgame() bool {
+	cnt := 0
+	for piece, pt := range p.partials {
+		if p.prio[piece] == PrioritySkip {
+			continue
+		}
+		for blk := range pt.done {
+			if !pt.done[blk] && len(pt.reqs[blk]) == 0 {
+				return false
+			}
+		}
+		cnt++
+	}
+	return cnt == p.missingCnt
+}
+
+// pieces in progress in the order to pick them
+func (p *Picker) sortedPartials() []int {
+	res := make([]int, 0, len(p.partials))
+	for piece := range p.partials {
+		res = append(res, piece)
+	}
+	sort.Slice(res, func(i, j int) bool { return p.pos[res[i]] < p.pos[res[j]] })
+	return res
+}
+
+func (p *Picker) pieceLen(piece int) int64 {
+	off := int64(piece) * p.pieceLenBytes
+	if off+p.pieceLenBytes > p.lenBytes {
+		return p.lenBytes - off
+	}
+	return p.pieceLenBytes
+}
+
+// key of pieces we have, which sorts them after all others
+const haveKey = int64(1) << 62
+
+// order of piece in rarest-first and priority modes
+func (p *Picker) key(piece int) int64 {
+	if p.have.Has(piece) {
+		return haveKey
+	}
+	k := int64(p.avail[piece])
+	if p.mode == ModePriority {
+		k |= int64(PriorityHigh-p.prio[piece]) << 32
+	}
+	return k
+}
+
+// rebuilds order of pieces from scratch
+func (p *Picker) sortOrder() {
+	for i := range p.order {
+		p.order[i] = i
+	}
+	if p.mode != ModeSequential {
+		p.rand.Shuffle(len(p.order), func(i, j int) { p.order[i], p.order[j] = p.order[j], p.order[i] })
+		sort.SliceStable(p.order, func(i, j int) bool { return p.key(p.order[i]) < p.key(p.order[j]) })
+	}
+	for i, piece := range p.order {
+		p.pos[piece] = i
+	}
+}
+
+func (p *Picker) incAvail(piece int) {
+	old := p.key(piece)
+	p.avail[piece]++
+	p.reposition(piece, old)
+}
+
+func (p *Picker) decAvail(piece int) {
+	if p.avail[piece] == 0 {
+		return
+	}
+	old := p.key(piece)
+	p.avail[piece]--
+	p.reposition(piece, old)
+}
+
+/*
+Moves piece whose key has changed from old to where it belongs in order, which is sorted otherwise. Piece hops
+over a run of pieces of the same key at a time by swapping with the piece at the far end of the run, so that
+it takes O(log n) for each distinct key in between rather than shifting everything in between.
+*/
+func (p *Picker) reposition(piece int, old int64) {
+	if p.mode == ModeSequential {
+		return
+	}
+	n, k, cur := len(p.order), p.key(piece), old
+	// key of piece at i, where piece is considered to have key cur
+	keyAt := func(i int) int64 {
+		if p.order[i] == piece {
+			return cur
+		}
+		return p.key(p.order[i])
+	}
+	for cur < k {
+		last := sort.Search(n, func(i int) bool { return keyAt(i) > cur }) - 1
+		p.swap(p.pos[piece], last)
+		if last+1 >= n || p.key(p.order[last+1]) >= k {
+			return
+		}
+		cur = p.key(p.order[last+1])
+	}
+	for cur > k {
+		first := sort.Search(n, func(i int) bool { return keyAt(i) >= cur })
+		p.swap(p.pos[piece], first)
+		if first == 0 || p.key(p.order[first-1]) <= k {
+			return
+		}
+		cur = p.key(p.order[first-1])
+	}
+}
+
+func (p *Picker) swap(i int, j int) {
+	p.order[i], p.order[j] = p.order[j], p.order[i]
+	p.pos[p.order[i]], p.pos[p.order[j]] = i, j
+}
+
+func containsStr(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeStr(ss []string, s string) []string {
+	for i, v := range ss {
+		if v == s {
+			return append(ss[:i], ss[i+1:]...)
+		}
+	}
+	return ss
+}
@@ -0,0 +1,208 @@
+package picker
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+)
+
+// info of n pieces, each of 2 blocks but the last one of a single short block
+func testInfo(n int) *bcodec.TorrentInfo {
+	return &bcodec.TorrentInfo{PieceLenBytes: 2 * blockLen, LenBytes: int64(n-1)*2*blockLen + 100}
+}
+
+func bits(n int, set ...int) *bitfield.Bitfield {
+	res := bitfield.New(n)
+	for _, i := range set {
+		res.Set(i)
+	}
+	return res
+}
+
+func pieces(blocks []Block) []int {
+	var res []int
+	for _, b := range blocks {
+		if len(res) == 0 || res[len(res)-1] != int(b.Index) {
+			res = append(res, int(b.Index))
+		}
+	}
+	return res
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	t.Parallel()
+	p := New(testInfo(6), bits(6, 0, 1, 2, 3))
+	all := bits(6, 0, 1, 2, 3, 4, 5)
+	p.PeerBitfield(all)
+	p.PeerBitfield(all)
+	p.PeerHave(5)
+	p.PeerHave(5)
+	// piece 4 is the rarest
+	assert.Equal(t, []Block{{Index: 4, Begin: 0, Length: blockLen}}, p.Pick("a", all, 1))
+	// piece in progress is finished first
+	assert.Equal(t, []Block{{Index: 4, Begin: blockLen, Length: blockLen}, {Index: 5, Begin: 0, Length: 100}}, p.Pick("b", all, 3))
+	assert.Empty(t, p.Pick("c", bits(6, 0), 3))
+
+	p.PeerGone("a", all)
+	p.PeerGone("b", all)
+	p.PeerGone("c", all)
+	p.PieceFailed(5)
+	// piece 5 still has 2 peers while piece 4 has none, and blocks requested from peers gone are free again
+	p.PeerHave(4)
+	p.PeerHave(4)
+	p.PeerHave(4)
+	assert.Equal(t, []int{4}, pieces(p.Pick("d", all, 2)))
+	assert.Equal(t, []int{5}, pieces(p.Pick("e", all, 1)))
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	t.Parallel()
+	const n = 1000
+	all := bitfield.New(n)
+	for i := 0; i < n; i++ {
+		all.Set(i)
+	}
+	seen := make(map[int]bool)
+	for k := 0; k < 10; k++ {
+		p := New(testInfo(n), bitfield.New(n))
+		p.PeerBitfield(all)
+		// rarity is the same for all, so the first piece is random
+		seen[int(p.Pick("a", all, 1)[0].Index)] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestPickModes(t *testing.T) {
+	t.Parallel()
+	all := bits(6, 0, 1, 2, 3, 4, 5)
+	cases := []struct {
+		name  string
+		setup func(p *Picker)
+		want  []int
+	}{
+		{"sequential", func(p *Picker) {
+			p.SetMode(ModeSequential)
+			p.PeerHave(5)
+		}, []int{0, 1, 2, 3, 4, 5}},
+		{"sequential skipping", func(p *Picker) {
+			p.SetMode(ModeSequential)
+			p.SetPriority(1, 3, PrioritySkip)
+		}, []int{0, 4, 5}},
+		{"priority", func(p *Picker) {
+			p.SetMode(ModePriority)
+			p.SetPriority(0, 5, PriorityLow)
+			p.SetPriority(3, 3, PriorityHigh)
+			p.SetPriority(1, 1, PriorityNormal)
+			p.PeerHave(1)
+		}, []int{3, 1}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			p := New(testInfo(6), bitfield.New(6))
+			p.PeerBitfield(all)
+			c.setup(p)
+			got := pieces(p.Pick("a", all, 12))
+			assert.Equal(t, c.want, got[:len(c.want)])
+		})
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	t.Parallel()
+	p := New(testInfo(2), bits(2, 0))
+	all := bits(2, 0, 1)
+	p.PeerBitfield(all)
+	p.PeerBitfield(all)
+	p.PeerBitfield(all)
+	// last piece is a single short block
+	b := Block{Index: 1, Begin: 0, Length: 100}
+	assert.Equal(t, []Block{b}, p.Pick("a", all, 4))
+	// duplicated in endgame, but never twice to the same peer
+	assert.Empty(t, p.Pick("a", all, 4))
+	assert.Equal(t, []Block{b}, p.Pick("b", all, 4))
+	assert.Equal(t, []Block{b}, p.Pick("c", all, 4))
+	p.Unrequest("c", b)
+
+	cancel, complete := p.BlockReceived("b", b)
+	assert.Equal(t, []string{"a"}, cancel)
+	assert.True(t, complete)
+	// duplicate arriving late is ignored
+	cancel, complete = p.BlockReceived("a", b)
+	assert.Empty(t, cancel)
+	assert.False(t, complete)
+	p.PieceDone(1)
+	assert.Empty(t, p.Pick("c", all, 4))
+}
+
+func TestAvailabilityOrder(t *testing.T) {
+	t.Parallel()
+	const n = 500
+	p := New(testInfo(n), bitfield.New(n))
+	r := rand.New(rand.NewSource(1))
+	for k := 0; k < 20000; k++ {
+		piece := r.Intn(n)
+		if r.Intn(3) == 0 {
+			p.decAvail(piece)
+		} else {
+			p.incAvail(piece)
+		}
+	}
+	for k := 0; k < 100; k++ {
+		p.PieceDone(r.Intn(n))
+	}
+	for k := 0; k < 1000; k++ {
+		p.incAvail(r.Intn(n))
+	}
+	for i := 1; i < n; i++ {
+		assert.LessOrEqual(t, p.key(p.order[i-1]), p.key(p.order[i]))
+	}
+	for i, piece := range p.order {
+		assert.Equal(t, i, p.pos[piece])
+	}
+}
+
+func BenchmarkPick(b *testing.B) {
+	const n, peerCnt = 100000, 50
+	info := testInfo(n)
+	have := bitfield.New(n)
+	r := rand.New(rand.NewSource(1))
+	peers := make([]*bitfield.Bitfield, peerCnt)
+	p := New(info, have)
+	for i := range peers {
+		peers[i] = bitfield.New(n)
+		for j := 0; j < n; j++ {
+			if r.Intn(2) == 0 {
+				peers[i].Set(j)
+			}
+		}
+		p.PeerBitfield(peers[i])
+	}
+	names := make([]string, peerCnt)
+	for i := range names {
+		names[i] = string(rune('a' + i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := i % peerCnt
+		for _, blk := range p.Pick(names[k], peers[k], 4) {
+			if _, complete := p.BlockReceived(names[k], blk); complete {
+				p.PieceDone(int(blk.Index))
+			}
+		}
+	}
+}
+
+func BenchmarkPeerHave(b *testing.B) {
+	const n = 100000
+	p := New(testInfo(n), bitfield.New(n))
+	r := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.PeerHave(r.Intn(n))
+	}
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+/*
+File keeps torrent content in files under a directory, laid out the way the torrent describes: content of
+single-file torrents goes to file named after the torrent, and files of multi-file torrents go under directory
+named after the torrent.
+
+Padding files aren't written to disk; they read as zeros. Files are opened on first access and kept open till
+storage is closed. Nothing is created on disk till the first block is written, so that reading, e.g. to verify
+content, leaves the directory as it is.
+*/
+type File struct {
+	info *bcodec.TorrentInfo
+	// files in the order of their appearance in content
+	files []*fileEntry
+	// mutex guarding states below
+	mtx     sync.Mutex
+	handles map[int]*os.File
+	closed  bool
+	// whether empty files are created
+	emptyCreated bool
+}
+
+// a file in content spanning [off, off+lenBytes)
+type fileEntry struct {
+	path     string
+	off      int64
+	lenBytes int64
+	padding  bool
+}
+
+var _ Storage = (*File)(nil)
+
+/*
+Creates storage of content of info under dir. Files and the directories they reside in are created as blocks
+are written to them; empty files, to which no block is ever written, are created along with the first block.
+*/
+func NewFile(info *bcodec.TorrentInfo, dir string) (*File, error) {
+	x := &File{info: info, handles: make(map[int]*os.File)}
+	if len(info.Files) == 0 {
+		path, err := localPath(dir, info.Name)
+		if err != nil {
+			return nil, err
+		}
+		x.files = []*fileEntry{{path: path, lenBytes: info.LenBytes}}
+	}
+	var off int64
+	for _, f := range info.Files {
+		path, err := localPath(dir, filepath.Join(info.Name, f.Path))
+		if err != nil {
+			return nil, err
+		}
+		x.files = append(x.files, &fileEntry{path: path, off: off, lenBytes: f.LenBytes, padding: f.IsPadding()})
+		off += f.LenBytes
+	}
+	return x, nil
+}
+
+func (x *File) ReadBlock(piece int, begin int64, buf []byte) error {
+	off, err := contentOff(x.info, piece, begin, len(buf))
+	if err != nil {
+		return err
+	}
+	return x.span(off, buf, false, func(f *os.File, off int64, b []byte) error {
+		if _, err := f.ReadAt(b, off); err != nil {
+			if err == io.EOF {
+				// file isn't fully written yet
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("error reading %s: %w", f.Name(), err)
+		}
+		return nil
+	})
+}
+
+func (x *File) WriteBlock(piece int, begin int64, b []byte) error {
+	off, err := contentOff(x.info, piece, begin, len(b))
+	if err != nil {
+		return err
+	}
+	if err := x.createEmpty(); err != nil {
+		return err
+	}
+	return x.span(off, b, true, func(f *os.File, off int64, b []byte) error {
+		if _, err := f.WriteAt(b, off); err != nil {
+			return fmt.Errorf("error writing %s: %w", f.Name(), err)
+		}
+		return nil
+	})
+}
+
+func (x *File) Close() error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.closed = true
+	var res error
+	for i, f := range x.handles {
+		if err := f.Close(); err != nil && res == nil {
+			res = err
+		}
+		delete(x.handles, i)
+	}
+	return res
+}
+
+/*
+Splits block at content offset off into parts falling in each file, and applies op to each part along with
+the file and offset within it. Parts in padding files are skipped when writing, and zeroed when reading.
+Files missing are only created when writing.
+*/
+func (x *File) span(off int64, b []byte, write bool, op func(f *os.File, off int64, b []byte) error) error {
+	i := sort.Search(len(x.files), func(i int) bool { return x.files[i].off+x.files[i].lenBytes > off })
+	for ; len(b) > 0 && i < len(x.files); i++ {
+		entry := x.files[i]
+		n := entry.off + entry.lenBytes - off
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		if entry.padding {
+			// block written is the caller's, which is left as it is
+			for j := 0; !write && j < int(n); j++ {
+				b[j] = 0
+			}
+		} else {
+			f, err := x.handle(i, write)
+			if err != nil {
+				return err
+			}
+			if err := op(f, off-entry.off, b[:n]); err != nil {
+				return err
+			}
+		}
+		b = b[n:]
+		off += n
+	}
+	return nil
+}
+
+// returns handle of file i, opening it if needed
+func (x *File) handle(i int, create bool) (*os.File, error) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if x.closed {
+		return nil, os.ErrClosed
+	}
+	if f := x.handles[i]; f != nil {
+		return f, nil
+	}
+	flag := os.O_RDWR
+	if create {
+		if err := os.MkdirAll(filepath.Dir(x.files[i].path), 0o755); err != nil {
+			return nil, fmt.Errorf("error creating directory of %s: %w", x.files[i].path, err)
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(x.files[i].path, flag, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", x.files[i].path, err)
+	}
+	x.handles[i] = f
+	return f, nil
+}
+
+// joins dir and rel, making sure the result stays within dir
+func localPath(dir string, rel string) (string, error) {
+	rel = filepath.Clean(rel)
+	if rel == "." || rel == ".." || filepath.IsAbs(rel) || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", bcodec.ErrUnsafePath, rel)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// creates empty files of content along with their directories, unless they're created already
+func (x *File) createEmpty() error {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if x.closed {
+		return os.ErrClosed
+	}
+	if x.emptyCreated {
+		return nil
+	}
+	for _, entry := range x.files {
+		if entry.padding || entry.lenBytes > 0 {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(entry.path), 0o755); err != nil {
+			return fmt.Errorf("error creating directory of %s: %w", entry.path, err)
+		}
+		f, err := os.OpenFile(entry.path, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %w", entry.path, err)
+		}
+		f.Close()
+	}
+	x.emptyCreated = true
+	return nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"sync"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+/*
+Memory keeps torrent content in memory, e.g. for tests. Pieces are allocated once they're written to, and
+pieces never written read as zeros, as do padding files.
+*/
+type Memory struct {
+	info *bcodec.TorrentInfo
+	// mutex guarding pieces
+	mtx    sync.RWMutex
+	pieces map[int][]byte
+}
+
+var _ Storage = (*Memory)(nil)
+
+func NewMemory(info *bcodec.TorrentInfo) *Memory {
+	return &Memory{info: info, pieces: make(map[int][]byte)}
+}
+
+func (m *Memory) ReadBlock(piece int, begin int64, buf []byte) error {
+	off, err := contentOff(m.info, piece, begin, len(buf))
+	if err != nil {
+		return err
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	p := m.pieces[piece]
+	if p == nil {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+	copy(buf, p[begin:])
+	zeroPadding(m.info, off, buf)
+	return nil
+}
+
+func (m *Memory) WriteBlock(piece int, begin int64, b []byte) error {
+	if _, err := contentOff(m.info, piece, begin, len(b)); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	p := m.pieces[piece]
+	if p == nil {
+		p = make([]byte, m.info.PieceLenBytes)
+		m.pieces[piece] = p
+	}
+	copy(p[begin:], b)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
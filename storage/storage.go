@@ -0,0 +1,64 @@
+// Package storage keeps torrent content, addressed by pieces, in some backend such as files on disk.
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+// ErrOutOfRange is returned when a block doesn't fall within a single piece of torrent content.
+var ErrOutOfRange = errors.New("block out of piece range")
+
+/*
+Storage reads and writes blocks of torrent content. A block is addressed by piece index and its offset within
+the piece, and must not cross piece boundary; its length is that of the buffer passed in.
+
+Implementations are goroutine safe.
+*/
+type Storage interface {
+	// ReadBlock fills buf with content of piece starting at offset begin.
+	ReadBlock(piece int, begin int64, buf []byte) error
+	// WriteBlock writes b to piece starting at offset begin.
+	WriteBlock(piece int, begin int64, b []byte) error
+	// Close releases resources held by storage, which can't be used afterwards.
+	Close() error
+}
+
+// returns offset of block within torrent content, validating the block is within a piece of info
+func contentOff(info *bcodec.TorrentInfo, piece int, begin int64, n int) (int64, error) {
+	if piece < 0 || int64(piece) >= info.PieceCnt() || begin < 0 {
+		return 0, fmt.Errorf("%w: piece %d, offset %d", ErrOutOfRange, piece, begin)
+	}
+	off := int64(piece) * info.PieceLenBytes
+	pieceLen := info.PieceLenBytes
+	if off+pieceLen > info.LenBytes {
+		pieceLen = info.LenBytes - off
+	}
+	if begin+int64(n) > pieceLen {
+		return 0, fmt.Errorf("%w: %d bytes at offset %d of piece %d, which is %d bytes long", ErrOutOfRange, n, begin, piece, pieceLen)
+	}
+	return off + begin, nil
+}
+
+// zeroes bytes of b, which starts at content offset off, falling in padding files of info
+func zeroPadding(info *bcodec.TorrentInfo, off int64, b []byte) {
+	var fileOff int64
+	for _, f := range info.Files {
+		lo, hi := fileOff, fileOff+f.LenBytes
+		fileOff = hi
+		if !f.IsPadding() || hi <= off || lo >= off+int64(len(b)) {
+			continue
+		}
+		if lo < off {
+			lo = off
+		}
+		if hi > off+int64(len(b)) {
+			hi = off + int64(len(b))
+		}
+		for i := lo - off; i < hi-off; i++ {
+			b[i] = 0
+		}
+	}
+}
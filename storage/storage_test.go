@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+var (
+	multiFileInfo = &bcodec.TorrentInfo{
+		Name:          "foo",
+		PieceLenBytes: 4,
+		LenBytes:      14,
+		Files: []*bcodec.FileSpec{
+			{Path: "a", LenBytes: 3},
+			{Path: ".pad/1", LenBytes: 1, Attr: "p"},
+			{Path: filepath.Join("sub", "empty"), LenBytes: 0},
+			{Path: filepath.Join("sub", "b"), LenBytes: 10},
+		},
+	}
+	singleFileInfo = &bcodec.TorrentInfo{Name: "bar", PieceLenBytes: 4, LenBytes: 14}
+)
+
+// content of info where padding bytes are zeros
+func testContent(info *bcodec.TorrentInfo) []byte {
+	res := make([]byte, info.LenBytes)
+	for i := range res {
+		res[i] = byte('a' + i)
+	}
+	if len(info.Files) > 0 {
+		// padding file of multiFileInfo
+		res[3] = 0
+	}
+	return res
+}
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		name string
+		info *bcodec.TorrentInfo
+		open func(t *testing.T, info *bcodec.TorrentInfo) Storage
+	}{
+		{"memory multi-file", multiFileInfo, func(t *testing.T, info *bcodec.TorrentInfo) Storage { return NewMemory(info) }},
+		{"memory single-file", singleFileInfo, func(t *testing.T, info *bcodec.TorrentInfo) Storage { return NewMemory(info) }},
+		{"file multi-file", multiFileInfo, openFile},
+		{"file single-file", singleFileInfo, openFile},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			s := c.open(t, c.info)
+			defer s.Close()
+			content := testContent(c.info)
+			// write each piece in 2 blocks, the second one first
+			for p := 0; p < int(c.info.PieceCnt()); p++ {
+				piece := content[int64(p)*c.info.PieceLenBytes:]
+				if int64(len(piece)) > c.info.PieceLenBytes {
+					piece = piece[:c.info.PieceLenBytes]
+				}
+				half := len(piece) / 2
+				assert.Nil(t, s.WriteBlock(p, int64(half), piece[half:]))
+				assert.Nil(t, s.WriteBlock(p, 0, piece[:half]))
+			}
+			buf := make([]byte, 3)
+			assert.Nil(t, s.ReadBlock(0, 1, buf))
+			assert.Equal(t, content[1:4], buf)
+			assert.Nil(t, s.ReadBlock(2, 0, buf))
+			assert.Equal(t, content[8:11], buf)
+			buf = make([]byte, 2)
+			assert.Nil(t, s.ReadBlock(2, 2, buf))
+			assert.Equal(t, content[10:12], buf)
+
+			assert.ErrorIs(t, s.ReadBlock(-1, 0, buf), ErrOutOfRange)
+			assert.ErrorIs(t, s.ReadBlock(int(c.info.PieceCnt()), 0, buf), ErrOutOfRange)
+			assert.ErrorIs(t, s.ReadBlock(0, 3, buf), ErrOutOfRange)
+			// last piece is shorter
+			assert.ErrorIs(t, s.WriteBlock(int(c.info.PieceCnt())-1, 1, make([]byte, 4)), ErrOutOfRange)
+
+			// padding reads as zeros whatever is written to it, and block written is left intact
+			block := []byte("wxyz")
+			assert.Nil(t, s.WriteBlock(0, 0, block))
+			assert.Equal(t, []byte("wxyz"), block)
+			want := []byte("wxyz")
+			if len(c.info.Files) > 0 {
+				want[3] = 0
+			}
+			buf = make([]byte, 4)
+			assert.Nil(t, s.ReadBlock(0, 0, buf))
+			assert.Equal(t, want, buf)
+		})
+	}
+}
+
+func openFile(t *testing.T, info *bcodec.TorrentInfo) Storage {
+	s, err := NewFile(info, t.TempDir())
+	assert.Nil(t, err)
+	return s
+}
+
+func TestFileLayout(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s, err := NewFile(multiFileInfo, dir)
+	assert.Nil(t, err)
+	// reading what's not written yet fails, and creates nothing
+	assert.NotNil(t, s.ReadBlock(3, 0, make([]byte, 2)))
+	_, err = os.Stat(filepath.Join(dir, "foo"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	content := testContent(multiFileInfo)
+	for p := 0; p < 4; p++ {
+		end := 4 * (p + 1)
+		if end > len(content) {
+			end = len(content)
+		}
+		assert.Nil(t, s.WriteBlock(p, 0, content[4*p:end]))
+	}
+	stat, err := os.Stat(filepath.Join(dir, "foo", "sub", "empty"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size())
+	assert.Nil(t, s.Close())
+	assert.ErrorIs(t, s.WriteBlock(0, 0, []byte{1}), os.ErrClosed)
+	b, err := os.ReadFile(filepath.Join(dir, "foo", "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, content[:3], b)
+	b, err = os.ReadFile(filepath.Join(dir, "foo", "sub", "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, content[4:], b)
+	_, err = os.Stat(filepath.Join(dir, "foo", ".pad"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	s, err = NewFile(singleFileInfo, dir)
+	assert.Nil(t, err)
+	assert.Nil(t, s.WriteBlock(3, 0, []byte("xy")))
+	assert.Nil(t, s.Close())
+	b, err = os.ReadFile(filepath.Join(dir, "bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, append(make([]byte, 12), "xy"...), b)
+
+	_, err = NewFile(&bcodec.TorrentInfo{Name: "..", PieceLenBytes: 4, LenBytes: 1}, dir)
+	assert.ErrorIs(t, err, bcodec.ErrUnsafePath)
+}
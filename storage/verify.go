@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/bitfield"
+)
+
+// ErrNoPieceHashes is returned when verifying content of a torrent without v1 piece hashes.
+var ErrNoPieceHashes = errors.New("torrent has no v1 piece hashes")
+
+/*
+VerifyPiece tells whether piece in s matches its hash in info. buf must be able to hold a whole piece.
+
+Piece which can't be read, e.g. because files are missing or truncated, doesn't match.
+*/
+func VerifyPiece(info *bcodec.TorrentInfo, s Storage, piece int, buf []byte) bool {
+	off := int64(piece) * info.PieceLenBytes
+	n := info.PieceLenBytes
+	if off+n > info.LenBytes {
+		n = info.LenBytes - off
+	}
+	if s.ReadBlock(piece, 0, buf[:n]) != nil {
+		return false
+	}
+	h := sha1.Sum(buf[:n])
+	return bytes.Equal(h[:], info.Pieces[20*piece:20*piece+20])
+}
+
+/*
+Verify hashes content of info in s against its piece hashes and returns the pieces which match.
+
+Pieces are hashed by up to workers goroutines, one per CPU core if workers isn't positive. onPiece, if not nil,
+is called once a piece is checked, one call at a time. Verification stops with ctx.Err() once ctx is done.
+*/
+func Verify(ctx context.Context, info *bcodec.TorrentInfo, s Storage, workers int, onPiece func(piece int, ok bool)) (*bitfield.Bitfield, error) {
+	if !info.HasV1() {
+		return nil, ErrNoPieceHashes
+	}
+	pieceCnt := int(info.PieceCnt())
+	if len(info.Pieces) != 20*pieceCnt {
+		return nil, fmt.Errorf("%w: %d piece hashes for %d pieces", bcodec.ErrPieceCntMismatch, len(info.Pieces)/20, pieceCnt)
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	res := bitfield.New(pieceCnt)
+	// mutex guarding res and serializing onPiece calls
+	var mtx sync.Mutex
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, info.PieceLenBytes)
+			for piece := range idxs {
+				ok := VerifyPiece(info, s, piece, buf)
+				mtx.Lock()
+				if ok {
+					res.Set(piece)
+				}
+				if onPiece != nil {
+					onPiece(piece, ok)
+				}
+				mtx.Unlock()
+			}
+		}()
+	}
+loop:
+	for piece := 0; piece < pieceCnt; piece++ {
+		select {
+		case idxs <- piece:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(idxs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PieceFiles returns indices of non-padding files of info which piece overlaps, in ascending order.
+func PieceFiles(info *bcodec.TorrentInfo, piece int) []int {
+	if len(info.Files) == 0 {
+		return []int{0}
+	}
+	start := int64(piece) * info.PieceLenBytes
+	end := start + info.PieceLenBytes
+	var res []int
+	var off int64
+	for i, f := range info.Files {
+		if off >= end {
+			break
+		}
+		if !f.IsPadding() && off+f.LenBytes > start && f.LenBytes > 0 {
+			res = append(res, i)
+		}
+		off += f.LenBytes
+	}
+	return res
+}
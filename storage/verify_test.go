@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "foo")
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "sub"), 0o755))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "a"), make([]byte, 20<<10), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "b"), []byte("0123456789"), 0o644))
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "c"), make([]byte, 30<<10), 0o644))
+	info, err := bcodec.NewTorrentInfo(root, 16<<10, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.PieceCnt())
+
+	s, err := NewFile(info, dir)
+	assert.Nil(t, err)
+	var checked []int
+	pieces, err := Verify(context.Background(), info, s, 2, func(piece int, ok bool) {
+		assert.True(t, ok)
+		checked = append(checked, piece)
+	})
+	assert.Nil(t, err)
+	assert.True(t, pieces.All())
+	assert.ElementsMatch(t, []int{0, 1, 2, 3}, checked)
+	assert.Nil(t, s.Close())
+
+	// corrupt piece 1 spanning all 3 files, and truncate the last file
+	assert.Nil(t, os.WriteFile(filepath.Join(root, "sub", "b"), []byte("01234x6789"), 0o644))
+	assert.Nil(t, os.Truncate(filepath.Join(root, "sub", "c"), 29<<10))
+	s, err = NewFile(info, dir)
+	assert.Nil(t, err)
+	defer s.Close()
+	pieces, err = Verify(context.Background(), info, s, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false, true, false}, []bool{pieces.Has(0), pieces.Has(1), pieces.Has(2), pieces.Has(3)})
+	assert.Equal(t, []int{0, 1, 2}, PieceFiles(info, 1))
+	assert.Equal(t, []int{2}, PieceFiles(info, 3))
+
+	// missing files only fail the pieces they span
+	assert.Nil(t, os.Remove(filepath.Join(root, "a")))
+	// a fresh storage so that the file removed isn't held open
+	assert.Nil(t, s.Close())
+	s, err = NewFile(info, dir)
+	assert.Nil(t, err)
+	pieces, err = Verify(context.Background(), info, s, 0, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pieces.Count())
+	_, err = os.Stat(filepath.Join(root, "a"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Verify(ctx, info, s, 0, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = Verify(context.Background(), &bcodec.TorrentInfo{PieceLenBytes: 4, LenBytes: 4, MetaVersion: 2}, NewMemory(info), 0, nil)
+	assert.ErrorIs(t, err, ErrNoPieceHashes)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"wuyrush.io/gtr/tracker"
+)
+
+func runTracker(args []string) error {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gtr tracker [options]\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	var allowlist stringsFlag
+	httpAddr := fs.String("http", ":6969", "address to serve HTTP announce and scrape on; disabled if empty")
+	udpAddr := fs.String("udp", ":6969", "address to serve UDP announce and scrape on; disabled if empty")
+	interval := fs.Duration("interval", 30*time.Minute, "announce interval asked from clients")
+	fs.Var(&allowlist, "allow", "hex-encoded info hash of torrent to track; can be repeated, any torrent is tracked if not set")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 || *httpAddr == "" && *udpAddr == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := &tracker.ServerOpts{Interval: *interval}
+	for _, s := range allowlist {
+		h, err := hex.DecodeString(s)
+		if err != nil || len(h) != 20 {
+			return fmt.Errorf("info hash to allow must be 40 hex digits: %s", s)
+		}
+		opts.Allowlist = append(opts.Allowlist, h)
+	}
+	srv := tracker.NewServer(opts)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return fmt.Errorf("error listening for HTTP tracker requests: %w", err)
+		}
+		httpSrv := &http.Server{Handler: srv, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			<-ctx.Done()
+			httpSrv.Close()
+		}()
+		go func() {
+			if err := httpSrv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+		fmt.Printf("serving HTTP tracker at http://%s/announce\n", ln.Addr())
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return fmt.Errorf("error listening for UDP tracker requests: %w", err)
+		}
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		go func() {
+			if err := srv.ServeUDP(conn); err != nil {
+				errs <- err
+			}
+		}()
+		fmt.Printf("serving UDP tracker at udp://%s/announce\n", conn.LocalAddr())
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
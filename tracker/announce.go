@@ -0,0 +1,270 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+// announce event
+type Event string
+
+const (
+	// regular announce
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventCompleted Event = "completed"
+	EventStopped   Event = "stopped"
+)
+
+// parameters of an announce request
+type AnnounceReq struct {
+	InfoHash   []byte
+	PeerID     []byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// # peers wanted; tracker's default applies when negative
+	NumWant int
+	// random value identifying the client across IP changes
+	Key uint32
+	// tracker id returned by previous announce if any
+	TrackerID *string
+}
+
+// client of a single tracker
+type Client interface {
+	Announce(ctx context.Context, req *AnnounceReq) (*bcodec.TrackerRsp, error)
+	Scrape(ctx context.Context, infoHashes ...[]byte) (*bcodec.ScrapeRsp, error)
+}
+
+// client of HTTP tracker
+type HTTPClient struct {
+	// http.DefaultClient is used if nil
+	HTTP *http.Client
+	// announce url
+	URL string
+}
+
+/*
+Announce sends BEP 3 announce request to tracker, asking for peer list in binary (compact) form.
+
+Failure reason in tracker response is surfaced as *FailureError.
+*/
+func (c *HTTPClient) Announce(ctx context.Context, req *AnnounceReq) (*bcodec.TrackerRsp, error) {
+	params := []string{
+		"info_hash=" + escapeBytes(req.InfoHash),
+		"peer_id=" + escapeBytes(req.PeerID),
+		"port=" + strconv.FormatUint(uint64(req.Port), 10),
+		"uploaded=" + strconv.FormatInt(req.Uploaded, 10),
+		"downloaded=" + strconv.FormatInt(req.Downloaded, 10),
+		"left=" + strconv.FormatInt(req.Left, 10),
+		"compact=1",
+		"key=" + strconv.FormatUint(uint64(req.Key), 16),
+	}
+	if req.NumWant >= 0 {
+		params = append(params, "numwant="+strconv.Itoa(req.NumWant))
+	}
+	if req.Event != EventNone {
+		params = append(params, "event="+string(req.Event))
+	}
+	if req.TrackerID != nil {
+		params = append(params, "trackerid="+escapeBytes([]byte(*req.TrackerID)))
+	}
+	rsp := &bcodec.TrackerRsp{}
+	if err := get(ctx, c.HTTP, withQuery(c.URL, strings.Join(params, "&")), rsp); err != nil {
+		return nil, err
+	}
+	if rsp.FailureReason != nil {
+		return nil, &FailureError{Reason: *rsp.FailureReason, RetryIn: rsp.RetryIn}
+	}
+	return rsp, nil
+}
+
+func (c *HTTPClient) Scrape(ctx context.Context, infoHashes ...[]byte) (*bcodec.ScrapeRsp, error) {
+	return Scrape(ctx, c.HTTP, c.URL, infoHashes...)
+}
+
+const (
+	defaultInterval   = 30 * time.Minute
+	defaultMinBackoff = 15 * time.Second
+	defaultMaxBackoff = 30 * time.Minute
+	// time allowed for an announce, retransmissions of UDP trackers included
+	defaultAnnounceTimeout = time.Minute
+	// time allowed for the stopped event when announcer is shutting down
+	stopTimeout = 5 * time.Second
+)
+
+// transfer statistics of a torrent reported in announces
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+/*
+Announcer announces a torrent to a single tracker periodically.
+
+It announces at the interval returned by tracker, never more often than the min interval, and backs off
+exponentially when announce fails.
+*/
+type Announcer struct {
+	Client Client
+	// template of announce requests; stats, event and tracker id are filled in by Announcer
+	Req AnnounceReq
+	// reports up-to-date transfer statistics
+	Stats func() Stats
+	// called with result of every announce
+	OnAnnounce func(rsp *bcodec.TrackerRsp, err error)
+	// backoff bounds on failure; defaults are used if zero
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// time allowed for each announce, after which it fails; default is used if zero
+	Timeout time.Duration
+}
+
+/*
+Run announces until ctx is done, in which case a stopped event is sent on best-effort basis, or tracker asks
+us never to retry after a failure. Completion of download is announced once completed is closed; pass nil if
+torrent is complete already.
+*/
+func (a *Announcer) Run(ctx context.Context, completed <-chan struct{}) {
+	var trackerID *string
+	event := EventStarted
+	// completion is yet to be announced
+	pendingCompleted := false
+	failures := 0
+	for {
+		if event == EventNone && pendingCompleted {
+			event = EventCompleted
+		}
+		rsp, err := a.announce(ctx, event, trackerID)
+		if ctx.Err() != nil {
+			// announce cut short may have reached tracker nonetheless
+			a.stop(trackerID)
+			return
+		}
+		if a.OnAnnounce != nil {
+			a.OnAnnounce(rsp, err)
+		}
+		var failure *FailureError
+		if errors.As(err, &failure) && failure.RetryIn != nil && *failure.RetryIn == bcodec.RetryNever {
+			return
+		}
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+			if rsp.TrackerID != nil {
+				trackerID = rsp.TrackerID
+			}
+			if event == EventCompleted {
+				pendingCompleted = false
+			}
+			event = EventNone
+		}
+		timer := time.NewTimer(a.nextAnnounce(rsp, err, failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if event != EventStarted {
+				// tracker knows about us
+				a.stop(trackerID)
+			}
+			return
+		case <-completed:
+			// announce completion right away
+			timer.Stop()
+			completed = nil
+			pendingCompleted = true
+		case <-timer.C:
+		}
+	}
+}
+
+// sends stopped event on best-effort basis, with its own timeout as announcer is shutting down
+func (a *Announcer) stop(trackerID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	rsp, err := a.announce(ctx, EventStopped, trackerID)
+	if a.OnAnnounce != nil {
+		a.OnAnnounce(rsp, err)
+	}
+}
+
+func (a *Announcer) announce(ctx context.Context, event Event, trackerID *string) (*bcodec.TrackerRsp, error) {
+	req := a.Req
+	if a.Stats != nil {
+		stats := a.Stats()
+		req.Uploaded, req.Downloaded, req.Left = stats.Uploaded, stats.Downloaded, stats.Left
+	}
+	req.Event = event
+	req.TrackerID = trackerID
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultAnnounceTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rsp, err := a.Client.Announce(ctx, &req)
+	if err != nil {
+		return nil, fmt.Errorf("error announcing %s event: %w", eventName(event), err)
+	}
+	return rsp, nil
+}
+
+func eventName(e Event) string {
+	if e == EventNone {
+		return "regular"
+	}
+	return string(e)
+}
+
+// computes wait time before the next announce, given result of the last one and # consecutive failures
+func (a *Announcer) nextAnnounce(rsp *bcodec.TrackerRsp, err error, failures int) time.Duration {
+	if err != nil {
+		var failure *FailureError
+		if errors.As(err, &failure) && failure.RetryIn != nil {
+			// tracker asking for immediate retry mustn't get us into a tight loop
+			if min := backoff(1, a.MinBackoff, a.MaxBackoff); *failure.RetryIn < min {
+				return min
+			}
+			return *failure.RetryIn
+		}
+		return backoff(failures, a.MinBackoff, a.MaxBackoff)
+	}
+	res := defaultInterval
+	if rsp.PollInterval != nil && *rsp.PollInterval > 0 {
+		res = *rsp.PollInterval
+	}
+	if rsp.MinPollInterval != nil && res < *rsp.MinPollInterval {
+		res = *rsp.MinPollInterval
+	}
+	return res
+}
+
+// exponential backoff after # consecutive failures
+func backoff(failures int, min, max time.Duration) time.Duration {
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	res := min
+	for i := 1; i < failures && res < max; i++ {
+		res <<= 1
+	}
+	if res > max {
+		res = max
+	}
+	return res
+}
@@ -0,0 +1,185 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+func TestHTTPAnnounce(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/announce", r.URL.Path)
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("event") == "stopped" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("d14:failure reason12:unknown peer8:retry in5:nevere"))
+			return
+		}
+		w.Write([]byte("d8:intervali1800e12:min intervali60e5:peers6:\x43\xd7\xf6\xca\x1a\xe110:tracker id3:xyze"))
+	}))
+	defer srv.Close()
+
+	trackerID := "a b"
+	c := &HTTPClient{HTTP: srv.Client(), URL: srv.URL + "/announce?passkey=42"}
+	rsp, err := c.Announce(context.Background(), &AnnounceReq{
+		InfoHash:   []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12~"),
+		PeerID:     []byte("-GT0001-0123456789ab"),
+		Port:       6881,
+		Uploaded:   1,
+		Downloaded: 2,
+		Left:       3,
+		Event:      EventStarted,
+		NumWant:    50,
+		Key:        0xbeef,
+		TrackerID:  &trackerID,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "passkey=42&info_hash=%00%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12~&peer_id=-GT0001-0123456789ab&port=6881&uploaded=1&downloaded=2&left=3&compact=1&key=beef&numwant=50&event=started&trackerid=a%20b", query)
+	assert.Equal(t, "67.215.246.202:6881", rsp.Peers[0].String())
+	assert.Equal(t, "xyz", *rsp.TrackerID)
+
+	_, err = c.Announce(context.Background(), &AnnounceReq{Event: EventStopped, NumWant: -1})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unknown peer", failure.Reason)
+	assert.Equal(t, bcodec.RetryNever, *failure.RetryIn)
+	assert.NotContains(t, query, "numwant")
+}
+
+// tracker client recording announces
+type fakeClient struct {
+	mtx    sync.Mutex
+	events []Event
+	errs   []error
+	rsp    *bcodec.TrackerRsp
+	// announces other than stopped hang till ctx is done
+	hang bool
+}
+
+func (c *fakeClient) Announce(ctx context.Context, req *AnnounceReq) (*bcodec.TrackerRsp, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.events = append(c.events, req.Event)
+	if c.hang && req.Event != EventStopped {
+		c.mtx.Unlock()
+		<-ctx.Done()
+		c.mtx.Lock()
+		return nil, ctx.Err()
+	}
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return c.rsp, nil
+}
+
+func (c *fakeClient) Scrape(ctx context.Context, infoHashes ...[]byte) (*bcodec.ScrapeRsp, error) {
+	return nil, ErrUnsupported
+}
+
+func (c *fakeClient) announced() []Event {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return append([]Event{}, c.events...)
+}
+
+func TestAnnouncerRun(t *testing.T) {
+	interval := time.Hour
+	client := &fakeClient{
+		errs: []error{errors.New("boom"), errors.New("boom")},
+		rsp:  &bcodec.TrackerRsp{PollInterval: &interval},
+	}
+	var left int64 = 100
+	a := &Announcer{
+		Client:     client,
+		Stats:      func() Stats { return Stats{Left: left} },
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	completed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx, completed)
+	}()
+	// started is retried till it succeeds
+	assert.Eventually(t, func() bool { return len(client.announced()) == 3 }, time.Second, time.Millisecond)
+	close(completed)
+	assert.Eventually(t, func() bool { return len(client.announced()) == 4 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	assert.Equal(t, []Event{EventStarted, EventStarted, EventStarted, EventCompleted, EventStopped}, client.announced())
+}
+
+func TestAnnouncerRunRetryNever(t *testing.T) {
+	never := bcodec.RetryNever
+	client := &fakeClient{errs: []error{&FailureError{Reason: "banned", RetryIn: &never}}}
+	var errs []error
+	a := &Announcer{
+		Client:     client,
+		OnAnnounce: func(rsp *bcodec.TrackerRsp, err error) { errs = append(errs, err) },
+	}
+	// returns right away without stopped event
+	a.Run(context.Background(), nil)
+	assert.Equal(t, []Event{EventStarted}, client.announced())
+	assert.Equal(t, 1, len(errs))
+}
+
+func TestAnnouncerRunCancelledDuringAnnounce(t *testing.T) {
+	client := &fakeClient{hang: true, rsp: &bcodec.TrackerRsp{}}
+	a := &Announcer{Client: client}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx, nil)
+	}()
+	assert.Eventually(t, func() bool { return len(client.announced()) == 1 }, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	// started may have reached tracker, so it's told we stop
+	assert.Equal(t, []Event{EventStarted, EventStopped}, client.announced())
+}
+
+func TestAnnouncerTimeout(t *testing.T) {
+	client := &fakeClient{hang: true}
+	errs := make(chan error, 10)
+	a := &Announcer{Client: client, Timeout: time.Millisecond, OnAnnounce: func(rsp *bcodec.TrackerRsp, err error) { errs <- err }}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Run(ctx, nil)
+	}()
+	// tracker not answering fails the announce rather than keeping it pending
+	assert.ErrorIs(t, <-errs, context.DeadlineExceeded)
+	cancel()
+	<-done
+}
+
+func TestNextAnnounce(t *testing.T) {
+	a := &Announcer{}
+	interval, minInterval, retryIn := 30*time.Second, time.Minute, 5*time.Minute
+	assert.Equal(t, defaultInterval, a.nextAnnounce(&bcodec.TrackerRsp{}, nil, 0))
+	assert.Equal(t, interval, a.nextAnnounce(&bcodec.TrackerRsp{PollInterval: &interval}, nil, 0))
+	// never announce more often than min interval
+	assert.Equal(t, minInterval, a.nextAnnounce(&bcodec.TrackerRsp{PollInterval: &interval, MinPollInterval: &minInterval}, nil, 0))
+	assert.Equal(t, retryIn, a.nextAnnounce(nil, &FailureError{RetryIn: &retryIn}, 1))
+	// immediate retry is held off for min backoff
+	var now time.Duration
+	assert.Equal(t, defaultMinBackoff, a.nextAnnounce(nil, &FailureError{RetryIn: &now}, 1))
+	assert.Equal(t, time.Second, (&Announcer{MinBackoff: time.Second}).nextAnnounce(nil, &FailureError{RetryIn: &now}, 5))
+	assert.Equal(t, defaultMinBackoff, a.nextAnnounce(nil, errors.New("boom"), 1))
+	assert.Equal(t, 4*defaultMinBackoff, a.nextAnnounce(nil, errors.New("boom"), 3))
+	assert.Equal(t, defaultMaxBackoff, a.nextAnnounce(nil, errors.New("boom"), 100))
+}
@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/anacrolix/torrent/bencode"
+	"wuyrush.io/gtr/bcodec"
+)
+
+// upper bound of tracker response body we're willing to read
+const maxRspBytes = 16 << 20
+
+/*
+ScrapeURL derives scrape URL from announce URL.
+
+By convention the last path segment of announce URL must start with "announce", which is then replaced with
+"scrape", e.g. http://tracker.net/x/announce.php?k=v becomes http://tracker.net/x/scrape.php?k=v.
+ErrUnsupported is returned if announce URL doesn't follow the convention.
+*/
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", fmt.Errorf("malformed announce url: %w", err)
+	}
+	idx := strings.LastIndexByte(u.Path, '/')
+	if idx < 0 || !strings.HasPrefix(u.Path[idx+1:], "announce") {
+		return "", fmt.Errorf("can't derive scrape url from %s: %w", announceURL, ErrUnsupported)
+	}
+	u.Path = u.Path[:idx+1] + "scrape" + strings.TrimPrefix(u.Path[idx+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+/*
+Scrape asks HTTP tracker with announceURL for swarm statistics of torrents with infoHashes in a single request.
+All torrents known by tracker are scraped if infoHashes is empty, though many trackers disallow it.
+
+Failure reason in tracker response is surfaced as *FailureError.
+*/
+func Scrape(ctx context.Context, client *http.Client, announceURL string, infoHashes ...[]byte) (*bcodec.ScrapeRsp, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	params := make([]string, 0, len(infoHashes))
+	for _, h := range infoHashes {
+		params = append(params, "info_hash="+escapeBytes(h))
+	}
+	rsp := &bcodec.ScrapeRsp{}
+	if err := get(ctx, client, withQuery(scrapeURL, strings.Join(params, "&")), rsp); err != nil {
+		return nil, err
+	}
+	if rsp.FailureReason != nil {
+		return nil, &FailureError{Reason: *rsp.FailureReason}
+	}
+	return rsp, nil
+}
+
+// appends encoded query to the query of rawURL if any
+func withQuery(rawURL string, query string) string {
+	if query == "" {
+		return rawURL
+	}
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query
+	}
+	return rawURL + "?" + query
+}
+
+// sends GET request to HTTP tracker and decodes bencoded response into target
+func get(ctx context.Context, client *http.Client, rawURL string, target bencode.Unmarshaler) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating tracker request: %w", err)
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending tracker request: %w", err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, maxRspBytes))
+	if err != nil {
+		return fmt.Errorf("error reading tracker response: %w", err)
+	}
+	if err := bencode.Unmarshal(body, target); err != nil {
+		if rsp.StatusCode != http.StatusOK {
+			return fmt.Errorf("tracker responded with status %s", rsp.Status)
+		}
+		return fmt.Errorf("error decoding tracker response: %w", err)
+	}
+	return nil
+}
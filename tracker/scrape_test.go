@@ -0,0 +1,72 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tcs := []struct {
+		announce string
+		expected string
+		err      bool
+	}{
+		{announce: "http://example.com/announce", expected: "http://example.com/scrape"},
+		{announce: "http://example.com/x/announce", expected: "http://example.com/x/scrape"},
+		{announce: "http://example.com/announce.php", expected: "http://example.com/scrape.php"},
+		{announce: "http://example.com/announce?x2%0644", expected: "http://example.com/scrape?x2%0644"},
+		{announce: "http://example.com/announce?x=2/4", expected: "http://example.com/scrape?x=2/4"},
+		{announce: "http://example.com/x%064announce", err: true},
+		{announce: "http://example.com/a", err: true},
+		{announce: "http://example.com/announce?x=2/4/announce", expected: "http://example.com/scrape?x=2/4/announce"},
+		{announce: "http://example.com/announce/x", err: true},
+	}
+	for _, c := range tcs {
+		c := c
+		t.Run(c.announce, func(t *testing.T) {
+			t.Parallel()
+			actual, err := ScrapeURL(c.announce)
+			if c.err {
+				assert.True(t, errors.Is(err, ErrUnsupported))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, c.expected, actual)
+		})
+	}
+}
+
+func TestScrape(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/scrape", r.URL.Path)
+		query = r.URL.RawQuery
+		if len(r.URL.Query()["info_hash"]) == 0 {
+			w.Write([]byte("d14:failure reason18:full scrape deniede"))
+			return
+		}
+		w.Write([]byte("d5:filesd20:\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09 \x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13d8:completei5e10:downloadedi50e10:incompletei10eee5:flagsd20:min_request_intervali900eee"))
+	}))
+	defer srv.Close()
+
+	h1 := []byte("\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09 \x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13")
+	h2 := []byte("aaaaaaaaaaaaaaaaaaaa")
+	rsp, err := Scrape(context.Background(), srv.Client(), srv.URL+"/announce", h1, h2)
+	assert.Nil(t, err)
+	assert.Equal(t, "info_hash=%00%01%02%03%04%05%06%07%08%09%20%0B%0C%0D%0E%0F%10%11%12%13&info_hash=aaaaaaaaaaaaaaaaaaaa", query)
+	assert.Equal(t, int64(5), rsp.Stats(h1).SeederCnt)
+	assert.Equal(t, int64(50), rsp.Stats(h1).CompletedCnt)
+	assert.Equal(t, int64(10), rsp.Stats(h1).LeecherCnt)
+	assert.Nil(t, rsp.Stats(h2))
+	assert.Equal(t, int64(900), int64(rsp.MinRequestInterval.Seconds()))
+
+	_, err = Scrape(context.Background(), srv.Client(), srv.URL+"/announce")
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "full scrape denied", failure.Reason)
+}
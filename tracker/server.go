@@ -0,0 +1,244 @@
+package tracker
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+const (
+	defaultServerInterval    = 30 * time.Minute
+	defaultServerMinInterval = time.Minute
+	defaultServerNumWant     = 50
+	maxServerNumWant         = 200
+)
+
+var (
+	// torrent isn't in the allowlist of tracker
+	ErrTorrentNotAllowed = errors.New("torrent not allowed by tracker")
+	// announce request misses or has malformed parameters
+	ErrInvalidAnnounce = errors.New("invalid announce request")
+)
+
+// options of tracker server
+type ServerOpts struct {
+	// announce interval asked from clients
+	Interval    time.Duration
+	MinInterval time.Duration
+	// peers which haven't announced for this long are dropped; twice of Interval if not positive
+	PeerTTL time.Duration
+	// info hashes of torrents the server tracks; any torrent is tracked if empty
+	Allowlist [][]byte
+}
+
+/*
+Server is a bittorrent tracker serving both HTTP and UDP clients out of an in-memory swarm registry.
+
+It's goroutine safe.
+*/
+type Server struct {
+	interval    time.Duration
+	minInterval time.Duration
+	peerTTL     time.Duration
+	allowlist   map[string]struct{}
+	// secret to derive UDP connection ids from
+	secret []byte
+	// returns current time, for tests to override
+	now func() time.Time
+
+	// mutex guarding states below
+	mtx sync.Mutex
+	// swarms keyed by info hash
+	swarms    map[string]*swarm
+	lastSweep time.Time
+}
+
+// peers of a torrent
+type swarm struct {
+	// peers keyed by peer id
+	peers map[string]*swarmPeer
+	// # times download completion is announced
+	completedCnt int64
+}
+
+type swarmPeer struct {
+	bcodec.Peer
+	left     int64
+	lastSeen time.Time
+}
+
+func NewServer(opts *ServerOpts) *Server {
+	if opts == nil {
+		opts = &ServerOpts{}
+	}
+	x := &Server{
+		interval:    opts.Interval,
+		minInterval: opts.MinInterval,
+		peerTTL:     opts.PeerTTL,
+		secret:      make([]byte, 16),
+		now:         time.Now,
+		swarms:      make(map[string]*swarm),
+	}
+	if x.interval <= 0 {
+		x.interval = defaultServerInterval
+	}
+	if x.minInterval <= 0 || x.minInterval > x.interval {
+		x.minInterval = defaultServerMinInterval
+		if x.minInterval > x.interval {
+			x.minInterval = x.interval
+		}
+	}
+	if x.peerTTL <= 0 {
+		x.peerTTL = 2 * x.interval
+	}
+	if len(opts.Allowlist) > 0 {
+		x.allowlist = make(map[string]struct{}, len(opts.Allowlist))
+		for _, h := range opts.Allowlist {
+			x.allowlist[string(h)] = struct{}{}
+		}
+	}
+	if _, err := crand.Read(x.secret); err != nil {
+		panic(err)
+	}
+	return x
+}
+
+/*
+Registers announce of peer listening at addr, and returns peers of the same swarm for it to connect to.
+
+Peers returned are picked at random and never include the announcing peer.
+*/
+func (x *Server) announce(req *AnnounceReq, addr netip.AddrPort) (*bcodec.TrackerRsp, error) {
+	if len(req.InfoHash) != 20 || len(req.PeerID) != 20 || !addr.IsValid() || addr.Port() == 0 {
+		return nil, ErrInvalidAnnounce
+	}
+	if !x.allowed(req.InfoHash) {
+		return nil, ErrTorrentNotAllowed
+	}
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	now := x.now()
+	x.sweep(now)
+	s := x.swarms[string(req.InfoHash)]
+	if s == nil {
+		s = &swarm{peers: make(map[string]*swarmPeer)}
+		x.swarms[string(req.InfoHash)] = s
+	}
+	if req.Event == EventStopped {
+		delete(s.peers, string(req.PeerID))
+	} else {
+		s.peers[string(req.PeerID)] = &swarmPeer{
+			Peer:     bcodec.Peer{AddrPort: addr, ID: req.PeerID},
+			left:     req.Left,
+			lastSeen: now,
+		}
+		if req.Event == EventCompleted {
+			s.completedCnt++
+		}
+	}
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = defaultServerNumWant
+	} else if numWant > maxServerNumWant {
+		numWant = maxServerNumWant
+	}
+	interval, minInterval := x.interval, x.minInterval
+	seederCnt, leecherCnt := s.counts()
+	rsp := &bcodec.TrackerRsp{
+		PollInterval:    &interval,
+		MinPollInterval: &minInterval,
+		SeederCnt:       &seederCnt,
+		LeecherCnt:      &leecherCnt,
+		// peers key is mandatory
+		Peers: []*bcodec.Peer{},
+	}
+	if req.Event == EventStopped {
+		return rsp, nil
+	}
+	candidates := make([]*bcodec.Peer, 0, len(s.peers))
+	for id, p := range s.peers {
+		// seeders don't need each other
+		if id == string(req.PeerID) || req.Left == 0 && p.left == 0 {
+			continue
+		}
+		p := p.Peer
+		candidates = append(candidates, &p)
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+	rsp.Peers = append(rsp.Peers, candidates...)
+	return rsp, nil
+}
+
+// returns swarm statistics of torrents with infoHashes, or all torrents tracked if infoHashes is empty
+func (x *Server) scrape(infoHashes [][]byte) *bcodec.ScrapeRsp {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	x.sweep(x.now())
+	rsp := &bcodec.ScrapeRsp{Files: make(map[string]*bcodec.ScrapeStats)}
+	stats := func(s *swarm) *bcodec.ScrapeStats {
+		seederCnt, leecherCnt := s.counts()
+		return &bcodec.ScrapeStats{SeederCnt: int64(seederCnt), CompletedCnt: s.completedCnt, LeecherCnt: int64(leecherCnt)}
+	}
+	if len(infoHashes) == 0 {
+		for h, s := range x.swarms {
+			rsp.Files[h] = stats(s)
+		}
+		return rsp
+	}
+	for _, h := range infoHashes {
+		if !x.allowed(h) {
+			continue
+		}
+		if s := x.swarms[string(h)]; s != nil {
+			rsp.Files[string(h)] = stats(s)
+		} else {
+			rsp.Files[string(h)] = &bcodec.ScrapeStats{}
+		}
+	}
+	return rsp
+}
+
+func (x *Server) allowed(infoHash []byte) bool {
+	if x.allowlist == nil {
+		return true
+	}
+	_, ok := x.allowlist[string(infoHash)]
+	return ok
+}
+
+// drops expired peers and empty swarms, at most 4 times per peer TTL. Caller must hold x.mtx.
+func (x *Server) sweep(now time.Time) {
+	if now.Sub(x.lastSweep) < x.peerTTL/4 {
+		return
+	}
+	x.lastSweep = now
+	for h, s := range x.swarms {
+		for id, p := range s.peers {
+			if now.Sub(p.lastSeen) > x.peerTTL {
+				delete(s.peers, id)
+			}
+		}
+		if len(s.peers) == 0 && s.completedCnt == 0 {
+			delete(x.swarms, h)
+		}
+	}
+}
+
+func (s *swarm) counts() (seederCnt int, leecherCnt int) {
+	for _, p := range s.peers {
+		if p.left == 0 {
+			seederCnt++
+		} else {
+			leecherCnt++
+		}
+	}
+	return seederCnt, leecherCnt
+}
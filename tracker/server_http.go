@@ -0,0 +1,91 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+
+	"github.com/anacrolix/torrent/bencode"
+	"wuyrush.io/gtr/bcodec"
+)
+
+/*
+ServeHTTP serves announce requests at path /announce and scrape requests at path /scrape.
+
+Peers are always returned in binary mode, IPv6 ones in peers6 as per BEP 7. Client-supplied ip parameter is
+ignored; peers are registered with the address the request comes from.
+*/
+func (x *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var rsp bencode.Marshaler
+	switch r.URL.Path {
+	case "/announce":
+		rsp = x.serveHTTPAnnounce(r)
+	case "/scrape":
+		q := r.URL.Query()
+		var infoHashes [][]byte
+		for _, h := range q["info_hash"] {
+			infoHashes = append(infoHashes, []byte(h))
+		}
+		rsp = x.scrape(infoHashes)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	b, err := bencode.Marshal(rsp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
+
+func (x *Server) serveHTTPAnnounce(r *http.Request) *bcodec.TrackerRsp {
+	failure := func(reason string) *bcodec.TrackerRsp {
+		return &bcodec.TrackerRsp{FailureReason: &reason}
+	}
+	q := r.URL.Query()
+	req := &AnnounceReq{
+		InfoHash: []byte(q.Get("info_hash")),
+		PeerID:   []byte(q.Get("peer_id")),
+		Event:    Event(q.Get("event")),
+		NumWant:  -1,
+	}
+	if _, ok := udpEvents[req.Event]; !ok {
+		return failure("unknown event " + string(req.Event))
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil {
+		return failure("invalid port")
+	}
+	req.Port = uint16(port)
+	for k, v := range map[string]*int64{"uploaded": &req.Uploaded, "downloaded": &req.Downloaded, "left": &req.Left} {
+		if s := q.Get(k); s != "" {
+			if *v, err = strconv.ParseInt(s, 10, 64); err != nil || *v < 0 {
+				return failure("invalid " + k)
+			}
+		}
+	}
+	if s := q.Get("numwant"); s != "" {
+		if req.NumWant, err = strconv.Atoi(s); err != nil {
+			return failure("invalid numwant")
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return failure("unknown client address")
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return failure("unknown client address")
+	}
+	rsp, err := x.announce(req, netip.AddrPortFrom(addr.Unmap(), req.Port))
+	if errors.Is(err, ErrInvalidAnnounce) {
+		return failure("missing or malformed info_hash, peer_id or port")
+	} else if err != nil {
+		return failure(err.Error())
+	}
+	return rsp
+}
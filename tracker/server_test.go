@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+func testPeerID(i byte) []byte {
+	return append([]byte("-GT0001-01234567890"), i)
+}
+
+func TestServerHTTP(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	srv := NewServer(&ServerOpts{Interval: time.Hour, Allowlist: [][]byte{infoHash}})
+	hsrv := httptest.NewServer(srv)
+	defer hsrv.Close()
+	c := &HTTPClient{HTTP: hsrv.Client(), URL: hsrv.URL + "/announce"}
+	ctx := context.Background()
+
+	rsp, err := c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(1), Port: 6881, Left: 0, Event: EventStarted, NumWant: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, *rsp.PollInterval)
+	assert.Equal(t, time.Minute, *rsp.MinPollInterval)
+	assert.Equal(t, 0, len(rsp.Peers))
+	rsp, err = c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(2), Port: 6882, Left: 10, Event: EventStarted, NumWant: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, *rsp.SeederCnt)
+	assert.Equal(t, 1, *rsp.LeecherCnt)
+	assert.Equal(t, bcodec.PeerAddrs{"127.0.0.1:6881"}, rsp.PeerAddrs)
+	_, err = c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(2), Port: 6882, Event: EventCompleted, NumWant: -1})
+	assert.Nil(t, err)
+	rsp, err = c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(1), Port: 6881, Event: EventStopped, NumWant: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, *rsp.SeederCnt)
+	assert.Equal(t, 0, *rsp.LeecherCnt)
+
+	// torrent outside allowlist
+	_, err = c.Announce(ctx, &AnnounceReq{InfoHash: bytes.Repeat([]byte{2}, 20), PeerID: testPeerID(1), Port: 6881, NumWant: -1})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, ErrTorrentNotAllowed.Error(), failure.Reason)
+
+	srsp, err := c.Scrape(ctx, infoHash, bytes.Repeat([]byte{2}, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, &bcodec.ScrapeStats{SeederCnt: 1, CompletedCnt: 1}, srsp.Stats(infoHash))
+	assert.Nil(t, srsp.Stats(bytes.Repeat([]byte{2}, 20)))
+}
+
+func TestServerUDP(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	srv := NewServer(nil)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan error)
+	go func() { done <- srv.ServeUDP(conn) }()
+	c := &UDPClient{URL: "udp://" + conn.LocalAddr().String(), Timeout: 100 * time.Millisecond}
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err = c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(1), Port: 6881, Left: 10, Event: EventStarted, NumWant: -1})
+	assert.Nil(t, err)
+	rsp, err := c.Announce(ctx, &AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(2), Port: 6882, Left: 10, Event: EventStarted, NumWant: -1})
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Minute, *rsp.PollInterval)
+	assert.Equal(t, 2, *rsp.LeecherCnt)
+	assert.Equal(t, bcodec.PeerAddrs{"127.0.0.1:6881"}, rsp.PeerAddrs)
+	srsp, err := c.Scrape(ctx, infoHash)
+	assert.Nil(t, err)
+	assert.Equal(t, &bcodec.ScrapeStats{LeecherCnt: 2}, srsp.Stats(infoHash))
+
+	// forged connection id is rejected
+	c.connID++
+	_, err = c.Scrape(ctx, infoHash)
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+
+	conn.Close()
+	assert.Nil(t, <-done)
+}
+
+func TestServerPeerExpiry(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{1}, 20)
+	now := time.Now()
+	srv := NewServer(&ServerOpts{Interval: time.Minute})
+	srv.now = func() time.Time { return now }
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	_, err := srv.announce(&AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(1), Left: 10, NumWant: -1}, addr)
+	assert.Nil(t, err)
+	now = now.Add(90 * time.Second)
+	rsp, err := srv.announce(&AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(2), Left: 10, NumWant: -1}, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rsp.Peers))
+	// the first peer hasn't announced for longer than 2 intervals
+	now = now.Add(45 * time.Second)
+	rsp, err = srv.announce(&AnnounceReq{InfoHash: infoHash, PeerID: testPeerID(2), Left: 10, NumWant: -1}, addr)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(rsp.Peers))
+	assert.Equal(t, 1, *rsp.LeecherCnt)
+	// empty swarms are dropped
+	now = now.Add(time.Hour)
+	assert.Nil(t, srv.scrape(nil).Stats(infoHash))
+}
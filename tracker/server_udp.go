@@ -0,0 +1,142 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+// # past minutes in which issued UDP connection ids are still accepted
+const udpConnIDWindows = 2
+
+/*
+ServeUDP serves UDP tracker protocol (BEP 15) on conn until conn is closed.
+
+Connection ids are derived from client address and time rather than stored, so that they cost no memory.
+*/
+func (x *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxUDPPacketBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if rsp := x.handleUDP(buf[:n], udpAddr.AddrPort()); rsp != nil {
+			conn.WriteTo(rsp, addr)
+		}
+	}
+}
+
+// handles UDP tracker request from addr and returns the response, or nil if request should be ignored
+func (x *Server) handleUDP(req []byte, addr netip.AddrPort) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID, action, tid := binary.BigEndian.Uint64(req), binary.BigEndian.Uint32(req[8:]), req[12:16]
+	ip := addr.Addr().Unmap()
+	rsp := appendUint32(nil, action)
+	rsp = append(rsp, tid...)
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		return appendUint64(rsp, x.udpConnID(ip, 0))
+	}
+	fail := func(reason string) []byte {
+		return append(append(appendUint32(nil, udpActionError), tid...), reason...)
+	}
+	if !x.validUDPConnID(ip, connID) {
+		return fail("invalid connection id")
+	}
+	switch action {
+	case udpActionAnnounce:
+		if len(req) < 98 {
+			return fail("malformed announce request")
+		}
+		var event Event
+		found := false
+		for e, v := range udpEvents {
+			if v == binary.BigEndian.Uint32(req[80:]) {
+				event, found = e, true
+			}
+		}
+		if !found {
+			return fail("unknown event")
+		}
+		areq := &AnnounceReq{
+			InfoHash:   append([]byte{}, req[16:36]...),
+			PeerID:     append([]byte{}, req[36:56]...),
+			Downloaded: int64(binary.BigEndian.Uint64(req[56:])),
+			Left:       int64(binary.BigEndian.Uint64(req[64:])),
+			Uploaded:   int64(binary.BigEndian.Uint64(req[72:])),
+			Event:      event,
+			Key:        binary.BigEndian.Uint32(req[88:]),
+			NumWant:    int(int32(binary.BigEndian.Uint32(req[92:]))),
+			Port:       binary.BigEndian.Uint16(req[96:]),
+		}
+		arsp, err := x.announce(areq, netip.AddrPortFrom(ip, areq.Port))
+		if err != nil {
+			return fail(err.Error())
+		}
+		rsp = appendUint32(rsp, uint32(arsp.PollInterval.Seconds()))
+		rsp = appendUint32(rsp, uint32(*arsp.LeecherCnt))
+		rsp = appendUint32(rsp, uint32(*arsp.SeederCnt))
+		// only peers of the same address family as client can be returned
+		v4, v6 := bcodec.EncodeCompactPeers(arsp.Peers)
+		if ip.Is4() {
+			return append(rsp, v4...)
+		}
+		return append(rsp, v6...)
+	case udpActionScrape:
+		var infoHashes [][]byte
+		for i := 16; i+20 <= len(req) && len(infoHashes) < maxUDPScrapeCnt; i += 20 {
+			infoHashes = append(infoHashes, req[i:i+20])
+		}
+		if len(infoHashes) == 0 {
+			return fail("no info hash to scrape")
+		}
+		srsp := x.scrape(infoHashes)
+		for _, h := range infoHashes {
+			stats := srsp.Stats(h)
+			if stats == nil {
+				stats = &bcodec.ScrapeStats{}
+			}
+			rsp = appendUint32(rsp, uint32(stats.SeederCnt))
+			rsp = appendUint32(rsp, uint32(stats.CompletedCnt))
+			rsp = appendUint32(rsp, uint32(stats.LeecherCnt))
+		}
+		return rsp
+	default:
+		return fail("unknown action")
+	}
+}
+
+// derives connection id of client with ip, issued the given # minutes ago
+func (x *Server) udpConnID(ip netip.Addr, minutesAgo int64) uint64 {
+	window := x.now().Unix()/60 - minutesAgo
+	b := ip.As16()
+	h := sha1.New()
+	h.Write(x.secret)
+	h.Write(b[:])
+	h.Write(appendUint64(nil, uint64(window)))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (x *Server) validUDPConnID(ip netip.Addr, connID uint64) bool {
+	for i := int64(0); i <= udpConnIDWindows; i++ {
+		if x.udpConnID(ip, i) == connID {
+			return true
+		}
+	}
+	return false
+}
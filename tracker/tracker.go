@@ -0,0 +1,63 @@
+// Package tracker implements clients and server of bittorrent trackers.
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tracker doesn't support the requested operation, e.g. scrape
+var ErrUnsupported = errors.New("operation not supported by tracker")
+
+// failure reason reported by tracker in its response
+type FailureError struct {
+	Reason string
+	// BEP 31 retry hint, see bcodec.TrackerRsp.RetryIn
+	RetryIn *time.Duration
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("tracker failure: %s", e.Reason)
+}
+
+/*
+NewClient creates client of tracker with announceURL. HTTP trackers are accessed with httpClient.
+
+Client should be closed if it implements io.Closer once it's no longer used.
+*/
+func NewClient(announceURL string, httpClient *http.Client) (Client, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed announce url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPClient{HTTP: httpClient, URL: announceURL}, nil
+	case "udp":
+		return &UDPClient{URL: announceURL}, nil
+	default:
+		return nil, fmt.Errorf("tracker scheme %q: %w", u.Scheme, ErrUnsupported)
+	}
+}
+
+// percent-encodes every byte of b except unreserved characters as per RFC 3986. Unlike url.QueryEscape
+// space is encoded as %20 since some trackers don't decode '+' in binary parameters.
+func escapeBytes(b []byte) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	sb.Grow(3 * len(b))
+	for _, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('%')
+		sb.WriteByte(hex[c>>4])
+		sb.WriteByte(hex[c&0xf])
+	}
+	return sb.String()
+}
@@ -0,0 +1,334 @@
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"wuyrush.io/gtr/bcodec"
+)
+
+// BEP 15 actions
+const (
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+)
+
+const (
+	// magic connection id of connect requests
+	udpProtocolID uint64 = 0x41727101980
+	// connection id can be used by client for 1 minute after it's received
+	udpConnIDTTL = time.Minute
+	// base retransmission timeout, doubled after every retransmission
+	defaultUDPTimeout = 15 * time.Second
+	// retransmission stops after timeout reaches 15 * 2 ^ 8 seconds
+	defaultUDPMaxRetries = 8
+	// max # info hashes in a single scrape request so that the request fits in a UDP packet
+	maxUDPScrapeCnt   = 74
+	maxUDPPacketBytes = 64 << 10
+)
+
+// numeric announce events of UDP tracker protocol
+var udpEvents = map[Event]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// client of UDP tracker, see BEP 15
+type UDPClient struct {
+	// announce url in form of udp://host:port[/path]
+	URL string
+	// base retransmission timeout and max # retransmissions; BEP 15 defaults are used if zero
+	Timeout    time.Duration
+	MaxRetries int
+
+	// mutex serializing exchanges with tracker and guarding states below
+	mtx          sync.Mutex
+	conn         net.Conn
+	connID       uint64
+	connIDExpiry time.Time
+}
+
+/*
+Announce sends announce request to tracker, connecting to it first if we don't have a valid connection id.
+
+Error action of tracker is surfaced as *FailureError.
+*/
+func (c *UDPClient) Announce(ctx context.Context, req *AnnounceReq) (*bcodec.TrackerRsp, error) {
+	event, ok := udpEvents[req.Event]
+	if !ok {
+		return nil, fmt.Errorf("unknown announce event %q", req.Event)
+	}
+	if len(req.InfoHash) != 20 || len(req.PeerID) != 20 {
+		return nil, fmt.Errorf("info hash and peer id must be 20 bytes long")
+	}
+	numWant := int32(-1)
+	if req.NumWant >= 0 {
+		numWant = int32(req.NumWant)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	rsp, err := c.roundTrip(ctx, udpActionAnnounce, func(b []byte) []byte {
+		b = append(b, req.InfoHash...)
+		b = append(b, req.PeerID...)
+		b = appendUint64(b, uint64(req.Downloaded))
+		b = appendUint64(b, uint64(req.Left))
+		b = appendUint64(b, uint64(req.Uploaded))
+		b = appendUint32(b, event)
+		// let tracker use the source address of the packet
+		b = appendUint32(b, 0)
+		b = appendUint32(b, req.Key)
+		b = appendUint32(b, uint32(numWant))
+		return appendUint16(b, req.Port)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) < 12 {
+		return nil, fmt.Errorf("announce response of UDP tracker is too short: %d bytes", len(rsp))
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(rsp[0:4])) * time.Second
+	leecherCnt := int(binary.BigEndian.Uint32(rsp[4:8]))
+	seederCnt := int(binary.BigEndian.Uint32(rsp[8:12]))
+	// peers have the same address family as tracker
+	addrLen := 4
+	if raddr, ok := c.conn.RemoteAddr().(*net.UDPAddr); ok && raddr.IP.To4() == nil {
+		addrLen = 16
+	}
+	peers, err := bcodec.DecodeCompactPeers(rsp[12:], addrLen)
+	if err != nil {
+		return nil, err
+	}
+	res := &bcodec.TrackerRsp{
+		PollInterval: &interval,
+		SeederCnt:    &seederCnt,
+		LeecherCnt:   &leecherCnt,
+		Peers:        peers,
+	}
+	for _, p := range peers {
+		res.PeerAddrs = append(res.PeerAddrs, p.String())
+	}
+	return res, nil
+}
+
+// Scrape asks tracker for swarm statistics of torrents with infoHashes, in batches if there're many of them.
+func (c *UDPClient) Scrape(ctx context.Context, infoHashes ...[]byte) (*bcodec.ScrapeRsp, error) {
+	if len(infoHashes) == 0 {
+		return nil, fmt.Errorf("UDP tracker can't scrape all torrents: %w", ErrUnsupported)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := &bcodec.ScrapeRsp{Files: make(map[string]*bcodec.ScrapeStats, len(infoHashes))}
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > maxUDPScrapeCnt {
+			batch = batch[:maxUDPScrapeCnt]
+		}
+		infoHashes = infoHashes[len(batch):]
+		for _, h := range batch {
+			if len(h) != 20 {
+				return nil, fmt.Errorf("info hash must be 20 bytes long")
+			}
+		}
+		rsp, err := c.roundTrip(ctx, udpActionScrape, func(b []byte) []byte {
+			for _, h := range batch {
+				b = append(b, h...)
+			}
+			return b
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(rsp) < 12*len(batch) {
+			return nil, fmt.Errorf("scrape response of UDP tracker is too short: %d bytes for %d torrents", len(rsp), len(batch))
+		}
+		for i, h := range batch {
+			entry := rsp[12*i:]
+			res.Files[string(h)] = &bcodec.ScrapeStats{
+				SeederCnt:    int64(binary.BigEndian.Uint32(entry[0:4])),
+				CompletedCnt: int64(binary.BigEndian.Uint32(entry[4:8])),
+				LeecherCnt:   int64(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+	return res, nil
+}
+
+// Close releases the socket used to talk to tracker.
+func (c *UDPClient) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+/*
+Sends request of action to tracker, retransmitting it as per BEP 15 till a response arrives, and returns the
+response payload following action and transaction id. appendBody appends the action-specific part of request.
+
+Tracker is connected first whenever we don't have a valid connection id. Caller must hold c.mtx.
+*/
+func (c *UDPClient) roundTrip(ctx context.Context, action uint32, appendBody func([]byte) []byte) ([]byte, error) {
+	if c.conn == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	timeout, maxRetries := c.Timeout, c.MaxRetries
+	if timeout <= 0 {
+		timeout = defaultUDPTimeout
+	}
+	if maxRetries <= 0 {
+		maxRetries = defaultUDPMaxRetries
+	}
+	buf := make([]byte, maxUDPPacketBytes)
+	for n := 0; n <= maxRetries; n++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout << n)
+		if time.Now().After(c.connIDExpiry) {
+			tid := newTransactionID()
+			req := appendUint32(appendUint64(make([]byte, 0, 16), udpProtocolID), udpActionConnect)
+			rsp, err := c.exchange(ctx, appendUint32(req, tid), tid, udpActionConnect, deadline, buf)
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if len(rsp) < 8 {
+				return nil, fmt.Errorf("connect response of UDP tracker is too short: %d bytes", len(rsp))
+			}
+			c.connID = binary.BigEndian.Uint64(rsp)
+			c.connIDExpiry = time.Now().Add(udpConnIDTTL)
+		}
+		tid := newTransactionID()
+		req := appendUint32(appendUint32(appendUint64(make([]byte, 0, 98), c.connID), action), tid)
+		rsp, err := c.exchange(ctx, appendBody(req), tid, action, deadline, buf)
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		var failure *FailureError
+		if errors.As(err, &failure) {
+			// tracker may have rejected an id it considers expired, so connect again next time
+			c.connIDExpiry = time.Time{}
+		}
+		return rsp, err
+	}
+	return nil, fmt.Errorf("UDP tracker didn't respond after %d retransmissions", maxRetries)
+}
+
+var errUDPTimeout = errors.New("UDP tracker response timed out")
+
+// sends req and waits till deadline for response with transaction id tid, ignoring unrelated packets
+func (c *UDPClient) exchange(ctx context.Context, req []byte, tid uint32, action uint32, deadline time.Time, buf []byte) ([]byte, error) {
+	ctxDeadline := false
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline, ctxDeadline = d, true
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	// unblock reading once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func(conn net.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}(c.conn)
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, c.ioErr(ctx, ctxDeadline, fmt.Errorf("error sending request to UDP tracker: %w", err))
+	}
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return nil, c.ioErr(ctx, ctxDeadline, fmt.Errorf("error reading response of UDP tracker: %w", err))
+		}
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != tid {
+			continue
+		}
+		switch got := binary.BigEndian.Uint32(buf[0:4]); got {
+		case action:
+			return append([]byte{}, buf[8:n]...), nil
+		case udpActionError:
+			return nil, &FailureError{Reason: string(buf[8:n])}
+		default:
+			return nil, fmt.Errorf("UDP tracker responded with action %d to action %d", got, action)
+		}
+	}
+}
+
+/*
+Translates I/O error to ctx error if ctx is done, or errUDPTimeout if it's due to retransmission deadline.
+ctxDeadline tells whether socket deadline was set to that of ctx.
+*/
+func (c *UDPClient) ioErr(ctx context.Context, ctxDeadline bool, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		if ctxDeadline {
+			// socket may time out slightly before ctx does
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return errUDPTimeout
+	}
+	return err
+}
+
+func (c *UDPClient) dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, fmt.Errorf("malformed announce url: %w", err)
+	}
+	if u.Scheme != "udp" || u.Port() == "" {
+		return nil, fmt.Errorf("announce url of UDP tracker must be in form of udp://host:port: %s", c.URL)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to UDP tracker: %w", err)
+	}
+	return conn, nil
+}
+
+func newTransactionID() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wuyrush.io/gtr/bcodec"
+)
+
+// in-process UDP tracker speaking just enough BEP 15 for tests
+type fakeUDPTracker struct {
+	conn net.PacketConn
+	// mutex guarding states below
+	mtx sync.Mutex
+	// # requests to drop before responding, to exercise retransmission
+	drops    int
+	connects int
+	actions  []uint32
+	// last announce request
+	announce []byte
+}
+
+const fakeConnID uint64 = 0xdeadbeef
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	x := &fakeUDPTracker{conn: conn}
+	go x.serve()
+	t.Cleanup(func() { conn.Close() })
+	return x
+}
+
+func (x *fakeUDPTracker) url() string {
+	return "udp://" + x.conn.LocalAddr().String() + "/announce"
+}
+
+func (x *fakeUDPTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := x.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if rsp := x.handle(buf[:n]); rsp != nil {
+			x.conn.WriteTo(rsp, addr)
+		}
+	}
+}
+
+// returns # connects, actions handled and the last announce request
+func (x *fakeUDPTracker) state() (int, []uint32, []byte) {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	return x.connects, append([]uint32{}, x.actions...), x.announce
+}
+
+func (x *fakeUDPTracker) handle(req []byte) []byte {
+	x.mtx.Lock()
+	defer x.mtx.Unlock()
+	if x.drops > 0 {
+		x.drops--
+		return nil
+	}
+	connID, action, tid := binary.BigEndian.Uint64(req), binary.BigEndian.Uint32(req[8:]), req[12:16]
+	x.actions = append(x.actions, action)
+	rsp := appendUint32(nil, action)
+	rsp = append(rsp, tid...)
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		x.connects++
+		return appendUint64(rsp, fakeConnID)
+	}
+	if connID != fakeConnID {
+		return append(appendUint32(nil, udpActionError), append(tid, "bad connection id"...)...)
+	}
+	switch action {
+	case udpActionAnnounce:
+		x.announce = append([]byte{}, req...)
+		if bytes.Equal(req[16:36], bytes.Repeat([]byte{0xff}, 20)) {
+			return append(appendUint32(nil, udpActionError), append(tid, "unregistered torrent"...)...)
+		}
+		rsp = appendUint32(rsp, 1800)
+		rsp = appendUint32(rsp, 2)
+		rsp = appendUint32(rsp, 1)
+		return append(rsp, 0x43, 0xd7, 0xf6, 0xca, 0x1a, 0xe1, 0xbe, 0x73, 0x1f, 0xda, 0x1a, 0xe3)
+	case udpActionScrape:
+		for i := 16; i+20 <= len(req); i += 20 {
+			rsp = appendUint32(appendUint32(appendUint32(rsp, uint32(req[i])), 10), 20)
+		}
+		return rsp
+	}
+	return nil
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	srv := newFakeUDPTracker(t)
+	c := &UDPClient{URL: srv.url(), Timeout: 10 * time.Millisecond}
+	defer c.Close()
+	req := &AnnounceReq{
+		InfoHash: bytes.Repeat([]byte{1}, 20),
+		PeerID:   []byte("-GT0001-0123456789ab"),
+		Port:     6881,
+		Left:     3,
+		Event:    EventStarted,
+		NumWant:  -1,
+		Key:      0xbeef,
+	}
+	rsp, err := c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 1800*time.Second, *rsp.PollInterval)
+	assert.Equal(t, 1, *rsp.SeederCnt)
+	assert.Equal(t, 2, *rsp.LeecherCnt)
+	assert.Equal(t, bcodec.PeerAddrs{"67.215.246.202:6881", "190.115.31.218:6883"}, rsp.PeerAddrs)
+	_, _, announce := srv.state()
+	assert.Equal(t, 98, len(announce))
+	// left, event, key, num want and port
+	assert.Equal(t, uint64(3), binary.BigEndian.Uint64(announce[64:72]))
+	assert.Equal(t, uint32(2), binary.BigEndian.Uint32(announce[80:84]))
+	assert.Equal(t, uint32(0xbeef), binary.BigEndian.Uint32(announce[88:92]))
+	assert.Equal(t, int32(-1), int32(binary.BigEndian.Uint32(announce[92:96])))
+	assert.Equal(t, uint16(6881), binary.BigEndian.Uint16(announce[96:98]))
+
+	// connection id is cached till it expires
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	connects, _, _ := srv.state()
+	assert.Equal(t, 1, connects)
+	c.connIDExpiry = time.Now().Add(-time.Second)
+	_, err = c.Announce(context.Background(), req)
+	assert.Nil(t, err)
+	connects, actions, _ := srv.state()
+	assert.Equal(t, 2, connects)
+	assert.Equal(t, []uint32{udpActionConnect, udpActionAnnounce, udpActionAnnounce, udpActionConnect, udpActionAnnounce}, actions)
+}
+
+func TestUDPAnnounceError(t *testing.T) {
+	srv := newFakeUDPTracker(t)
+	c := &UDPClient{URL: srv.url(), Timeout: 10 * time.Millisecond}
+	defer c.Close()
+	_, err := c.Announce(context.Background(), &AnnounceReq{
+		InfoHash: bytes.Repeat([]byte{0xff}, 20),
+		PeerID:   []byte("-GT0001-0123456789ab"),
+	})
+	var failure *FailureError
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, "unregistered torrent", failure.Reason)
+	// connection id is dropped after error
+	assert.True(t, c.connIDExpiry.IsZero())
+}
+
+func TestUDPRetransmission(t *testing.T) {
+	srv := newFakeUDPTracker(t)
+	srv.mtx.Lock()
+	srv.drops = 2
+	srv.mtx.Unlock()
+	c := &UDPClient{URL: srv.url(), Timeout: 10 * time.Millisecond, MaxRetries: 3}
+	defer c.Close()
+	rsp, err := c.Scrape(context.Background(), bytes.Repeat([]byte{7}, 20), bytes.Repeat([]byte{9}, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, &bcodec.ScrapeStats{SeederCnt: 7, CompletedCnt: 10, LeecherCnt: 20}, rsp.Stats(bytes.Repeat([]byte{7}, 20)))
+	assert.Equal(t, &bcodec.ScrapeStats{SeederCnt: 9, CompletedCnt: 10, LeecherCnt: 20}, rsp.Stats(bytes.Repeat([]byte{9}, 20)))
+
+	// gives up once retransmissions are exhausted
+	srv.mtx.Lock()
+	srv.drops = 100
+	srv.mtx.Unlock()
+	_, err = c.Scrape(context.Background(), bytes.Repeat([]byte{7}, 20))
+	assert.NotNil(t, err)
+	// or ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.MaxRetries = 8
+	_, err = c.Scrape(ctx, bytes.Repeat([]byte{7}, 20))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestUDPScrapeBatches(t *testing.T) {
+	srv := newFakeUDPTracker(t)
+	c := &UDPClient{URL: srv.url(), Timeout: 10 * time.Millisecond}
+	defer c.Close()
+	var hashes [][]byte
+	for i := 0; i < maxUDPScrapeCnt+1; i++ {
+		hashes = append(hashes, bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	rsp, err := c.Scrape(context.Background(), hashes...)
+	assert.Nil(t, err)
+	assert.Equal(t, maxUDPScrapeCnt+1, len(rsp.Files))
+	_, actions, _ := srv.state()
+	assert.Equal(t, []uint32{udpActionConnect, udpActionScrape, udpActionScrape}, actions)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"wuyrush.io/gtr/bcodec"
+	"wuyrush.io/gtr/storage"
+)
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gtr verify [options] <file.torrent> <dir>\n\nVerifies content of torrent saved under dir against its piece hashes.\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	workers := fs.Int("workers", 0, "# pieces hashed in parallel; one per CPU core if not set")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	raw, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error reading torrent file: %w", err)
+	}
+	tr, err := bcodec.DecodeTorrent(raw)
+	if err != nil {
+		return err
+	}
+	info := tr.Info
+	s, err := storage.NewFile(info, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	pieces, err := storage.Verify(ctx, info, s, *workers, nil)
+	if err != nil {
+		return err
+	}
+	pieceCnt := int(info.PieceCnt())
+	// # bad pieces per file
+	badFiles := make(map[int]int)
+	for i := 0; i < pieceCnt; i++ {
+		if pieces.Has(i) {
+			continue
+		}
+		fmt.Printf("bad piece %d\n", i)
+		for _, f := range storage.PieceFiles(info, i) {
+			badFiles[f]++
+		}
+	}
+	fileCnt := len(info.Files)
+	if fileCnt == 0 {
+		fileCnt = 1
+	}
+	for f := 0; f < fileCnt; f++ {
+		if n := badFiles[f]; n > 0 {
+			path := info.Name
+			if len(info.Files) > 0 {
+				path = info.Files[f].Path
+			}
+			fmt.Printf("bad file %s: %d bad pieces\n", path, n)
+		}
+	}
+	fmt.Printf("%d of %d pieces ok\n", pieces.Count(), pieceCnt)
+	if pieces.Count() != pieceCnt {
+		return fmt.Errorf("%d pieces are bad", pieceCnt-pieces.Count())
+	}
+	return nil
+}